@@ -1,3 +1,7 @@
 module fw
 
 go 1.24.1
+
+require protocol v0.0.0
+
+replace protocol => ../protocol
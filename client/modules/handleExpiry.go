@@ -0,0 +1,46 @@
+package modules
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExpiresAt is an RFC 3339 time after which the client refuses to run. It
+// can be built in with -ldflags "-X fw/modules.ExpiresAt=<time>" so a copy
+// left behind on a host stops working, or given with --expires. When both
+// are set the earlier one applies.
+var ExpiresAt = ""
+
+// Now is the clock the client checks expiry and engagement windows against
+var Now = time.Now
+
+// Expiry returns the effective expiry time from the built-in ExpiresAt and
+// the given value. The zero time means the client does not expire.
+func Expiry(given string) (time.Time, error) {
+	var expiry time.Time
+	for _, value := range []string{ExpiresAt, given} {
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expiry time %q: %v", value, err)
+		}
+		if expiry.IsZero() || t.Before(expiry) {
+			expiry = t
+		}
+	}
+	return expiry, nil
+}
+
+// CheckExpiry refuses to run once the effective expiry time has passed
+func CheckExpiry(given string) error {
+	expiry, err := Expiry(given)
+	if err != nil {
+		return err
+	}
+	if !expiry.IsZero() && !Now().Before(expiry) {
+		return fmt.Errorf("this client expired at %s", expiry.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -1,19 +1,18 @@
 package modules
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+
+	"protocol"
 )
 
 // MaxPayloadLength is the maximum allowed length for request path
-const MaxPayloadLength = 2000
+const MaxPayloadLength = protocol.MaxPayloadLength
 
 // SplitHexString splits a hex string into chunks of specified size
 func SplitHexString(hexString string, chunkSize int) []string {
@@ -31,9 +30,9 @@ func SplitHexString(hexString string, chunkSize int) []string {
 	return chunks
 }
 
-// CalculateMD5 computes MD5 hash of a string
-func CalculateMD5(data string) string {
-	hash := md5.Sum([]byte(data))
+// CalculateSHA256 computes the SHA-256 hash of a string
+func CalculateSHA256(data string) string {
+	hash := sha256.Sum256([]byte(data))
 	return hex.EncodeToString(hash[:])
 }
 
@@ -43,14 +42,8 @@ func CalculateOptimalChunkSize(data string) int {
 	dataLen := len(data)
 
 	// Calculate maximum chunk size based on MaxPayloadLength
-	// Format: chunk/transferID/index/checksum/data
-	// Estimate overhead for path components (excluding data)
-	// transferID = 32 chars (MD5)
-	// index = ~10 chars max (for large files)
-	// checksum = 32 chars (MD5)
-	// separators = ~10 chars
-	const pathOverhead = 84 // "chunk/" + transferID + "/" + index + "/" + checksum + "/"
-	maxChunkSize := MaxPayloadLength - pathOverhead
+	// minus everything in a signed chunk path except the data
+	maxChunkSize := MaxPayloadLength - protocol.ChunkPathOverhead
 
 	// Ensure maxChunkSize is positive
 	if maxChunkSize <= 0 {
@@ -89,40 +82,63 @@ func Min(a, b int) int {
 	return b
 }
 
-// EncryptFile reads a file, encrypts it with AES-256 using a provided key string,
-// and returns the encrypted data as a hex string
-func OriginalEncryptFile(filePath string, keyString string) (string, error) {
+// NewTransferID returns a random transfer ID. It is chosen before the file
+// is encrypted because the payload key is derived from it.
+func NewTransferID() (string, error) {
+	id := make([]byte, protocol.TransferIDLength/2)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", fmt.Errorf("failed to generate transfer ID: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// EncryptFile reads a file, encrypts it with AES-256 under a key derived for
+// the transfer from the provided key string, and returns the encrypted data
+// as a hex string. The payload is a salt followed by the segment stream
+// described in protocol/stream.go.
+func OriginalEncryptFile(filePath string, keyString string, transferID string) (string, error) {
 	// Read file to encrypt
 	plaintext, err := os.ReadFile(filePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read file: %v", err)
 	}
 
-	// Convert string key to 32-byte key using SHA-256
-	hasher := sha256.New()
-	hasher.Write([]byte(keyString))
-	key := hasher.Sum(nil)
-
-	// Create AES cipher
-	block, err := aes.NewCipher(key)
+	// Derive this transfer's key from the shared key and a fresh salt
+	salt, err := protocol.NewPayloadSalt()
 	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %v", err)
+		return "", err
 	}
+	key := protocol.DerivePayloadKey(keyString, salt, transferID)
 
 	// Create GCM mode which provides authenticated encryption
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := protocol.NewStreamAEAD(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %v", err)
+		return "", err
 	}
 
-	// Create nonce (number used once)
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+	// Create the random nonce prefix shared by all segments
+	prefix := make([]byte, protocol.StreamNoncePrefixSize)
+	if _, err = io.ReadFull(rand.Reader, prefix); err != nil {
 		return "", fmt.Errorf("failed to generate nonce: %v", err)
 	}
 
-	// Encrypt and authenticate data
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	// Encrypt and authenticate data segment by segment
+	ciphertext := make([]byte, 0, protocol.EncryptedSize(int64(len(plaintext))))
+	ciphertext = append(ciphertext, salt...)
+	ciphertext = append(ciphertext, prefix...)
+	for counter := uint32(0); ; counter++ {
+		segment := plaintext
+		if len(segment) > protocol.StreamSegmentSize {
+			segment = segment[:protocol.StreamSegmentSize]
+		}
+		plaintext = plaintext[len(segment):]
+		final := len(plaintext) == 0
+
+		ciphertext = gcm.Seal(ciphertext, protocol.StreamNonce(prefix, counter, final), segment, nil)
+		if final {
+			break
+		}
+	}
 
 	// Convert to hex
 	return hex.EncodeToString(ciphertext), nil
@@ -130,8 +146,8 @@ func OriginalEncryptFile(filePath string, keyString string) (string, error) {
 
 // EncryptFile is a wrapper for the actual EncryptFile function in your existing module
 // This is just a placeholder that calls the real function
-func EncryptFile(filePath, key string) (string, error) {
+func EncryptFile(filePath, key, transferID string) (string, error) {
 	// Assuming the actual implementation is already in fw/modules
 	// and we're just providing a consistent interface here
-	return OriginalEncryptFile(filePath, key)
+	return OriginalEncryptFile(filePath, key, transferID)
 }
@@ -0,0 +1,48 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"protocol"
+)
+
+// ManifestPublicKey is the hex ed25519 key engagement manifests must be
+// signed with. It can be built in with
+// -ldflags "-X fw/modules.ManifestPublicKey=<hex>" or given with --manifest-key.
+var ManifestPublicKey = ""
+
+// LoadManifest reads a signed engagement manifest and verifies it against
+// the hex public key
+func LoadManifest(path, publicKey string) (*protocol.Manifest, error) {
+	if publicKey == "" {
+		return nil, fmt.Errorf("no manifest public key. Use --manifest-key to specify")
+	}
+	key, err := protocol.ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return protocol.LoadManifest(data, key)
+}
+
+// CheckEngagement refuses a transfer that the manifest does not cover: the
+// engagement must be current, baseURL in scope and the encrypted file
+// within the byte limit
+func CheckEngagement(m *protocol.Manifest, baseURL string, fileSize int64, now time.Time) error {
+	if err := m.CheckWindow(now); err != nil {
+		return err
+	}
+	if !m.InScope(baseURL) {
+		return fmt.Errorf("URL %s is not in scope for engagement %s", baseURL, m.EngagementID)
+	}
+	if size := protocol.EncryptedSize(fileSize); size > m.MaxTotalBytes {
+		return fmt.Errorf("file encrypts to %d bytes, engagement %s allows at most %d",
+			size, m.EngagementID, m.MaxTotalBytes)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"protocol"
+)
+
+// ChunkDelay is the pause between chunk requests
+const ChunkDelay = 500 * time.Millisecond
+
+// PlanRequestLatency is the round trip assumed per request when estimating
+// how long a transfer takes
+const PlanRequestLatency = 250 * time.Millisecond
+
+// Plan describes the traffic a transfer will generate, so it can be
+// reviewed before anything is sent. SendPlan sends exactly these requests.
+type Plan struct {
+	Engagement     string `json:"engagement"`
+	BaseURL        string `json:"base_url"`
+	FileName       string `json:"file_name"`
+	TransferID     string `json:"transfer_id"`
+	PlaintextBytes int64  `json:"plaintext_bytes"`
+	EncryptedBytes int    `json:"encrypted_bytes"`
+	ChunkSize      int    `json:"chunk_size"`
+	Chunks         int    `json:"chunks"`
+	Requests       int    `json:"requests"`
+	// URLBytes is the length of all request URLs together
+	URLBytes     int `json:"url_bytes"`
+	MaxURLLength int `json:"max_url_length"`
+
+	StatusURL   string `json:"status_url"`
+	InitURL     string `json:"init_url"`
+	ChunkURL    string `json:"chunk_url_template"`
+	CompleteURL string `json:"complete_url"`
+
+	ChunkDelaySeconds     float64 `json:"chunk_delay_seconds"`
+	AssumedLatencySeconds float64 `json:"assumed_latency_seconds"`
+	EstimatedSeconds      float64 `json:"estimated_seconds"`
+
+	// Encoded request paths, in the order they are sent
+	statusBaseURL string
+	statusPath    string
+	initPath      string
+	chunkPaths    []string
+	completePath  string
+}
+
+// NewPlan encrypts the file at filePath for a new transfer and plans its
+// requests, the way the client prepares every transfer
+func NewPlan(filePath, baseURL, statusURL, engagementID, sharedKey string) (*Plan, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick a unique ID for this file transfer; its key is derived from it
+	transferID, err := NewTransferID()
+	if err != nil {
+		return nil, err
+	}
+	encryptedData, err := EncryptFile(filePath, sharedKey, transferID)
+	if err != nil {
+		return nil, fmt.Errorf("encryption failed: %v", err)
+	}
+	chunks := SplitHexString(encryptedData, CalculateOptimalChunkSize(encryptedData))
+	return BuildPlan(baseURL, statusURL, filepath.Base(filePath), engagementID, transferID, info.Size(),
+		encryptedData, chunks, sharedKey)
+}
+
+// BuildPlan encodes every request of a transfer without sending any of them.
+// Status queries go to statusURL, everything else to baseURL.
+func BuildPlan(baseURL, statusURL, fileName, engagementID, transferID string, plaintextSize int64,
+	encryptedData string, chunks []string, sharedKey string) (*Plan, error) {
+	plan := &Plan{
+		Engagement:     engagementID,
+		BaseURL:        baseURL,
+		FileName:       fileName,
+		TransferID:     transferID,
+		PlaintextBytes: plaintextSize,
+		EncryptedBytes: len(encryptedData) / 2,
+		Chunks:         len(chunks),
+		Requests:       len(chunks) + 3,
+
+		ChunkDelaySeconds:     ChunkDelay.Seconds(),
+		AssumedLatencySeconds: PlanRequestLatency.Seconds(),
+
+		statusBaseURL: statusURL,
+	}
+	if len(chunks) > 0 {
+		plan.ChunkSize = len(chunks[0])
+	}
+
+	// The engagement status is checked before the transfer starts
+	statusPath, err := protocol.EncodeStatus(engagementID, sharedKey)
+	if err != nil {
+		return nil, fmt.Errorf("status request: %v", err)
+	}
+	plan.statusPath = statusPath
+	plan.StatusURL = RequestURL(statusURL, statusPath)
+	plan.addURL(plan.StatusURL)
+
+	// Every transfer request is authenticated with a key derived for it
+	macKey := protocol.DeriveMACKey(sharedKey, transferID)
+	initPath, err := protocol.Encode(protocol.Init{
+		TransferID:   transferID,
+		TotalChunks:  len(chunks),
+		FileSize:     len(encryptedData),
+		EngagementID: engagementID,
+		Filename:     fileName,
+	}, macKey)
+	if err != nil {
+		return nil, fmt.Errorf("init request: %v", err)
+	}
+	plan.initPath = initPath
+	plan.InitURL = RequestURL(baseURL, initPath)
+	plan.addURL(plan.InitURL)
+
+	for i, chunk := range chunks {
+		chunkPath, err := protocol.Encode(protocol.Chunk{
+			TransferID: transferID,
+			Index:      i,
+			Checksum:   CalculateSHA256(chunk),
+			Data:       chunk,
+		}, macKey)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %v", i, err)
+		}
+		plan.chunkPaths = append(plan.chunkPaths, chunkPath)
+		plan.addURL(RequestURL(baseURL, chunkPath))
+	}
+	plan.ChunkURL = RequestURL(baseURL, fmt.Sprintf("%s/v%d/%s/{index}/{sha256(data)}/{data}/{mac}",
+		protocol.ActionChunk, protocol.Version, transferID))
+
+	completePath, err := protocol.Encode(protocol.Complete{
+		TransferID: transferID,
+		Checksum:   CalculateSHA256(encryptedData),
+	}, macKey)
+	if err != nil {
+		return nil, fmt.Errorf("complete request: %v", err)
+	}
+	plan.completePath = completePath
+	plan.CompleteURL = RequestURL(baseURL, completePath)
+	plan.addURL(plan.CompleteURL)
+
+	estimate := time.Duration(plan.Requests) * PlanRequestLatency
+	if len(chunks) > 1 {
+		estimate += time.Duration(len(chunks)-1) * ChunkDelay
+	}
+	plan.EstimatedSeconds = estimate.Seconds()
+	return plan, nil
+}
+
+// URLs returns every request URL of the plan in the order they are sent
+func (p *Plan) URLs() []string {
+	urls := []string{p.StatusURL, p.InitURL}
+	for _, path := range p.chunkPaths {
+		urls = append(urls, RequestURL(p.BaseURL, path))
+	}
+	return append(urls, p.CompleteURL)
+}
+
+// addURL counts one request URL
+func (p *Plan) addURL(url string) {
+	p.URLBytes += len(url)
+	if len(url) > p.MaxURLLength {
+		p.MaxURLLength = len(url)
+	}
+}
+
+// Print writes the plan in human-readable form
+func (p *Plan) Print(w io.Writer) {
+	fmt.Fprintf(w, "Transfer plan (no requests have been sent)\n\n")
+	fmt.Fprintf(w, "  Engagement:         %s\n", p.Engagement)
+	fmt.Fprintf(w, "  Receiver:           %s\n", p.BaseURL)
+	fmt.Fprintf(w, "  File:               %s (%d bytes)\n", p.FileName, p.PlaintextBytes)
+	fmt.Fprintf(w, "  Transfer ID:        %s\n", p.TransferID)
+	fmt.Fprintf(w, "  Encrypted size:     %d bytes (%d hex characters)\n", p.EncryptedBytes, p.EncryptedBytes*2)
+	fmt.Fprintf(w, "  Chunks:             %d of up to %d characters\n", p.Chunks, p.ChunkSize)
+	fmt.Fprintf(w, "  Requests:           %d GET (1 status, 1 init, %d chunk, 1 complete)\n", p.Requests, p.Chunks)
+	fmt.Fprintf(w, "  Total URL bytes:    %d (longest URL %d)\n", p.URLBytes, p.MaxURLLength)
+	fmt.Fprintf(w, "  Estimated duration: %s (%gs between chunks, %gs per request assumed)\n",
+		FormatDuration(time.Duration(p.EstimatedSeconds*float64(time.Second))),
+		p.ChunkDelaySeconds, p.AssumedLatencySeconds)
+	fmt.Fprintf(w, "\nRequests:\n")
+	fmt.Fprintf(w, "  1. %s\n", p.StatusURL)
+	fmt.Fprintf(w, "  2. %s\n", p.InitURL)
+	fmt.Fprintf(w, "  3. %s  (x%d, index 0..%d)\n", p.ChunkURL, p.Chunks, p.Chunks-1)
+	fmt.Fprintf(w, "  4. %s\n", p.CompleteURL)
+}
+
+// WriteJSON writes the plan as JSON to path
+func (p *Plan) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
@@ -0,0 +1,51 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"protocol"
+)
+
+// CheckStatus asks the receiver whether the engagement is still active and
+// returns an error unless it positively says so. Any other answer, including
+// none at all, stops the client: the operator revokes an engagement on the
+// receiver to stop every client still holding it.
+func CheckStatus(statusURL, engagementID, sharedKey string) error {
+	path, err := protocol.EncodeStatus(engagementID, sharedKey)
+	if err != nil {
+		return err
+	}
+	return checkStatusPath(statusURL, engagementID, path)
+}
+
+// checkStatusPath sends an already encoded status query
+func checkStatusPath(statusURL, engagementID, path string) error {
+	fullURL := RequestURL(statusURL, path)
+	DebugPrintf("\nStatus URL: %s\n", fullURL)
+	if err := checkPinnedURL(fullURL); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", fullURL, nil)
+	if err != nil {
+		return fmt.Errorf("error creating status request: %v", err)
+	}
+	resp, err := newHTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("engagement status unavailable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var reply ServerResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&reply); err != nil {
+		return fmt.Errorf("engagement status unavailable: %s did not answer as a receiver (%s)", statusURL, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || !reply.OK || reply.Code != protocol.CodeEngagementActive {
+		return fmt.Errorf("engagement %s may not be used: %s (%s)", engagementID, reply.Message, reply.Code)
+	}
+	DebugPrintf("Status: %s\n", reply.Message)
+	return nil
+}
@@ -0,0 +1,87 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ChunkAttempts is how many times a chunk request is tried before the
+// transfer is given up
+const ChunkAttempts = 3
+
+// ErrCompletionFailed is returned by SendPlan when every chunk was sent but
+// the complete request failed
+var ErrCompletionFailed = errors.New("failed to send completion notification")
+
+// SendPlan sends the requests of a plan in order: the engagement status
+// check, init, each chunk with chunkDelay between them, then complete. With
+// progress set it reports each step on stdout.
+func SendPlan(p *Plan, chunkDelay time.Duration, progress bool) error {
+	say := func(format string, args ...interface{}) {
+		if progress {
+			fmt.Printf(format, args...)
+		}
+	}
+
+	// Stop if the operator has revoked the engagement
+	say("Checking engagement status... ")
+	if err := checkStatusPath(p.statusBaseURL, p.Engagement, p.statusPath); err != nil {
+		say("Failed!\n")
+		return fmt.Errorf("refusing to send: %v", err)
+	}
+	say("Active\n")
+
+	// Send initialization request
+	say("Initializing transfer... ")
+	DebugPrintf("Init path length: %d characters\n", len(p.initPath))
+	if err := SendRequest(p.BaseURL, p.initPath); err != nil {
+		say("Failed!\n")
+		return fmt.Errorf("failed to initialize transfer: %v", err)
+	}
+	say("Done!\n")
+
+	// Process each chunk
+	totalChunks := len(p.chunkPaths)
+	startTime := time.Now()
+	if progress {
+		UpdateProgressInPlace(0, totalChunks, startTime)
+	}
+	for i, chunkPath := range p.chunkPaths {
+		var err error
+		for attempt := 1; attempt <= ChunkAttempts; attempt++ {
+			if progress {
+				UpdateProgressInPlace(i+1, totalChunks, startTime)
+			}
+			if err = SendRequest(p.BaseURL, chunkPath); err == nil {
+				break
+			}
+			if attempt < ChunkAttempts {
+				DebugPrintf("\nRetry %d/%d: %v\n", attempt, ChunkAttempts, err)
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err != nil {
+			say("\n")
+			return fmt.Errorf("failed to send chunk %d after %d attempts: %v", i, ChunkAttempts, err)
+		}
+
+		// Small delay between chunks
+		if i < totalChunks-1 {
+			time.Sleep(chunkDelay)
+		}
+	}
+	if progress {
+		UpdateProgressInPlace(totalChunks, totalChunks, startTime)
+	}
+	say("\n")
+
+	// Send completion request
+	say("Finalizing transfer... ")
+	if err := SendRequest(p.BaseURL, p.completePath); err != nil {
+		say("Failed!\n")
+		return fmt.Errorf("%w: %v", ErrCompletionFailed, err)
+	}
+	say("Done!\n")
+	return nil
+}
@@ -0,0 +1,7 @@
+module detect
+
+go 1.22.2
+
+require protocol v0.0.0
+
+replace protocol => ../protocol
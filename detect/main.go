@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	modules "detect/modules"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rules" {
+		if err := runRules(os.Args[2:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	fs := flag.NewFlagSet("detect", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "Write the report as JSON")
+	verbose := fs.Bool("v", false, "List every matched request of each transfer")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [-json] [-v] [access.log ...]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s rules [-out dir] [-sid-base n]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Finds transfers in web server and proxy access logs (common, combined")
+		fmt.Fprintln(fs.Output(), "or JSON lines). Reads standard input when no file is given. Exits with")
+		fmt.Fprintln(fs.Output(), "status 2 when a transfer was found.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	analyzer := modules.NewAnalyzer()
+	unparsed := 0
+
+	files := fs.Args()
+	if len(files) == 0 {
+		n, err := analyzer.Scan(os.Stdin, "stdin")
+		if err != nil {
+			log.Fatalf("Error reading standard input: %v", err)
+		}
+		unparsed += n
+	}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		n, err := analyzer.Scan(f, path)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Error reading %s: %v", path, err)
+		}
+		unparsed += n
+	}
+
+	report := analyzer.Report(unparsed)
+	if *jsonOut {
+		if err := report.WriteJSON(os.Stdout); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	} else {
+		report.WriteText(os.Stdout, *verbose)
+	}
+
+	// A non-zero exit lets scripts notice that transfers were found
+	if len(report.Transfers) > 0 {
+		os.Exit(2)
+	}
+}
+
+// runRules writes Sigma, Suricata and Snort rules for the wire format
+func runRules(args []string) error {
+	fs := flag.NewFlagSet("detect rules", flag.ContinueOnError)
+	out := fs.String("out", "rules", "Directory to write the rules to")
+	sidBase := fs.Int("sid-base", modules.DefaultSIDBase, "First Suricata/Snort signature ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	written, err := modules.WriteRules(*out, *sidBase)
+	if err != nil {
+		return err
+	}
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package detect
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"protocol"
+)
+
+var testID = strings.Repeat("3c", 32)
+
+// signedPaths returns the paths of a transfer of the given chunks
+func signedPaths(t *testing.T, chunks []string) []string {
+	t.Helper()
+	macKey := protocol.DeriveMACKey("k", testID)
+	size := 0
+	for _, c := range chunks {
+		size += len(c)
+	}
+	msgs := []protocol.Message{protocol.Init{
+		TransferID: testID, TotalChunks: len(chunks), FileSize: size, EngagementID: "acme", Filename: "db.sql",
+	}}
+	for i, c := range chunks {
+		msgs = append(msgs, protocol.Chunk{
+			TransferID: testID, Index: i, Checksum: strings.Repeat("0a", 32), Data: c,
+		})
+	}
+	msgs = append(msgs, protocol.Complete{TransferID: testID, Checksum: strings.Repeat("0b", 32)})
+
+	var paths []string
+	for _, m := range msgs {
+		p, err := protocol.Encode(m, macKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, "/"+p+protocol.URLSuffix)
+	}
+	return paths
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		source string
+		method string
+		target string
+		status int
+	}{
+		{`203.0.113.9 - - [16/Oct/2026:10:00:00 +0000] "GET /init/x HTTP/1.1" 404 19`,
+			"203.0.113.9", "GET", "/init/x", 404},
+		{`203.0.113.9 - bob [16/Oct/2026:10:00:00 +0000] "GET /a?b=\"c\" HTTP/1.1" 200 5 "-" "Go-http-client/1.1"`,
+			"203.0.113.9", "GET", `/a?b="c"`, 200},
+		{`{"remote_addr":"10.1.1.1","time_iso8601":"2026-10-16T10:00:00+00:00","request":"GET /p HTTP/1.1","status":200}`,
+			"10.1.1.1", "GET", "/p", 200},
+		{`{"ts":1792144800.5,"request":{"remote_ip":"10.2.2.2","method":"GET","uri":"/q"},"status":502}`,
+			"10.2.2.2", "GET", "/q", 502},
+	}
+	for _, tt := range tests {
+		e, err := ParseLine(tt.line)
+		if err != nil {
+			t.Errorf("ParseLine(%q): %v", tt.line, err)
+			continue
+		}
+		if e.Source != tt.source || e.Method != tt.method || e.Target != tt.target || e.Status != tt.status {
+			t.Errorf("ParseLine(%q) = %+v", tt.line, e)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("ParseLine(%q): no time", tt.line)
+		}
+	}
+
+	for _, bad := range []string{"", "garbage", `{"status":200}`, `{not json`} {
+		if _, err := ParseLine(bad); err == nil {
+			t.Errorf("ParseLine(%q) accepted", bad)
+		}
+	}
+}
+
+func TestMatchTarget(t *testing.T) {
+	paths := signedPaths(t, []string{"deadbeef"})
+	relayed := "/fetch?url=" + url.QueryEscape("http://collector.example.com/drop"+paths[1])
+
+	tests := []struct {
+		target string
+		action protocol.Action
+	}{
+		{paths[0], protocol.ActionInit},
+		{paths[1], protocol.ActionChunk},
+		{paths[2], protocol.ActionComplete},
+		{"/base/path" + paths[1], protocol.ActionChunk},
+		{relayed, protocol.ActionChunk},
+		{"/fetch?u=" + url.QueryEscape(relayed), protocol.ActionChunk},
+		// The unversioned layout with SHA-256 sized fields
+		{"/init/" + testID + "/2/100/a.txt" + protocol.URLSuffix, protocol.ActionInit},
+		{"/complete/" + testID + "/" + testID + protocol.URLSuffix, protocol.ActionComplete},
+	}
+	for _, tt := range tests {
+		hit := MatchTarget(tt.target)
+		if hit == nil || hit.Action != tt.action || hit.TransferID != testID {
+			t.Errorf("MatchTarget(%q) = %+v, want %s", tt.target, hit, tt.action)
+		}
+	}
+
+	for _, miss := range []string{
+		"/init/" + testID + "/2/100/a.txt",
+		"/init/abc/2/100/a.txt" + protocol.URLSuffix,
+		"/chunk/" + testID + "/0/nothex/zz" + protocol.URLSuffix,
+		// MD5 sized IDs only ever appeared unversioned
+		"/init/v3/" + strings.Repeat("ab", 16) + "/1/10/e/a.txt/" + testID + protocol.URLSuffix,
+		"/github.com/foo/bar/@v/v1.info",
+		"/index.html",
+	} {
+		if hit := MatchTarget(miss); hit != nil {
+			t.Errorf("MatchTarget(%q) = %+v, want no match", miss, hit)
+		}
+	}
+}
+
+// baselinePaths returns the paths the original client sent for a file: an
+// MD5 transfer ID, MD5 checksums and no version or MAC
+func baselinePaths(name string, chunks []string) (string, []string) {
+	md5hex := func(s string) string { return fmt.Sprintf("%x", md5.Sum([]byte(s))) }
+	transferID := md5hex(name + "2024-01-01T00:00:00Z")
+	data := strings.Join(chunks, "")
+
+	paths := []string{fmt.Sprintf("/init/%s/%d/%d/%s", transferID, len(chunks), len(data), name)}
+	for i, chunk := range chunks {
+		paths = append(paths, fmt.Sprintf("/chunk/%s/%d/%s/%s", transferID, i, md5hex(chunk), chunk))
+	}
+	paths = append(paths, fmt.Sprintf("/complete/%s/%s", transferID, md5hex(data)))
+	for i := range paths {
+		paths[i] += protocol.URLSuffix
+	}
+	return transferID, paths
+}
+
+func TestAnalyzerBaselineClient(t *testing.T) {
+	transferID, paths := baselinePaths("secrets.txt", []string{"0011223344", "5566778899", "aabb"})
+
+	a := NewAnalyzer()
+	for i, p := range paths {
+		hit := MatchTarget(p)
+		if hit == nil || hit.TransferID != transferID || hit.Version != 0 || hit.Signed {
+			t.Fatalf("MatchTarget(%q) = %+v", p, hit)
+		}
+		a.Add(&Event{Line: i + 1, Source: "10.0.0.1", Target: p})
+	}
+	report := a.Report(0)
+	if report.FullMatches != 1 {
+		t.Fatalf("baseline transfer not fully matched: %+v", report)
+	}
+	tr := report.Transfers[0]
+	if tr.Filename != "secrets.txt" || tr.DeclaredChunks != 3 || tr.UniqueChunks != 3 || tr.Bytes != 12 {
+		t.Errorf("baseline transfer %+v", tr)
+	}
+}
+
+func TestAnalyzerTimeline(t *testing.T) {
+	paths := signedPaths(t, []string{"00112233", "4455", "66778899aa"})
+	start := time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+
+	var log strings.Builder
+	line := func(i int, source, target string) {
+		ts := start.Add(time.Duration(i) * time.Second).Format(clfTimeLayout)
+		fmt.Fprintf(&log, "%s - - [%s] \"GET %s HTTP/1.1\" 200 64 \"-\" \"Go-http-client/1.1\"\n", source, ts, target)
+	}
+	line(0, "198.51.100.7", "/index.html")
+	line(1, "198.51.100.7", paths[0])
+	line(2, "198.51.100.7", paths[1])
+	line(3, "198.51.100.7", paths[1]) // retry
+	line(4, "198.51.100.8", paths[2])
+	log.WriteString("this is not a log line\n")
+	line(5, "198.51.100.7", paths[3])
+	line(6, "198.51.100.7", paths[4])
+
+	a := NewAnalyzer()
+	unparsed, err := a.Scan(strings.NewReader(log.String()), "access.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := a.Report(unparsed)
+
+	if report.Unparsed != 1 || report.Matches != 6 || len(report.Transfers) != 1 || report.FullMatches != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	tr := report.Transfers[0]
+	if tr.TransferID != testID || tr.Version != protocol.Version || !tr.Signed {
+		t.Errorf("transfer %s v%d signed=%v", tr.TransferID, tr.Version, tr.Signed)
+	}
+	if tr.Filename != "db.sql" || tr.Engagement != "acme" || tr.DeclaredChunks != 3 || tr.DeclaredBytes != 11 {
+		t.Errorf("init fields %+v", tr)
+	}
+	if tr.ChunkRequests != 4 || tr.UniqueChunks != 3 || tr.Bytes != 11 {
+		t.Errorf("chunks: %d requests, %d unique, %d bytes", tr.ChunkRequests, tr.UniqueChunks, tr.Bytes)
+	}
+	if len(tr.Sources) != 2 || tr.LastSeen.Sub(tr.FirstSeen) != 5*time.Second {
+		t.Errorf("sources %v, window %s", tr.Sources, tr.LastSeen.Sub(tr.FirstSeen))
+	}
+	if len(tr.Timeline) != 6 || tr.Timeline[0].Line != 2 {
+		t.Errorf("timeline %+v", tr.Timeline)
+	}
+}
+
+func TestScanSkipsOverlongLines(t *testing.T) {
+	paths := signedPaths(t, []string{"00112233"})
+	var log strings.Builder
+	for i, p := range paths {
+		fmt.Fprintf(&log, "10.0.0.1 - - [16/Oct/2026:10:00:0%d +0000] \"GET %s HTTP/1.1\" 200 64 \"-\" \"-\"\n", i, p)
+		if i == 0 {
+			fmt.Fprintf(&log, "10.0.0.1 - - [16/Oct/2026:10:00:00 +0000] \"GET /%s HTTP/1.1\" 200 64 \"-\" \"-\"\r\n",
+				strings.Repeat("a", 2*maxLineLength))
+		}
+	}
+
+	a := NewAnalyzer()
+	unparsed, err := a.Scan(strings.NewReader(log.String()), "access.log")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	report := a.Report(unparsed)
+	if report.Unparsed != 1 || report.FullMatches != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if tl := report.Transfers[0].Timeline; tl[len(tl)-1].Line != len(paths)+1 {
+		t.Errorf("line numbers not kept across the skipped line: %+v", tl)
+	}
+}
+
+func TestAnalyzerPartialTransfer(t *testing.T) {
+	paths := signedPaths(t, []string{"00", "11", "22", "33"})
+
+	a := NewAnalyzer()
+	for i, p := range []string{paths[0], paths[1], paths[4]} {
+		a.Add(&Event{Line: i + 1, Source: "10.0.0.1", Target: p})
+	}
+	report := a.Report(0)
+	tr := report.Transfers[0]
+	if tr.FullSequence || report.FullMatches != 0 {
+		t.Error("partial transfer reported as a full sequence")
+	}
+	if fmt.Sprint(tr.MissingChunks) != "[1 2]" || tr.CompleteSeen {
+		t.Errorf("missing %v, complete %v", tr.MissingChunks, tr.CompleteSeen)
+	}
+
+	var out strings.Builder
+	report.WriteText(&out, true)
+	if !strings.Contains(out.String(), "Missing:    1-2") {
+		t.Errorf("text report does not list the missing chunks:\n%s", out.String())
+	}
+}
+
+func TestAnalyzerHugeDeclaredChunks(t *testing.T) {
+	a := NewAnalyzer()
+	a.Add(&Event{Line: 1, Source: "10.0.0.1", Target: "/init/" + testID + "/999999999999/8/db.sql" + protocol.URLSuffix})
+	report := a.Report(0)
+	if len(report.Transfers) != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	tr := report.Transfers[0]
+	if tr.DeclaredChunks != 999999999999 || tr.MissingCount != 999999999999 || len(tr.MissingChunks) != maxListedMissing {
+		t.Errorf("declared %d, missing %d, listed %d", tr.DeclaredChunks, tr.MissingCount, len(tr.MissingChunks))
+	}
+
+	var out strings.Builder
+	report.WriteText(&out, false)
+	if !strings.Contains(out.String(), fmt.Sprintf("0-%d and %d more", maxListedMissing-1, 999999999999-maxListedMissing)) {
+		t.Errorf("text report does not count the unlisted chunks:\n%s", out.String())
+	}
+}
+
+func TestRulesMatchEncodedPaths(t *testing.T) {
+	paths := signedPaths(t, []string{"00112233"})
+	legacy := "/init/" + testID + "/1/8/db.sql" + protocol.URLSuffix
+	_, baseline := baselinePaths("db.sql", []string{"00112233"})
+	status, err := protocol.EncodeStatus("acme", "k")
+	if err != nil {
+		t.Fatalf("EncodeStatus: %v", err)
+	}
+	paths = append(paths, legacy)
+	paths = append(paths, baseline...)
+	paths = append(paths, "/"+status+protocol.URLSuffix)
+
+	for _, r := range Rules() {
+		for i, p := range paths {
+			want := (i < len(paths)-1 && r.Name == "any-version") || (i == len(paths)-1 && r.Name == "status") ||
+				(i == 0 && r.Name == "init") || (i == 1 && r.Name == "chunk") || (i == 2 && r.Name == "complete")
+			if got := r.MatchURI("/proxy" + p); got != want {
+				t.Errorf("rule %s: MatchURI(%.40s...) = %v, want %v", r.Name, p, got, want)
+			}
+		}
+	}
+}
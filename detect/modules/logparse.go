@@ -0,0 +1,207 @@
+package detect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is one request taken from an access log
+type Event struct {
+	File      string
+	Line      int
+	Time      time.Time
+	Source    string
+	Method    string
+	Target    string // request target as logged: path, query or absolute URL
+	Status    int
+	UserAgent string
+}
+
+// clfPattern matches the common log format, optionally followed by the
+// referer and user agent of the combined format
+var clfPattern = regexp.MustCompile(
+	`^(\S+) \S+ \S+ \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}|-) (\d+|-)(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+
+// clfTimeLayout is the timestamp layout of common/combined logs
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// ParseLine parses one access log line. JSON objects are read as JSON lines,
+// anything else as common or combined log format.
+func ParseLine(line string) (*Event, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, errors.New("empty line")
+	}
+	if strings.HasPrefix(line, "{") {
+		return parseJSONLine(line)
+	}
+	return parseCLFLine(line)
+}
+
+// parseCLFLine parses a common or combined log format line
+func parseCLFLine(line string) (*Event, error) {
+	m := clfPattern.FindStringSubmatch(line)
+	if m == nil {
+		return nil, errors.New("not a common/combined log line")
+	}
+
+	event := &Event{Source: m[1], UserAgent: unescapeCLF(m[7])}
+	if t, err := time.Parse(clfTimeLayout, m[2]); err == nil {
+		event.Time = t
+	}
+	event.Method, event.Target = splitRequestLine(unescapeCLF(m[3]))
+	if status, err := strconv.Atoi(m[4]); err == nil {
+		event.Status = status
+	}
+	return event, nil
+}
+
+// unescapeCLF undoes the escaping web servers apply inside quoted fields
+func unescapeCLF(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(s)
+}
+
+// splitRequestLine splits "GET /path HTTP/1.1" into method and target
+func splitRequestLine(request string) (string, string) {
+	fields := strings.Fields(request)
+	switch len(fields) {
+	case 0:
+		return "", ""
+	case 1:
+		return "", fields[0]
+	default:
+		return fields[0], fields[1]
+	}
+}
+
+// JSON log field names, in order of preference. These cover the usual
+// nginx, Caddy, Envoy and proxy log configurations.
+var (
+	jsonSourceFields  = []string{"remote_addr", "client_ip", "remote_ip", "src_ip", "client", "ip", "host"}
+	jsonTimeFields    = []string{"time", "timestamp", "@timestamp", "time_local", "time_iso8601", "ts"}
+	jsonRequestFields = []string{"request", "request_line"}
+	jsonTargetFields  = []string{"request_uri", "uri", "url", "path", "target"}
+	jsonMethodFields  = []string{"method", "request_method"}
+	jsonStatusFields  = []string{"status", "status_code", "response_code"}
+	jsonAgentFields   = []string{"http_user_agent", "user_agent", "ua"}
+)
+
+// parseJSONLine parses one JSON object. Nested objects such as Caddy's
+// "request" are flattened so their fields are found too.
+func parseJSONLine(line string) (*Event, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	fields := make(map[string]interface{})
+	flatten(raw, fields)
+
+	event := &Event{
+		Source:    firstString(fields, jsonSourceFields),
+		Method:    firstString(fields, jsonMethodFields),
+		Target:    firstString(fields, jsonTargetFields),
+		UserAgent: firstString(fields, jsonAgentFields),
+	}
+	if request := firstString(fields, jsonRequestFields); request != "" {
+		method, target := splitRequestLine(request)
+		if event.Method == "" {
+			event.Method = method
+		}
+		if event.Target == "" {
+			event.Target = target
+		}
+	}
+	if event.Target == "" {
+		return nil, errors.New("no request target in JSON line")
+	}
+	event.Time = parseJSONTime(firstValue(fields, jsonTimeFields))
+	event.Status = int(toNumber(firstValue(fields, jsonStatusFields)))
+	return event, nil
+}
+
+// flatten copies nested object fields into out; top-level fields win
+func flatten(in map[string]interface{}, out map[string]interface{}) {
+	var nested []map[string]interface{}
+	for k, v := range in {
+		if obj, ok := v.(map[string]interface{}); ok {
+			nested = append(nested, obj)
+			continue
+		}
+		if _, exists := out[k]; !exists {
+			out[k] = v
+		}
+	}
+	for _, obj := range nested {
+		flatten(obj, out)
+	}
+}
+
+func firstValue(fields map[string]interface{}, names []string) interface{} {
+	for _, name := range names {
+		if v, ok := fields[name]; ok && v != nil && v != "" {
+			return v
+		}
+	}
+	return nil
+}
+
+func firstString(fields map[string]interface{}, names []string) string {
+	switch v := firstValue(fields, names).(type) {
+	case string:
+		return v
+	case []interface{}:
+		// Some loggers record headers as lists
+		if len(v) > 0 {
+			if s, ok := v[0].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+func toNumber(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case string:
+		f, _ := strconv.ParseFloat(n, 64)
+		return f
+	}
+	return 0
+}
+
+// parseJSONTime accepts RFC 3339, common log format and Unix timestamps
+func parseJSONTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, clfTimeLayout, "2006-01-02 15:04:05"} {
+			if parsed, err := time.Parse(layout, t); err == nil {
+				return parsed
+			}
+		}
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return unixTime(f)
+		}
+	case float64:
+		return unixTime(t)
+	}
+	return time.Time{}
+}
+
+// unixTime converts seconds or milliseconds since the epoch
+func unixTime(f float64) time.Time {
+	if f > 1e12 {
+		f /= 1000
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)).UTC()
+}
@@ -0,0 +1,148 @@
+package detect
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"protocol"
+)
+
+// Hit is a request that matches the transfer wire format
+type Hit struct {
+	Action     protocol.Action
+	Version    int // 0 for the unversioned format
+	TransferID string
+	Signed     bool
+
+	// init
+	TotalChunks int
+	FileSize    int
+	Engagement  string
+	Filename    string
+
+	// chunk
+	Index     int
+	Checksum  string
+	DataBytes int
+}
+
+// requestPattern finds a transfer request anywhere in a decoded target, so
+// requests relayed through another service (for example as a query
+// parameter of a fetch endpoint) are caught as well. Clients from before
+// versioning used 32 hex character MD5 transfer IDs.
+var requestPattern = regexp.MustCompile(
+	`(?:^|[/=])(init|chunk|complete)/(?:v([0-9]{1,3})/)?([0-9a-f]{64}|[0-9a-f]{32})/([^?#\s]*?)` +
+		regexp.QuoteMeta(protocol.URLSuffix) + `(?:$|[?#&\s])`)
+
+var (
+	numberPattern = regexp.MustCompile(`^-?[0-9]+$`)
+	digestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	hexPattern    = regexp.MustCompile(`^[0-9a-f]+$`)
+
+	// legacyDigestPattern also accepts the MD5 checksums of the unversioned layout
+	legacyDigestPattern = regexp.MustCompile(`^(?:[0-9a-f]{32}|[0-9a-f]{64})$`)
+)
+
+// maxDecodeRounds bounds how often a target is percent-decoded; relayed
+// URLs are typically encoded once or twice
+const maxDecodeRounds = 3
+
+// MatchTarget checks a logged request target against the wire format
+func MatchTarget(target string) *Hit {
+	candidate := target
+	for round := 0; ; round++ {
+		if hit := matchDecoded(candidate); hit != nil {
+			return hit
+		}
+		if round == maxDecodeRounds {
+			return nil
+		}
+		decoded, err := url.QueryUnescape(candidate)
+		if err != nil || decoded == candidate {
+			decoded, err = url.PathUnescape(candidate)
+			if err != nil || decoded == candidate {
+				return nil
+			}
+		}
+		candidate = decoded
+	}
+}
+
+// matchDecoded matches a target that needs no further decoding
+func matchDecoded(target string) *Hit {
+	for _, m := range requestPattern.FindAllStringSubmatch(target, -1) {
+		hit := &Hit{Action: protocol.Action(m[1]), TransferID: m[3]}
+		if m[2] != "" {
+			hit.Version, _ = strconv.Atoi(m[2])
+			if len(hit.TransferID) != protocol.TransferIDLength {
+				continue
+			}
+		}
+		if parseFields(hit, strings.Split(m[4], "/")) {
+			return hit
+		}
+	}
+	return nil
+}
+
+// parseFields reads the fields after the transfer ID. Both the original
+// unsigned layout and the versioned, signed one are accepted.
+func parseFields(hit *Hit, fields []string) bool {
+	checksum := digestPattern
+	if hit.Version == 0 {
+		checksum = legacyDigestPattern
+	}
+
+	// A trailing MAC is the same shape as a digest
+	withMAC := func(n int) bool {
+		if len(fields) == n+1 && digestPattern.MatchString(fields[n]) {
+			hit.Signed = true
+			return true
+		}
+		return len(fields) == n
+	}
+
+	switch hit.Action {
+	case protocol.ActionInit:
+		// <n>/<size>/<name>, <n>/<size>/<engagement>/<name>, each optionally signed
+		if len(fields) < 3 || !numberPattern.MatchString(fields[0]) || !numberPattern.MatchString(fields[1]) {
+			return false
+		}
+		hit.TotalChunks, _ = strconv.Atoi(fields[0])
+		hit.FileSize, _ = strconv.Atoi(fields[1])
+		rest := fields[2:]
+		if len(rest) > 1 && digestPattern.MatchString(rest[len(rest)-1]) {
+			hit.Signed = true
+			rest = rest[:len(rest)-1]
+		}
+		switch len(rest) {
+		case 1:
+			hit.Filename = rest[0]
+		case 2:
+			hit.Engagement, hit.Filename = rest[0], rest[1]
+		default:
+			return false
+		}
+		return true
+
+	case protocol.ActionChunk:
+		if len(fields) < 3 || !numberPattern.MatchString(fields[0]) ||
+			!checksum.MatchString(fields[1]) || !hexPattern.MatchString(fields[2]) {
+			return false
+		}
+		hit.Index, _ = strconv.Atoi(fields[0])
+		hit.Checksum = fields[1]
+		hit.DataBytes = len(fields[2]) / 2
+		return withMAC(3)
+
+	case protocol.ActionComplete:
+		if len(fields) < 1 || !checksum.MatchString(fields[0]) {
+			return false
+		}
+		hit.Checksum = fields[0]
+		return withMAC(1)
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package detect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Report is the outcome of analysing a set of logs
+type Report struct {
+	Lines       int         `json:"lines"`
+	Unparsed    int         `json:"unparsed"`
+	Matches     int         `json:"matches"`
+	Transfers   []*Transfer `json:"transfers"`
+	FullMatches int         `json:"full_sequences"`
+}
+
+// Report summarises what the analyzer has seen; unparsed is the number of
+// log lines that could not be read
+func (a *Analyzer) Report(unparsed int) *Report {
+	r := &Report{Lines: a.Lines + unparsed, Unparsed: unparsed, Matches: a.Matches, Transfers: a.Transfers()}
+	for _, t := range r.Transfers {
+		if t.FullSequence {
+			r.FullMatches++
+		}
+	}
+	return r
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the report for a human reader. With verbose set every
+// request of each timeline is listed.
+func (r *Report) WriteText(w io.Writer, verbose bool) {
+	fmt.Fprintf(w, "Scanned %d log lines (%d unreadable), %d matched the transfer wire format\n",
+		r.Lines, r.Unparsed, r.Matches)
+	fmt.Fprintf(w, "Transfers found: %d (%d with a full init -> chunk -> complete sequence)\n",
+		len(r.Transfers), r.FullMatches)
+
+	for _, t := range r.Transfers {
+		fmt.Fprintf(w, "\nTransfer %s\n", t.TransferID)
+		status := "partial"
+		if t.FullSequence {
+			status = "full sequence"
+		}
+		version := "unversioned"
+		if t.Version > 0 {
+			version = fmt.Sprintf("v%d", t.Version)
+		}
+		fmt.Fprintf(w, "  Status:     %s (%s, signed: %v)\n", status, version, t.Signed)
+		fmt.Fprintf(w, "  Sources:    %s\n", strings.Join(t.Sources, ", "))
+		if t.InitSeen {
+			fmt.Fprintf(w, "  File:       %q, %d bytes declared in %d chunks\n", t.Filename, t.DeclaredBytes, t.DeclaredChunks)
+		} else {
+			fmt.Fprintf(w, "  File:       init request not seen\n")
+		}
+		if t.Engagement != "" {
+			fmt.Fprintf(w, "  Engagement: %s\n", t.Engagement)
+		}
+		fmt.Fprintf(w, "  Chunks:     %d requests, %d distinct, %d bytes\n", t.ChunkRequests, t.UniqueChunks, t.Bytes)
+		if len(t.MissingChunks) > 0 {
+			more := ""
+			if extra := t.MissingCount - len(t.MissingChunks); extra > 0 {
+				more = fmt.Sprintf(" and %d more", extra)
+			}
+			fmt.Fprintf(w, "  Missing:    %s%s\n", summariseIndexes(t.MissingChunks), more)
+		}
+		fmt.Fprintf(w, "  Complete:   %v\n", t.CompleteSeen)
+		if !t.FirstSeen.IsZero() {
+			fmt.Fprintf(w, "  Window:     %s to %s (%s)\n", t.FirstSeen.Format(time.RFC3339),
+				t.LastSeen.Format(time.RFC3339), t.LastSeen.Sub(t.FirstSeen))
+		}
+
+		if verbose {
+			for _, e := range t.Timeline {
+				detail := ""
+				if e.Index != nil {
+					detail = fmt.Sprintf(" #%d (%d bytes)", *e.Index, e.Bytes)
+				}
+				fmt.Fprintf(w, "    %s:%-6d %s %-15s %-8s%s status %d\n",
+					e.File, e.Line, e.Time.Format(time.RFC3339), e.Source, e.Action, detail, e.Status)
+			}
+		}
+	}
+}
+
+// summariseIndexes prints runs of indexes compactly, such as "0-4, 7"
+func summariseIndexes(indexes []int) string {
+	var parts []string
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprint(indexes[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indexes[i], indexes[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,258 @@
+package detect
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"protocol"
+)
+
+// DefaultSIDBase is the first signature ID used for generated Suricata and
+// Snort rules. It lies in the range reserved for local rules.
+const DefaultSIDBase = 1946000
+
+// Rule is one detection, described once and rendered as Sigma, Suricata and
+// Snort rules. A request URI matches when it contains every string in
+// Contents, ends with Suffix and matches Pattern.
+type Rule struct {
+	Name        string
+	Title       string
+	Description string
+	Level       string // Sigma level
+	Contents    []string
+	Suffix      string
+	Pattern     string
+	pattern     *regexp.Regexp
+}
+
+// MatchURI reports whether a request URI, as seen by a proxy or web server,
+// matches the rule
+func (r *Rule) MatchURI(uri string) bool {
+	for _, c := range r.Contents {
+		if !strings.Contains(uri, c) {
+			return false
+		}
+	}
+	return strings.HasSuffix(uri, r.Suffix) && r.pattern.MatchString(uri)
+}
+
+// Expressions for the fields of a request path, built from the protocol
+// constants so the rules follow the wire format
+var (
+	numberField = `[0-9]+`
+	suffixExpr  = regexp.QuoteMeta(protocol.URLSuffix)
+)
+
+// hexField matches a fixed-width hex field
+func hexField(n int) string {
+	return fmt.Sprintf("[0-9a-f]{%d}", n)
+}
+
+// Rules returns the rules for the current wire format
+func Rules() []*Rule {
+	version := fmt.Sprintf("v%d", protocol.Version)
+	prefix := func(action protocol.Action) string {
+		return "/" + string(action) + "/" + version + "/"
+	}
+	id := hexField(protocol.TransferIDLength)
+	mac := hexField(protocol.MACLength)
+	// Unversioned clients used 32-character MD5 transfer IDs
+	anyID := `(` + hexField(32) + `|` + id + `)`
+
+	rules := []*Rule{
+		{
+			Name:  "init",
+			Title: fmt.Sprintf("SSRFLEAK transfer init request (protocol %s)", version),
+			Description: "A request announcing a new transfer: transfer ID, chunk count, size, " +
+				"engagement and filename, disguised as a Go module proxy lookup.",
+			Level:    "high",
+			Contents: []string{prefix(protocol.ActionInit)},
+			Suffix:   protocol.URLSuffix,
+			Pattern: regexp.QuoteMeta(prefix(protocol.ActionInit)) + strings.Join([]string{
+				id, numberField, numberField, protocol.EngagementIDExpr, `[^/]+`, mac,
+			}, "/") + suffixExpr + `$`,
+		},
+		{
+			Name:  "chunk",
+			Title: fmt.Sprintf("SSRFLEAK transfer chunk request (protocol %s)", version),
+			Description: fmt.Sprintf("A request carrying one hex-encoded chunk of ciphertext. "+
+				"Chunk paths are up to %d characters long.", protocol.MaxPayloadLength),
+			Level:    "high",
+			Contents: []string{prefix(protocol.ActionChunk)},
+			Suffix:   protocol.URLSuffix,
+			Pattern: regexp.QuoteMeta(prefix(protocol.ActionChunk)) + strings.Join([]string{
+				id, numberField, hexField(protocol.ChecksumLength), `[0-9a-f]+`, mac,
+			}, "/") + suffixExpr + `$`,
+		},
+		{
+			Name:        "complete",
+			Title:       fmt.Sprintf("SSRFLEAK transfer complete request (protocol %s)", version),
+			Description: "A request asking the receiver to assemble a transfer.",
+			Level:       "high",
+			Contents:    []string{prefix(protocol.ActionComplete)},
+			Suffix:      protocol.URLSuffix,
+			Pattern: regexp.QuoteMeta(prefix(protocol.ActionComplete)) + strings.Join([]string{
+				id, hexField(protocol.ChecksumLength), mac,
+			}, "/") + suffixExpr + `$`,
+		},
+		{
+			Name:  "any-version",
+			Title: "SSRFLEAK transfer request (any protocol version)",
+			Description: "Any transfer request, including unversioned and unsigned ones " +
+				"from older clients.",
+			Level:  "medium",
+			Suffix: protocol.URLSuffix,
+			Pattern: `/(init|chunk|complete)/(v[0-9]+/)?` + anyID +
+				`/([^/?#]+/)*[^/?#]+` + suffixExpr + `$`,
+		},
+		{
+			Name:  "status",
+			Title: fmt.Sprintf("SSRFLEAK engagement status request (protocol %s)", version),
+			Description: "A request checking that an engagement is still active. The client " +
+				"sends it before any transfer, so it is the earliest indicator.",
+			Level:    "high",
+			Contents: []string{prefix(protocol.ActionStatus)},
+			Suffix:   protocol.URLSuffix,
+			Pattern: regexp.QuoteMeta(prefix(protocol.ActionStatus)) + strings.Join([]string{
+				protocol.EngagementIDExpr, mac,
+			}, "/") + suffixExpr + `$`,
+		},
+	}
+	for _, r := range rules {
+		r.pattern = regexp.MustCompile(r.Pattern)
+	}
+	return rules
+}
+
+// ruleUUID derives a stable Sigma rule ID from the rule name
+func ruleUUID(name string) string {
+	sum := sha256.Sum256([]byte("ssrfleak/sigma/" + name))
+	sum[6] = sum[6]&0x0f | 0x50 // version 5 layout
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// sigmaLogSources are the Sigma log sources each rule is written for, with
+// the field holding the request URI
+var sigmaLogSources = []struct {
+	name     string
+	category string
+	field    string
+}{
+	{"proxy", "proxy", "c-uri"},
+	{"webserver", "webserver", "cs-uri-stem"},
+}
+
+// yamlQuote returns s as a single-quoted YAML scalar
+func yamlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// SigmaRule renders r as a Sigma rule for one log source
+func (r *Rule) SigmaRule(logSource, category, field string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "title: %s\n", yamlQuote(r.Title))
+	fmt.Fprintf(&b, "id: %s\n", ruleUUID(r.Name+"/"+logSource))
+	b.WriteString("status: experimental\n")
+	fmt.Fprintf(&b, "description: %s\n", yamlQuote(r.Description))
+	b.WriteString("author: ssrfleak detect rules\n")
+	b.WriteString("tags:\n    - attack.exfiltration\n    - attack.t1048\n")
+	fmt.Fprintf(&b, "logsource:\n    category: %s\n", category)
+	b.WriteString("detection:\n    selection:\n")
+	if len(r.Contents) > 0 {
+		fmt.Fprintf(&b, "        %s|contains|all:\n", field)
+		for _, c := range r.Contents {
+			fmt.Fprintf(&b, "            - %s\n", yamlQuote(c))
+		}
+	}
+	fmt.Fprintf(&b, "        %s|endswith: %s\n", field, yamlQuote(r.Suffix))
+	fmt.Fprintf(&b, "        %s|re: %s\n", field, yamlQuote(r.Pattern))
+	b.WriteString("    condition: selection\n")
+	b.WriteString("falsepositives:\n    - Authorised ssrfleak testing within an engagement\n")
+	fmt.Fprintf(&b, "level: %s\n", r.Level)
+	return b.String()
+}
+
+// ruleContent escapes s for a Suricata or Snort content match
+func ruleContent(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `;`, `\;`).Replace(s)
+}
+
+// rulePCRE renders a pattern as a quoted PCRE with the given flags
+func rulePCRE(pattern, flags string) string {
+	escaped := strings.NewReplacer(`/`, `\/`, `"`, `\"`, `;`, `\;`).Replace(pattern)
+	return fmt.Sprintf(`"/%s/%s"`, escaped, flags)
+}
+
+// SuricataRule renders r as a Suricata rule using the http.uri buffer
+func (r *Rule) SuricataRule(sid int) string {
+	var opts []string
+	opts = append(opts, fmt.Sprintf(`msg:"%s"`, ruleContent(r.Title)))
+	opts = append(opts, "flow:established,to_server", "http.method", `content:"GET"`, "http.uri")
+	for _, c := range r.Contents {
+		opts = append(opts, fmt.Sprintf(`content:"%s"`, ruleContent(c)))
+	}
+	opts = append(opts, fmt.Sprintf(`content:"%s"`, ruleContent(r.Suffix)), "endswith")
+	opts = append(opts, "pcre:"+rulePCRE(r.Pattern, ""))
+	opts = append(opts, "classtype:policy-violation", fmt.Sprintf("sid:%d", sid), "rev:1")
+	return "alert http any any -> any any (" + strings.Join(opts, "; ") + ";)"
+}
+
+// SnortRule renders r as a Snort 2 rule using http_uri modifiers
+func (r *Rule) SnortRule(sid int) string {
+	var opts []string
+	opts = append(opts, fmt.Sprintf(`msg:"%s"`, ruleContent(r.Title)))
+	opts = append(opts, "flow:established,to_server", `content:"GET"`, "http_method")
+	for _, c := range r.Contents {
+		opts = append(opts, fmt.Sprintf(`content:"%s"`, ruleContent(c)), "http_uri")
+	}
+	opts = append(opts, fmt.Sprintf(`content:"%s"`, ruleContent(r.Suffix)), "http_uri")
+	opts = append(opts, "pcre:"+rulePCRE(r.Pattern, "U"))
+	opts = append(opts, "classtype:policy-violation", fmt.Sprintf("sid:%d", sid), "rev:1")
+	return "alert tcp any any -> any $HTTP_PORTS (" + strings.Join(opts, "; ") + ";)"
+}
+
+// WriteRules writes the rules below dir: one Sigma rule per rule and log
+// source in dir/sigma, and dir/suricata.rules and dir/snort.rules. Existing
+// files are replaced so the directory can be regenerated. It returns the
+// paths written.
+func WriteRules(dir string, sidBase int) ([]string, error) {
+	sigmaDir := filepath.Join(dir, "sigma")
+	if err := os.MkdirAll(sigmaDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating rules directory: %v", err)
+	}
+
+	header := fmt.Sprintf("# Generated by \"detect rules\" for protocol v%d. Do not edit.\n", protocol.Version)
+	var written []string
+	var suricata, snort strings.Builder
+	suricata.WriteString(header)
+	snort.WriteString(header)
+
+	for i, r := range Rules() {
+		for _, src := range sigmaLogSources {
+			path := filepath.Join(sigmaDir, fmt.Sprintf("ssrfleak_%s_%s.yml", r.Name, src.name))
+			if err := os.WriteFile(path, []byte(r.SigmaRule(src.name, src.category, src.field)), 0644); err != nil {
+				return written, fmt.Errorf("error writing %s: %v", path, err)
+			}
+			written = append(written, path)
+		}
+		suricata.WriteString(r.SuricataRule(sidBase+i) + "\n")
+		snort.WriteString(r.SnortRule(sidBase+i) + "\n")
+	}
+
+	for _, file := range []struct{ name, content string }{
+		{"suricata.rules", suricata.String()},
+		{"snort.rules", snort.String()},
+	} {
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, []byte(file.content), 0644); err != nil {
+			return written, fmt.Errorf("error writing %s: %v", path, err)
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
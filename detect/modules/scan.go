@@ -0,0 +1,69 @@
+package detect
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// maxLineLength bounds a single log line; chunk requests make long lines
+const maxLineLength = 1 << 20
+
+// scanLines calls fn with each line of r and its 1-based number. Lines
+// longer than maxLineLength are skipped rather than ending the scan, and
+// their number is returned.
+func scanLines(r io.Reader, fn func(n int, line string)) (int, error) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	n, skipped := 0, 0
+	var line []byte
+	tooLong := false
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(fragment) > maxLineLength+1 {
+				tooLong, line = true, line[:0]
+			} else {
+				line = append(line, fragment...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if len(line) > 0 || tooLong {
+			n++
+			if tooLong {
+				skipped++
+			} else {
+				fn(n, strings.TrimRight(string(line), "\r\n"))
+			}
+		}
+		line, tooLong = line[:0], false
+		if err == io.EOF {
+			return skipped, nil
+		}
+		if err != nil {
+			return skipped, err
+		}
+	}
+}
+
+// Scan reads the log lines of the named file from r into the analyzer and
+// returns the number of lines that could not be parsed, including lines
+// too long to be read
+func (a *Analyzer) Scan(r io.Reader, name string) (int, error) {
+	unparsed := 0
+	skipped, err := scanLines(r, func(n int, line string) {
+		if strings.TrimSpace(line) == "" {
+			return
+		}
+		event, err := ParseLine(line)
+		if err != nil {
+			unparsed++
+			return
+		}
+		event.File = name
+		event.Line = n
+		a.Add(event)
+	})
+	return unparsed + skipped, err
+}
@@ -0,0 +1,186 @@
+package detect
+
+import (
+	"sort"
+	"time"
+
+	"protocol"
+)
+
+// TimelineEntry is one matched request of a transfer
+type TimelineEntry struct {
+	File   string          `json:"file,omitempty"`
+	Line   int             `json:"line"`
+	Time   time.Time       `json:"time"`
+	Source string          `json:"source"`
+	Action protocol.Action `json:"action"`
+	Index  *int            `json:"index,omitempty"`
+	Bytes  int             `json:"bytes,omitempty"`
+	Status int             `json:"status,omitempty"`
+}
+
+// Transfer is the reconstructed view of one transfer
+type Transfer struct {
+	TransferID string   `json:"transfer_id"`
+	Version    int      `json:"version"`
+	Signed     bool     `json:"signed"`
+	Sources    []string `json:"sources"`
+	Filename   string   `json:"filename,omitempty"`
+	Engagement string   `json:"engagement,omitempty"`
+
+	// Declared by the init request
+	DeclaredChunks int `json:"declared_chunks"`
+	DeclaredBytes  int `json:"declared_bytes"`
+
+	ChunkRequests int `json:"chunk_requests"`
+	UniqueChunks  int `json:"unique_chunks"`
+	// MissingChunks lists the first maxListedMissing declared chunks not
+	// seen; MissingCount counts all of them
+	MissingChunks []int `json:"missing_chunks,omitempty"`
+	MissingCount  int   `json:"missing_count"`
+	// Bytes is the decoded size of the distinct chunks seen
+	Bytes int `json:"bytes"`
+
+	InitSeen     bool `json:"init_seen"`
+	CompleteSeen bool `json:"complete_seen"`
+	// FullSequence is set when init, every chunk and complete were all seen
+	FullSequence bool `json:"full_sequence"`
+
+	FirstSeen time.Time       `json:"first_seen"`
+	LastSeen  time.Time       `json:"last_seen"`
+	Timeline  []TimelineEntry `json:"timeline"`
+
+	chunks map[int]int
+}
+
+// Analyzer groups matched requests into transfers
+type Analyzer struct {
+	transfers map[string]*Transfer
+	order     []string
+	// Lines and Matches count the events seen and those that matched
+	Lines   int
+	Matches int
+}
+
+// NewAnalyzer returns an empty analyzer
+func NewAnalyzer() *Analyzer {
+	return &Analyzer{transfers: make(map[string]*Transfer)}
+}
+
+// Add checks one log event and records it if it is a transfer request
+func (a *Analyzer) Add(event *Event) *Hit {
+	a.Lines++
+	hit := MatchTarget(event.Target)
+	if hit == nil {
+		return nil
+	}
+	a.Matches++
+
+	t, ok := a.transfers[hit.TransferID]
+	if !ok {
+		t = &Transfer{TransferID: hit.TransferID, chunks: make(map[int]int)}
+		a.transfers[hit.TransferID] = t
+		a.order = append(a.order, hit.TransferID)
+	}
+	t.record(event, hit)
+	return hit
+}
+
+// record adds a matched request to the transfer
+func (t *Transfer) record(event *Event, hit *Hit) {
+	if hit.Version > t.Version {
+		t.Version = hit.Version
+	}
+	t.Signed = t.Signed || hit.Signed
+	if event.Source != "" && !contains(t.Sources, event.Source) {
+		t.Sources = append(t.Sources, event.Source)
+	}
+
+	entry := TimelineEntry{
+		File:   event.File,
+		Line:   event.Line,
+		Time:   event.Time,
+		Source: event.Source,
+		Action: hit.Action,
+		Status: event.Status,
+	}
+
+	switch hit.Action {
+	case protocol.ActionInit:
+		t.InitSeen = true
+		t.DeclaredChunks = hit.TotalChunks
+		t.DeclaredBytes = hit.FileSize / 2
+		t.Filename = hit.Filename
+		t.Engagement = hit.Engagement
+	case protocol.ActionChunk:
+		t.ChunkRequests++
+		index := hit.Index
+		entry.Index = &index
+		entry.Bytes = hit.DataBytes
+		if _, seen := t.chunks[hit.Index]; !seen {
+			t.chunks[hit.Index] = hit.DataBytes
+			t.Bytes += hit.DataBytes
+		}
+	case protocol.ActionComplete:
+		t.CompleteSeen = true
+	}
+
+	if !event.Time.IsZero() {
+		if t.FirstSeen.IsZero() || event.Time.Before(t.FirstSeen) {
+			t.FirstSeen = event.Time
+		}
+		if event.Time.After(t.LastSeen) {
+			t.LastSeen = event.Time
+		}
+	}
+	t.Timeline = append(t.Timeline, entry)
+}
+
+// maxListedMissing bounds the missing chunk indexes listed per transfer
+const maxListedMissing = 1000
+
+// finish fills in the derived fields
+func (t *Transfer) finish() {
+	t.UniqueChunks = len(t.chunks)
+	t.MissingChunks = nil
+
+	// The declared count comes from the log and may be anything, so only
+	// the chunks seen are counted and the listing is bounded
+	seen := 0
+	for i := range t.chunks {
+		if i >= 0 && i < t.DeclaredChunks {
+			seen++
+		}
+	}
+	t.MissingCount = t.DeclaredChunks - seen
+	for i := 0; i < t.DeclaredChunks && len(t.MissingChunks) < min(t.MissingCount, maxListedMissing); i++ {
+		if _, ok := t.chunks[i]; !ok {
+			t.MissingChunks = append(t.MissingChunks, i)
+		}
+	}
+	t.FullSequence = t.InitSeen && t.CompleteSeen && t.DeclaredChunks > 0 && t.MissingCount == 0
+	sort.SliceStable(t.Timeline, func(i, j int) bool {
+		return t.Timeline[i].Time.Before(t.Timeline[j].Time)
+	})
+}
+
+// Transfers returns the reconstructed transfers in the order they were
+// first seen
+func (a *Analyzer) Transfers() []*Transfer {
+	result := make([]*Transfer, 0, len(a.order))
+	for _, id := range a.order {
+		t := a.transfers[id]
+		t.finish()
+		result = append(result, t)
+	}
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,5 @@
+// Package e2e holds the end-to-end tests that run the client against the
+// receiver over HTTP and HTTPS: transfers, the client kill switch,
+// certificate pinning, and the generated detection rules checked against
+// that traffic. It has no code of its own; see e2e_test.go.
+package e2e
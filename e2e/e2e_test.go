@@ -0,0 +1,443 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	fw "fw/modules"
+	"protocol"
+	srv "server/modules"
+)
+
+const sharedKey = "e2e-shared-key"
+
+// engagementFor returns a current engagement that allows baseURL
+func engagementFor(baseURL string) *protocol.Manifest {
+	return &protocol.Manifest{
+		EngagementID:  "e2e",
+		AllowedURLs:   []string{baseURL},
+		NotBefore:     time.Now().Add(-time.Hour),
+		NotAfter:      time.Now().Add(time.Hour),
+		MaxTotalBytes: 1 << 30,
+	}
+}
+
+// startReceiver serves HandleRequest from a fresh output directory and
+// returns the server together with that directory
+func startReceiver(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	srv.SetOutputDir(dir)
+	srv.SetEncryptionKey(sharedKey)
+	srv.SetTransferRetention(30 * time.Minute)
+	srv.SetSourcePolicy(srv.SourcePolicy{})
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.HandleRequest))
+	t.Cleanup(ts.Close)
+	srv.SetManifest(engagementFor(ts.URL))
+	return ts, dir
+}
+
+// clientTransfer is a file prepared the way the client prepares it
+type clientTransfer struct {
+	baseURL   string
+	plaintext []byte
+	data      string
+	id        string
+	macKey    []byte
+	chunks    []string
+}
+
+// prepare encrypts random plaintext of the given size under encryptKey and
+// splits it into chunks of chunkSize hex characters
+func prepare(t *testing.T, baseURL string, size int, encryptKey string, chunkSize int) *clientTransfer {
+	t.Helper()
+	plaintext := make([]byte, size)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "secret.bin")
+	if err := os.WriteFile(path, plaintext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return prepareFile(t, baseURL, path, encryptKey, chunkSize)
+}
+
+// prepareFile encrypts the file at path under encryptKey and splits it into
+// chunks of chunkSize hex characters
+func prepareFile(t *testing.T, baseURL, path, encryptKey string, chunkSize int) *clientTransfer {
+	t.Helper()
+	plaintext, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := fw.NewTransferID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fw.EncryptFile(path, encryptKey, id)
+	if err != nil {
+		t.Fatalf("EncryptFile: %v", err)
+	}
+	return &clientTransfer{
+		baseURL:   baseURL,
+		plaintext: plaintext,
+		data:      data,
+		id:        id,
+		macKey:    protocol.DeriveMACKey(sharedKey, id),
+		chunks:    fw.SplitHexString(data, chunkSize),
+	}
+}
+
+// send encodes msg and sends it with SendRequest
+func (c *clientTransfer) send(t *testing.T, msg protocol.Message) error {
+	t.Helper()
+	path, err := protocol.Encode(msg, c.macKey)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	return fw.SendRequest(c.baseURL, path)
+}
+
+func (c *clientTransfer) init(t *testing.T) error {
+	return c.send(t, protocol.Init{
+		TransferID:   c.id,
+		TotalChunks:  len(c.chunks),
+		FileSize:     len(c.data),
+		EngagementID: "e2e",
+		Filename:     "secret.bin",
+	})
+}
+
+func (c *clientTransfer) chunk(t *testing.T, index int) error {
+	return c.send(t, protocol.Chunk{
+		TransferID: c.id,
+		Index:      index,
+		Checksum:   fw.CalculateSHA256(c.chunks[index]),
+		Data:       c.chunks[index],
+	})
+}
+
+func (c *clientTransfer) complete(t *testing.T) error {
+	return c.send(t, protocol.Complete{TransferID: c.id, Checksum: fw.CalculateSHA256(c.data)})
+}
+
+// sendAll sends init and every chunk, failing the test on any error
+func (c *clientTransfer) sendAll(t *testing.T) {
+	t.Helper()
+	if err := c.init(t); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	for i := range c.chunks {
+		if err := c.chunk(t, i); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+}
+
+// expectRejection checks that err is a receiver rejection with the given code
+func expectRejection(t *testing.T, err error, code string) {
+	t.Helper()
+	var serverErr *fw.ServerError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("error = %v, want rejection %q", err, code)
+	}
+	if serverErr.Code != code {
+		t.Errorf("code = %q, want %q (%s)", serverErr.Code, code, serverErr.Message)
+	}
+}
+
+// storedPath is where the receiver keeps the plaintext of a completed transfer
+func storedPath(dir, transferID string, plaintext []byte) string {
+	sum := sha256.Sum256(plaintext)
+	return filepath.Join(dir, "files", transferID, hex.EncodeToString(sum[:]))
+}
+
+func TestRoundTrip(t *testing.T) {
+	ts, dir := startReceiver(t)
+
+	// Large enough to span several stream segments
+	c := prepare(t, ts.URL, 200*1024, sharedKey, fw.CalculateOptimalChunkSize(""))
+	if got, want := int64(len(c.data)/2), protocol.EncryptedSize(int64(len(c.plaintext))); got != want {
+		t.Errorf("encrypted size = %d, EncryptedSize says %d", got, want)
+	}
+	c.sendAll(t)
+	if err := c.complete(t); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	stored, err := os.ReadFile(storedPath(dir, c.id, c.plaintext))
+	if err != nil {
+		t.Fatalf("stored file: %v", err)
+	}
+	if !bytes.Equal(stored, c.plaintext) {
+		t.Errorf("stored file differs from the original (%d bytes, want %d)", len(stored), len(c.plaintext))
+	}
+}
+
+func TestChunkChecksumMismatch(t *testing.T) {
+	ts, _ := startReceiver(t)
+
+	c := prepare(t, ts.URL, 4096, sharedKey, 1000)
+	if err := c.init(t); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	err := c.send(t, protocol.Chunk{
+		TransferID: c.id,
+		Index:      0,
+		Checksum:   fw.CalculateSHA256(c.chunks[1]),
+		Data:       c.chunks[0],
+	})
+	expectRejection(t, err, srv.ErrCodeChecksumMismatch)
+
+	// The chunk can be resent intact
+	if err := c.chunk(t, 0); err != nil {
+		t.Errorf("resending chunk: %v", err)
+	}
+}
+
+func TestCompleteWithMissingChunks(t *testing.T) {
+	ts, _ := startReceiver(t)
+
+	c := prepare(t, ts.URL, 4096, sharedKey, 1000)
+	if err := c.init(t); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	for i := 1; i < len(c.chunks); i++ {
+		if err := c.chunk(t, i); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+	expectRejection(t, c.complete(t), srv.ErrCodeMissingChunks)
+
+	// Sending the missing chunk lets the transfer finish
+	if err := c.chunk(t, 0); err != nil {
+		t.Fatalf("chunk 0: %v", err)
+	}
+	if err := c.complete(t); err != nil {
+		t.Errorf("complete: %v", err)
+	}
+}
+
+func TestWrongDecryptionKey(t *testing.T) {
+	ts, dir := startReceiver(t)
+
+	// Requests are signed correctly but the payload is under another key
+	c := prepare(t, ts.URL, 4096, "not-the-shared-key", 1000)
+	c.sendAll(t)
+	expectRejection(t, c.complete(t), srv.ErrCodeDecryptionFailed)
+
+	if _, err := os.Stat(storedPath(dir, c.id, c.plaintext)); !os.IsNotExist(err) {
+		t.Errorf("output written for undecryptable transfer: %v", err)
+	}
+	// The transfer has failed and cannot be retried
+	expectRejection(t, c.complete(t), srv.ErrCodeInvalidState)
+}
+
+func TestKeyRotation(t *testing.T) {
+	ts, dir := startReceiver(t)
+	keyring := srv.NewKeyring()
+	keyring.Add("2026-q1", "first-shared-key")
+	keyring.Add("2026-q2", "second-shared-key")
+	srv.SetKeyring(keyring)
+
+	// Clients holding either key complete their transfers
+	for _, id := range keyring.IDs() {
+		key, _ := keyring.Key(id)
+		c := prepare(t, ts.URL, 70*1024, key, 1000)
+		c.macKey = protocol.DeriveMACKey(key, c.id)
+		c.sendAll(t)
+		if err := c.complete(t); err != nil {
+			t.Fatalf("%s: complete: %v", id, err)
+		}
+		stored, err := os.ReadFile(storedPath(dir, c.id, c.plaintext))
+		if err != nil || !bytes.Equal(stored, c.plaintext) {
+			t.Errorf("%s: stored file differs from the original: %v", id, err)
+		}
+	}
+
+	// The same plaintext never produces the same ciphertext twice
+	path := filepath.Join(t.TempDir(), "same.bin")
+	os.WriteFile(path, []byte("same plaintext"), 0600)
+	a := prepareFile(t, ts.URL, path, "first-shared-key", 1000)
+	b := prepareFile(t, ts.URL, path, "first-shared-key", 1000)
+	if a.id == b.id || a.data == b.data {
+		t.Error("two transfers of one file share a transfer ID or ciphertext")
+	}
+
+	// Once a key is retired, its clients are refused
+	retired := srv.NewKeyring()
+	retired.Add("2026-q2", "second-shared-key")
+	srv.SetKeyring(retired)
+	c := prepare(t, ts.URL, 4096, "first-shared-key", 1000)
+	c.macKey = protocol.DeriveMACKey("first-shared-key", c.id)
+	expectRejection(t, c.init(t), srv.ErrCodeUnauthenticated)
+}
+
+func TestDuplicateInit(t *testing.T) {
+	ts, _ := startReceiver(t)
+
+	c := prepare(t, ts.URL, 4096, sharedKey, 1000)
+	if err := c.init(t); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if err := c.chunk(t, 0); err != nil {
+		t.Fatalf("chunk 0: %v", err)
+	}
+	expectRejection(t, c.init(t), srv.ErrCodeTransferExists)
+
+	// The original transfer carries on
+	for i := 1; i < len(c.chunks); i++ {
+		if err := c.chunk(t, i); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+	if err := c.complete(t); err != nil {
+		t.Errorf("complete: %v", err)
+	}
+}
+
+func TestCleanupExpiresIdleTransfers(t *testing.T) {
+	ts, dir := startReceiver(t)
+
+	c := prepare(t, ts.URL, 4096, sharedKey, 1000)
+	if err := c.init(t); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if err := c.chunk(t, 0); err != nil {
+		t.Fatalf("chunk 0: %v", err)
+	}
+
+	// Nothing is idle yet under the default retention
+	srv.ScheduleCleanup()
+	if err := c.chunk(t, 1); err != nil {
+		t.Fatalf("chunk 1 before expiry: %v", err)
+	}
+
+	srv.SetTransferRetention(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	srv.ScheduleCleanup()
+
+	expectRejection(t, c.chunk(t, 2), srv.ErrCodeTransferNotFound)
+	expectRejection(t, c.complete(t), srv.ErrCodeTransferNotFound)
+	if _, err := os.Stat(filepath.Join(dir, "journal", c.id)); !os.IsNotExist(err) {
+		t.Errorf("journal entry kept after expiry: %v", err)
+	}
+}
+
+func TestEngagementScope(t *testing.T) {
+	ts, _ := startReceiver(t)
+	m := engagementFor(ts.URL)
+
+	if err := fw.CheckEngagement(m, ts.URL+"/", 4096, time.Now()); err != nil {
+		t.Errorf("in-scope transfer refused: %v", err)
+	}
+	if err := fw.CheckEngagement(m, "http://192.0.2.1/", 4096, time.Now()); err == nil {
+		t.Error("out-of-scope URL accepted")
+	}
+	if err := fw.CheckEngagement(m, ts.URL, 4096, m.NotAfter.Add(time.Minute)); err == nil {
+		t.Error("transfer after the engagement ended accepted")
+	}
+	m.MaxTotalBytes = protocol.EncryptedSize(4096) - 1
+	if err := fw.CheckEngagement(m, ts.URL, 4096, time.Now()); err == nil {
+		t.Error("transfer over the byte limit accepted")
+	}
+
+	// The receiver refuses transfers for another engagement
+	c := prepare(t, ts.URL, 4096, sharedKey, 1000)
+	err := c.send(t, protocol.Init{
+		TransferID:   c.id,
+		TotalChunks:  len(c.chunks),
+		FileSize:     len(c.data),
+		EngagementID: "someone-else",
+		Filename:     "secret.bin",
+	})
+	expectRejection(t, err, srv.ErrCodeUnknownEngagement)
+}
+
+func TestCanaryProofOfPath(t *testing.T) {
+	ts, dir := startReceiver(t)
+
+	path, err := fw.WriteCanaryFile("e2e", 150*1024)
+	if err != nil {
+		t.Fatalf("WriteCanaryFile: %v", err)
+	}
+	defer os.Remove(path)
+
+	c := prepareFile(t, ts.URL, path, sharedKey, 1500)
+	c.sendAll(t)
+	if err := c.complete(t); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	// The canary is recorded as proof but never stored
+	if _, err := os.Stat(filepath.Join(dir, "canaries", c.id+".json")); err != nil {
+		t.Errorf("canary proof: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "files", c.id)); !os.IsNotExist(err) {
+		t.Errorf("canary contents stored: %v", err)
+	}
+}
+
+func TestPlanMatchesTraffic(t *testing.T) {
+	ts, _ := startReceiver(t)
+
+	// Record every URL that reaches the receiver
+	var seen []string
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, ts.URL+r.URL.RequestURI())
+		srv.HandleRequest(w, r)
+	})
+
+	path := filepath.Join(t.TempDir(), "secret.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("plan"), 5*1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := fw.NewPlan(path, ts.URL, ts.URL, "e2e", sharedKey)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	if len(seen) != 0 {
+		t.Fatalf("planning sent %d requests", len(seen))
+	}
+
+	// Send the plan the way the client's main does
+	if err := fw.SendPlan(plan, 0, false); err != nil {
+		t.Fatalf("SendPlan: %v", err)
+	}
+
+	if plan.Requests != len(seen) {
+		t.Errorf("plan has %d requests, %d were sent", plan.Requests, len(seen))
+	}
+	if !slices.Equal(plan.URLs(), seen) {
+		t.Errorf("planned URLs differ from those sent")
+	}
+	if plan.StatusURL != seen[0] || plan.InitURL != seen[1] || plan.CompleteURL != seen[len(seen)-1] {
+		t.Errorf("planned status/init/complete URLs differ from those sent")
+	}
+	total := 0
+	for _, u := range seen {
+		total += len(u)
+	}
+	if plan.URLBytes != total {
+		t.Errorf("plan has %d URL bytes, %d were sent", plan.URLBytes, total)
+	}
+	if plan.PlaintextBytes != 20*1024 || plan.Chunks < 2 || plan.EstimatedSeconds <= 0 {
+		t.Errorf("unexpected plan %+v", plan)
+	}
+	if !strings.Contains(plan.ChunkURL, plan.TransferID) {
+		t.Errorf("chunk URL template %s does not name the transfer", plan.ChunkURL)
+	}
+}
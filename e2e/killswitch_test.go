@@ -0,0 +1,102 @@
+package e2e
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	fw "fw/modules"
+	srv "server/modules"
+)
+
+// fakeClock makes the client see now as the current time until the test ends
+func fakeClock(t *testing.T, now time.Time) {
+	t.Helper()
+	previous := fw.Now
+	fw.Now = func() time.Time { return now }
+	t.Cleanup(func() { fw.Now = previous })
+}
+
+// builtInExpiry sets the expiry the client was built with until the test ends
+func builtInExpiry(t *testing.T, expiresAt string) {
+	t.Helper()
+	previous := fw.ExpiresAt
+	fw.ExpiresAt = expiresAt
+	t.Cleanup(func() { fw.ExpiresAt = previous })
+}
+
+func TestClientExpiry(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock(t, now)
+	before := now.Add(-time.Minute).Format(time.RFC3339)
+	after := now.Add(time.Hour).Format(time.RFC3339)
+
+	if err := fw.CheckExpiry(""); err != nil {
+		t.Errorf("client without expiry refused: %v", err)
+	}
+	if err := fw.CheckExpiry(after); err != nil {
+		t.Errorf("client before its expiry refused: %v", err)
+	}
+	if err := fw.CheckExpiry(before); err == nil {
+		t.Error("expired client allowed to run")
+	}
+	if err := fw.CheckExpiry(now.Format(time.RFC3339)); err == nil {
+		t.Error("client allowed to run at its expiry time")
+	}
+	if err := fw.CheckExpiry("next tuesday"); err == nil {
+		t.Error("invalid expiry accepted")
+	}
+
+	// A built-in expiry cannot be extended from the command line
+	builtInExpiry(t, before)
+	if err := fw.CheckExpiry(after); err == nil {
+		t.Error("--expires extended the built-in expiry")
+	}
+	builtInExpiry(t, after)
+	if err := fw.CheckExpiry(before); err == nil {
+		t.Error("--expires earlier than the built-in expiry ignored")
+	}
+	expiry, err := fw.Expiry(now.Add(2 * time.Hour).Format(time.RFC3339))
+	if err != nil || !expiry.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expiry = %v, %v; want the built-in %v", expiry, err, now.Add(time.Hour))
+	}
+}
+
+func TestKillSwitch(t *testing.T) {
+	ts, _ := startReceiver(t)
+
+	if err := fw.CheckStatus(ts.URL, "e2e", sharedKey); err != nil {
+		t.Fatalf("active engagement refused: %v", err)
+	}
+	if err := fw.CheckStatus(ts.URL, "e2e", "wrong-key"); err == nil {
+		t.Error("status with the wrong key accepted")
+	}
+	if err := fw.CheckStatus(ts.URL, "someone-else", sharedKey); err == nil {
+		t.Error("status of an unknown engagement accepted")
+	}
+
+	// Once revoked, the client stops and the receiver refuses new transfers
+	if _, err := srv.Revoke("e2e", "client lost"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if err := fw.CheckStatus(ts.URL, "e2e", sharedKey); err == nil {
+		t.Error("revoked engagement reported active")
+	}
+	c := prepare(t, ts.URL, 4096, sharedKey, 1000)
+	expectRejection(t, c.init(t), srv.ErrCodeEngagementRevoked)
+
+	// Anything that is not a receiver saying yes stops the client
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>not found</html>"))
+	}))
+	defer other.Close()
+	if err := fw.CheckStatus(other.URL, "e2e", sharedKey); err == nil {
+		t.Error("non-receiver answer taken as active")
+	}
+	other.Close()
+	if err := fw.CheckStatus(other.URL, "e2e", sharedKey); err == nil {
+		t.Error("unreachable receiver taken as active")
+	}
+}
@@ -0,0 +1,201 @@
+package e2e
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	detect "detect/modules"
+	fw "fw/modules"
+	srv "server/modules"
+)
+
+// uriRule is a generated rule read back from disk
+type uriRule struct {
+	name     string
+	contents []string
+	suffix   string
+	pattern  *regexp.Regexp
+}
+
+func (r *uriRule) match(uri string) bool {
+	for _, c := range r.contents {
+		if !strings.Contains(uri, c) {
+			return false
+		}
+	}
+	return strings.HasSuffix(uri, r.suffix) && r.pattern.MatchString(uri)
+}
+
+var (
+	msgOption     = regexp.MustCompile(`^msg:"(.*)"$`)
+	contentOption = regexp.MustCompile(`^content:"(.*)"$`)
+	pcreOption    = regexp.MustCompile(`^pcre:"/(.*)/[A-Za-z]*"$`)
+)
+
+// readSuricataRules reads the URI matches back out of suricata.rules
+func readSuricataRules(t *testing.T, path string) []*uriRule {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	unescape := strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\;`, `;`, `\/`, `/`)
+	var rules []*uriRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		start, end := strings.Index(line, "("), strings.LastIndex(line, ";)")
+		if start < 0 || end < start {
+			t.Fatalf("malformed rule %q", line)
+		}
+
+		rule := &uriRule{}
+		inURI := false
+		options := strings.Split(line[start+1:end], "; ")
+		for i, opt := range options {
+			switch {
+			case opt == "http.uri":
+				inURI = true
+			case msgOption.MatchString(opt):
+				rule.name = msgOption.FindStringSubmatch(opt)[1]
+			case contentOption.MatchString(opt) && inURI:
+				content := unescape.Replace(contentOption.FindStringSubmatch(opt)[1])
+				if i+1 < len(options) && options[i+1] == "endswith" {
+					rule.suffix = content
+				} else {
+					rule.contents = append(rule.contents, content)
+				}
+			case pcreOption.MatchString(opt):
+				pattern := strings.NewReplacer(`\/`, `/`, `\"`, `"`, `\;`, `;`).
+					Replace(pcreOption.FindStringSubmatch(opt)[1])
+				rule.pattern = regexp.MustCompile(pattern)
+			}
+		}
+		if rule.pattern == nil || rule.suffix == "" {
+			t.Fatalf("rule %q has no URI match", line)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// readSigmaRule reads the URI match back out of a generated Sigma rule
+func readSigmaRule(t *testing.T, path, field string) *uriRule {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unquote := func(s string) string {
+		return strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(s, "'"), "'"), "''", "'")
+	}
+
+	rule := &uriRule{name: filepath.Base(path)}
+	inContains := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == field+"|contains|all:":
+			inContains = true
+		case inContains && strings.HasPrefix(line, "- "):
+			rule.contents = append(rule.contents, unquote(strings.TrimPrefix(line, "- ")))
+		case strings.HasPrefix(line, field+"|endswith: "):
+			inContains = false
+			rule.suffix = unquote(strings.TrimPrefix(line, field+"|endswith: "))
+		case strings.HasPrefix(line, field+"|re: "):
+			rule.pattern = regexp.MustCompile(unquote(strings.TrimPrefix(line, field+"|re: ")))
+		}
+	}
+	if rule.pattern == nil || rule.suffix == "" {
+		t.Fatalf("%s has no URI match", path)
+	}
+	return rule
+}
+
+func TestGeneratedRulesMatchTraffic(t *testing.T) {
+	ts, _ := startReceiver(t)
+
+	// Record the request URI of everything the client sends
+	var seen []string
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.RequestURI)
+		srv.HandleRequest(w, r)
+	})
+
+	if err := fw.CheckStatus(ts.URL, "e2e", sharedKey); err != nil {
+		t.Fatalf("CheckStatus: %v", err)
+	}
+	c := prepare(t, ts.URL, 8*1024, sharedKey, 1000)
+	c.sendAll(t)
+	if err := c.complete(t); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	dir := t.TempDir()
+	if _, err := detect.WriteRules(dir, detect.DefaultSIDBase); err != nil {
+		t.Fatalf("WriteRules: %v", err)
+	}
+
+	// Each transfer request should hit the rule for its action and the
+	// generic one; the status query only its own
+	expected := func(uri string) []string {
+		action := strings.SplitN(strings.TrimPrefix(uri, "/"), "/", 2)[0]
+		if action == "status" {
+			return []string{action}
+		}
+		return []string{action, "any-version"}
+	}
+
+	for _, r := range detect.Rules() {
+		proxy := readSigmaRule(t, filepath.Join(dir, "sigma", "ssrfleak_"+r.Name+"_proxy.yml"), "c-uri")
+		webserver := readSigmaRule(t, filepath.Join(dir, "sigma", "ssrfleak_"+r.Name+"_webserver.yml"), "cs-uri-stem")
+		for _, uri := range seen {
+			want := false
+			for _, name := range expected(uri) {
+				want = want || name == r.Name
+			}
+			if proxy.match(uri) != want || webserver.match(uri) != want || r.MatchURI(uri) != want {
+				t.Errorf("Sigma rule %s: match(%.60s...) != %v", r.Name, uri, want)
+			}
+		}
+	}
+
+	suricata := readSuricataRules(t, filepath.Join(dir, "suricata.rules"))
+	if len(suricata) != len(detect.Rules()) {
+		t.Fatalf("suricata.rules has %d rules, want %d", len(suricata), len(detect.Rules()))
+	}
+	for _, uri := range seen {
+		hits := 0
+		for _, rule := range suricata {
+			if rule.match(uri) {
+				hits++
+			}
+		}
+		if hits != len(expected(uri)) {
+			t.Errorf("%d Suricata rules match %.60s..., want %d", hits, uri, len(expected(uri)))
+		}
+	}
+
+	// Ordinary module proxy lookups must not match
+	for _, uri := range []string{
+		"/golang.org/x/text/@v/v0.14.0.info",
+		"/github.com/init/chunk/@v/v1.info",
+		"/chunk/v2/abc/@v/v1.info",
+	} {
+		for _, rule := range suricata {
+			if rule.match(uri) {
+				t.Errorf("rule %q matches %s", rule.name, uri)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	fw "fw/modules"
+	srv "server/modules"
+)
+
+// startTLSReceiver serves HandleRequest over TLS with a self-signed
+// certificate, as the receiver does with -tls-self-signed
+func startTLSReceiver(t *testing.T) (*httptest.Server, string, tls.Certificate) {
+	t.Helper()
+	dir := t.TempDir()
+	srv.SetOutputDir(dir)
+	srv.SetEncryptionKey(sharedKey)
+	srv.SetSourcePolicy(srv.SourcePolicy{})
+	cert, err := srv.TLSConfig{SelfSigned: true}.LoadCertificate(dir)
+	if err != nil {
+		t.Fatalf("LoadCertificate: %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(srv.HandleRequest))
+	ts.TLS = srv.ServerTLSConfig(cert)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	srv.SetManifest(engagementFor(ts.URL))
+	return ts, dir, cert
+}
+
+// pin pins the client to a fingerprint until the test ends
+func pin(t *testing.T, fingerprint string) {
+	t.Helper()
+	if err := fw.SetPinnedFingerprint(fingerprint); err != nil {
+		t.Fatalf("SetPinnedFingerprint: %v", err)
+	}
+	t.Cleanup(func() { fw.SetPinnedFingerprint("") })
+}
+
+func TestCertificatePinning(t *testing.T) {
+	ts, dir, cert := startTLSReceiver(t)
+
+	// Without a pin the self-signed certificate is not trusted
+	c := prepare(t, ts.URL, 4096, sharedKey, 1000)
+	var serverErr *fw.ServerError
+	if err := c.init(t); err == nil || errors.As(err, &serverErr) {
+		t.Fatalf("unpinned client reached a self-signed receiver: %v", err)
+	}
+
+	// Pinned to the receiver's certificate, the transfer goes through
+	pin(t, srv.CertificateFingerprint(cert))
+	if err := fw.CheckStatus(ts.URL, "e2e", sharedKey); err != nil {
+		t.Fatalf("CheckStatus: %v", err)
+	}
+	c.sendAll(t)
+	if err := c.complete(t); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	stored, err := os.ReadFile(storedPath(dir, c.id, c.plaintext))
+	if err != nil || !bytes.Equal(stored, c.plaintext) {
+		t.Errorf("stored file differs from the original: %v", err)
+	}
+
+	// Any other certificate is refused before a request is sent
+	other, err := srv.TLSConfig{SelfSigned: true}.LoadCertificate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin(t, srv.CertificateFingerprint(other))
+	d := prepare(t, ts.URL, 4096, sharedKey, 1000)
+	if err := d.init(t); err == nil || errors.As(err, &serverErr) {
+		t.Errorf("client talked to a receiver with another certificate: %v", err)
+	}
+	if err := fw.CheckStatus(ts.URL, "e2e", sharedKey); err == nil {
+		t.Error("status accepted from a receiver with another certificate")
+	}
+
+	// A pinned client never falls back to plain HTTP
+	requests := 0
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		srv.HandleRequest(w, r)
+	}))
+	defer plain.Close()
+	pin(t, srv.CertificateFingerprint(cert))
+	e := prepare(t, plain.URL, 4096, sharedKey, 1000)
+	if err := e.init(t); err == nil {
+		t.Error("pinned client sent over plain HTTP")
+	}
+	if requests != 0 {
+		t.Errorf("%d requests reached the plain HTTP receiver", requests)
+	}
+}
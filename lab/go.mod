@@ -0,0 +1,17 @@
+module lab
+
+go 1.24.1
+
+require (
+	detect v0.0.0
+	fw v0.0.0
+	protocol v0.0.0
+	server v0.0.0
+)
+
+replace (
+	detect => ../detect
+	fw => ../client
+	protocol => ../protocol
+	server => ../server
+)
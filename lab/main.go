@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	fw "fw/modules"
+	modules "lab/modules"
+)
+
+func main() {
+	fs := flag.NewFlagSet("lab", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory for the receiver output and logs (default a new temporary directory)")
+	canarySize := fs.Int64("canary", 16*1024, "Size of the canary sent through the lab in bytes")
+	chunkDelay := fs.Duration("chunk-delay", fw.ChunkDelay, "Pause between chunk requests, as the client makes")
+	jsonOut := fs.Bool("json", false, "Write the detection report as JSON")
+	verbose := fs.Bool("v", false, "List every matched request of each transfer")
+	serve := fs.Bool("serve", false, "Keep the lab running after the canary until interrupted")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [-dir dir] [-canary bytes] [-chunk-delay d] [-json] [-v] [-serve]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Starts a receiver, a fetch service vulnerable to SSRF and a logging")
+		fmt.Fprintln(fs.Output(), "forward proxy on loopback, sends a canary through the fetch service and")
+		fmt.Fprintln(fs.Output(), "runs detection over the proxy log. Needs no network access. Exits with")
+		fmt.Fprintln(fs.Output(), "status 1 unless the canary was both received and detected.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	if *dir == "" {
+		tmp, err := os.MkdirTemp("", "ssrfleak-lab-")
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		*dir = tmp
+	}
+
+	lab, err := modules.Start(*dir)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	fmt.Printf("Receiver:      %s\n", lab.ReceiverURL)
+	fmt.Printf("Fetch service: %s%s<url>\n", lab.FetchURL, modules.FetchPrefix)
+	fmt.Printf("Proxy:         %s (log: %s)\n", lab.ProxyURL, lab.ProxyLog)
+	fmt.Printf("Client URL:    %s\n", lab.BaseURL())
+	fmt.Printf("Lab directory: %s\n\n", lab.Dir)
+
+	fmt.Printf("Sending a %d byte canary through the fetch service...\n", *canarySize)
+	result, err := lab.Run(*canarySize, *chunkDelay)
+	exitCode := 0
+	if err != nil {
+		log.Printf("Error: %v", err)
+		exitCode = 1
+	}
+	if result != nil && result.Report != nil {
+		fmt.Printf("Canary %s verified by the receiver: %s\n\n", result.TransferID, result.ProofPath)
+		if *jsonOut {
+			if err := result.Report.WriteJSON(os.Stdout); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		} else {
+			result.Report.WriteText(os.Stdout, *verbose)
+		}
+		if result.Detected == nil {
+			log.Printf("Detection missed canary %s in %s", result.TransferID, lab.ProxyLog)
+			exitCode = 1
+		}
+	}
+
+	// Leave the components up for trainees to send their own traffic
+	if *serve {
+		fmt.Printf("\nLab running. Send more traffic with the client, for example:\n")
+		fmt.Printf("  client -u %s -k %s -m %s -manifest-key %s -canary 4096\n",
+			lab.BaseURL(), lab.SharedKey, lab.ManifestFile, lab.ManifestKey)
+		fmt.Printf("Press Ctrl-C to stop.\n")
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		<-ctx.Done()
+		stop()
+	}
+
+	if err := lab.Close(); err != nil {
+		log.Printf("Error: %v", err)
+		exitCode = 1
+	}
+	os.Exit(exitCode)
+}
@@ -0,0 +1,60 @@
+package lab
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// FetchPrefix is the path of the fetch endpoint; the URL to fetch follows it
+const FetchPrefix = "/fetch/"
+
+// maxFetchBody bounds the response body the fetch service passes back
+const maxFetchBody = 1 << 20
+
+// FetchService simulates a "link preview" service vulnerable to SSRF:
+// GET /fetch/<url> fetches any URL it is given, through the egress proxy,
+// and returns the response status and body unchanged
+type FetchService struct {
+	client *http.Client
+}
+
+// NewFetchService returns a fetch service sending its requests through the
+// proxy at proxyURL
+func NewFetchService(proxyURL *url.URL) *FetchService {
+	return &FetchService{client: &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   30 * time.Second,
+	}}
+}
+
+// ServeHTTP fetches the URL in the request path. The raw request URI is
+// used so that the target reaches the proxy exactly as it was sent.
+func (f *FetchService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, ok := strings.CutPrefix(r.RequestURI, FetchPrefix)
+	if !ok || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		http.Error(w, "usage: GET /fetch/<http or https URL>", http.StatusBadRequest)
+		return
+	}
+
+	// The vulnerability: the target is neither validated nor restricted
+	resp, err := f.client.Get(target)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("fetch failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, io.LimitReader(resp.Body, maxFetchBody))
+}
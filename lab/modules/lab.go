@@ -0,0 +1,239 @@
+package lab
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	detect "detect/modules"
+	fw "fw/modules"
+	"protocol"
+	srv "server/modules"
+)
+
+// EngagementID is the engagement the lab receiver accepts transfers for
+const EngagementID = "lab"
+
+// Lab is the receiver, a fetch service vulnerable to SSRF and the egress
+// proxy in front of it, all on loopback. Transfers are sent to the fetch
+// service, which relays them through the proxy to the receiver.
+type Lab struct {
+	Dir       string // working directory holding the receiver output and logs
+	SharedKey string
+	Manifest  *protocol.Manifest
+	// ManifestFile holds Manifest signed with the key ManifestKey, for
+	// running the client against the lab
+	ManifestFile string
+	ManifestKey  string
+	ReceiverURL  string
+	FetchURL     string
+	ProxyURL     string
+	ProxyLog     string // access log written by the proxy
+
+	servers  []*http.Server
+	proxyLog *os.File
+	auditLog *srv.AuditLog
+}
+
+// Result is the outcome of a canary run
+type Result struct {
+	TransferID string
+	// ProofPath is the receiver's proof-of-path record for the canary
+	ProofPath string
+	// Report is what detection found in the proxy log; Detected is the
+	// canary's transfer in it, nil if it was missed
+	Report   *detect.Report
+	Detected *detect.Transfer
+}
+
+// Start starts the three components with their state under dir
+func Start(dir string) (*Lab, error) {
+	receiverDir := filepath.Join(dir, "receiver")
+	if err := os.MkdirAll(receiverDir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating lab directory: %v", err)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating key: %v", err)
+	}
+	l := &Lab{Dir: dir, SharedKey: hex.EncodeToString(key), ProxyLog: filepath.Join(dir, "proxy.log")}
+
+	proxyLog, err := os.OpenFile(l.ProxyLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening proxy log: %v", err)
+	}
+	l.proxyLog = proxyLog
+	auditLog, err := srv.OpenAuditLog(filepath.Join(receiverDir, "audit.jsonl"))
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	l.auditLog = auditLog
+
+	// Listen first so that every URL is known before anything is served
+	var listeners [3]net.Listener
+	fail := func(err error) (*Lab, error) {
+		for _, ln := range listeners {
+			if ln != nil {
+				ln.Close()
+			}
+		}
+		l.Close()
+		return nil, err
+	}
+	for i := range listeners {
+		if listeners[i], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return fail(fmt.Errorf("error listening on loopback: %v", err))
+		}
+	}
+	l.ReceiverURL = "http://" + listeners[0].Addr().String()
+	l.ProxyURL = "http://" + listeners[1].Addr().String()
+	l.FetchURL = "http://" + listeners[2].Addr().String()
+	proxyURL, _ := url.Parse(l.ProxyURL)
+
+	// The engagement covers the fetch service. Its manifest is signed with
+	// a throwaway key so the client can be pointed at the lab too.
+	now := time.Now()
+	l.Manifest = &protocol.Manifest{
+		EngagementID:  EngagementID,
+		AllowedURLs:   []string{l.FetchURL},
+		NotBefore:     now.Add(-time.Minute),
+		NotAfter:      now.Add(24 * time.Hour),
+		MaxTotalBytes: 64 << 20,
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fail(fmt.Errorf("error generating manifest key: %v", err))
+	}
+	signed, err := protocol.SignManifest(*l.Manifest, private)
+	if err != nil {
+		return fail(err)
+	}
+	l.ManifestFile, l.ManifestKey = filepath.Join(dir, "manifest.json"), hex.EncodeToString(public)
+	if err := os.WriteFile(l.ManifestFile, signed, 0600); err != nil {
+		return fail(fmt.Errorf("error writing manifest: %v", err))
+	}
+
+	// The receiver only accepts requests from loopback. Rates are not
+	// limited so that canaries can be sent without pauses.
+	sources := srv.SourcePolicy{
+		AllowedCIDRs:  []string{"127.0.0.1", "::1"},
+		MaxConcurrent: srv.DefaultSourcePolicy().MaxConcurrent,
+	}
+	srv.SetOutputDir(receiverDir)
+	srv.SetEncryptionKey(l.SharedKey)
+	srv.SetSourcePolicy(sources)
+	srv.SetManifest(l.Manifest)
+	srv.SetAuditLog(auditLog)
+
+	handlers := []http.Handler{
+		http.HandlerFunc(srv.HandleRequest),
+		NewProxy(proxyLog),
+		NewFetchService(proxyURL),
+	}
+	for i, handler := range handlers {
+		server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+		l.servers = append(l.servers, server)
+		go server.Serve(listeners[i])
+	}
+	return l, nil
+}
+
+// BaseURL is the base URL a client uses to reach the receiver through the
+// fetch service
+func (l *Lab) BaseURL() string {
+	return l.FetchURL + FetchPrefix + l.ReceiverURL
+}
+
+// RunCanary sends a canary of the given size through the fetch service with
+// the client's own transfer routine, pausing chunkDelay between chunks. It
+// returns the transfer ID.
+func (l *Lab) RunCanary(size int64, chunkDelay time.Duration) (string, error) {
+	baseURL := l.BaseURL()
+	if err := fw.CheckEngagement(l.Manifest, baseURL, size, time.Now()); err != nil {
+		return "", err
+	}
+
+	path, err := fw.WriteCanaryFile(EngagementID, size)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(path)
+	plan, err := fw.NewPlan(path, baseURL, baseURL, EngagementID, l.SharedKey)
+	if err != nil {
+		return "", err
+	}
+	return plan.TransferID, fw.SendPlan(plan, chunkDelay, false)
+}
+
+// ProofPath is where the receiver records the proof of path for a canary
+func (l *Lab) ProofPath(transferID string) string {
+	return filepath.Join(l.Dir, "receiver", "canaries", transferID+".json")
+}
+
+// Detect runs detection over the proxy log
+func (l *Lab) Detect() (*detect.Report, error) {
+	f, err := os.Open(l.ProxyLog)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	analyzer := detect.NewAnalyzer()
+	unparsed, err := analyzer.Scan(f, l.ProxyLog)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", l.ProxyLog, err)
+	}
+	return analyzer.Report(unparsed), nil
+}
+
+// Run sends a canary through the lab and checks that the receiver proved
+// its path and that detection found it in the proxy log
+func (l *Lab) Run(size int64, chunkDelay time.Duration) (*Result, error) {
+	transferID, err := l.RunCanary(size, chunkDelay)
+	if err != nil {
+		return nil, fmt.Errorf("canary transfer failed: %v", err)
+	}
+	result := &Result{TransferID: transferID, ProofPath: l.ProofPath(transferID)}
+	if _, err := os.Stat(result.ProofPath); err != nil {
+		return result, fmt.Errorf("receiver recorded no proof for canary %s: %v", transferID, err)
+	}
+
+	if result.Report, err = l.Detect(); err != nil {
+		return result, err
+	}
+	for _, t := range result.Report.Transfers {
+		if t.TransferID == transferID {
+			result.Detected = t
+		}
+	}
+	return result, nil
+}
+
+// Close stops the components and flushes the logs
+func (l *Lab) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range l.servers {
+		server.Shutdown(ctx)
+	}
+	var firstErr error
+	if l.auditLog != nil {
+		srv.SetAuditLog(nil)
+		firstErr = l.auditLog.Close()
+	}
+	if l.proxyLog != nil {
+		if err := l.proxyLog.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,55 @@
+package lab
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCanaryThroughLab(t *testing.T) {
+	l, err := Start(t.TempDir())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer l.Close()
+
+	result, err := l.Run(8*1024, 0)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Detected == nil {
+		t.Fatalf("detection missed canary %s: %+v", result.TransferID, result.Report)
+	}
+	if !result.Detected.FullSequence || result.Detected.Engagement != EngagementID {
+		t.Errorf("detected transfer: %+v", result.Detected)
+	}
+
+	// The proxy saw the requests the fetch service relayed, not the client's
+	data, err := os.ReadFile(l.ProxyLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.Contains(line, `"GET `+l.ReceiverURL+"/") {
+			t.Errorf("proxy log line does not target the receiver: %.100s", line)
+		}
+	}
+}
+
+func TestProxyRefusesOriginRequests(t *testing.T) {
+	l, err := Start(t.TempDir())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer l.Close()
+
+	resp, err := http.Get(l.ProxyURL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("origin-form request to the proxy: status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
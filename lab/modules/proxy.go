@@ -0,0 +1,95 @@
+package lab
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders are connection-specific and not forwarded by the proxy
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// Proxy is a plain HTTP forward proxy that writes every request it relays
+// to an access log in the combined log format, the way an egress proxy in
+// front of the vulnerable service would
+type Proxy struct {
+	transport *http.Transport
+	mu        sync.Mutex
+	log       io.Writer
+}
+
+// NewProxy returns a proxy logging to w
+func NewProxy(w io.Writer) *Proxy {
+	return &Proxy{
+		// Connect directly; the proxy is the last hop before the receiver
+		transport: &http.Transport{Proxy: nil, DisableCompression: true},
+		log:       w,
+	}
+}
+
+// ServeHTTP relays an absolute-form request and logs it
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "only absolute http:// requests are proxied", http.StatusBadRequest)
+		p.record(r, http.StatusBadRequest, 0)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("upstream error: %v", err), http.StatusBadGateway)
+		p.record(r, http.StatusBadGateway, 0)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, _ := io.Copy(w, resp.Body)
+	p.record(r, resp.StatusCode, n)
+}
+
+// record appends one combined log format line for r
+func (p *Proxy) record(r *http.Request, status int, bytes int64) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\"\n",
+		host, time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, quote.Replace(r.RequestURI), r.Proto, status, bytes,
+		dash(quote.Replace(r.Referer())), dash(quote.Replace(r.UserAgent())))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := io.WriteString(p.log, line); err != nil {
+		log.Printf("ERROR: Failed to write proxy log: %v", err)
+	}
+}
+
+// dash stands in for an empty log field
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// macKeyLabel separates the request authentication key from other uses of
+// the shared key
+const macKeyLabel = "ssrfleak/request-mac/v1|"
+
+// DeriveMACKey derives the per-transfer request authentication key from the
+// shared key and the transfer ID
+func DeriveMACKey(sharedKey, transferID string) []byte {
+	mac := hmac.New(sha256.New, []byte(sharedKey))
+	mac.Write([]byte(macKeyLabel + transferID))
+	return mac.Sum(nil)
+}
+
+// ComputeMAC returns the hex HMAC-SHA256 of an unsigned path under macKey
+func ComputeMAC(macKey []byte, body string) string {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign appends the MAC of path under macKey as a final path component
+func Sign(path string, macKey []byte) string {
+	path = strings.Trim(path, "/")
+	return path + "/" + ComputeMAC(macKey, path)
+}
+
+// Verify reports whether the request's MAC is valid under the per-transfer
+// key derived from sharedKey
+func (r *Request) Verify(sharedKey string) bool {
+	received, err := hex.DecodeString(r.MAC)
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(ComputeMAC(DeriveMACKey(sharedKey, r.Message.ID()), r.Body))
+	return hmac.Equal(received, expected)
+}
@@ -0,0 +1,204 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A canary is a synthetic payload used to demonstrate an egress path without
+// moving real data. It is a single header line followed by a pattern that
+// anyone holding the header can regenerate:
+//
+//	SSRFLEAK-CANARY/1 engagement=<id> nonce=<32 hex> size=<total bytes>\n
+//	pattern...
+//
+// Pattern byte i is byte i%32 of SHA-256(nonce || big-endian uint64(i/32)).
+// The size counts the header too, so the file is exactly size bytes long.
+
+// CanaryMagic starts every canary
+const CanaryMagic = "SSRFLEAK-CANARY/1 "
+
+// MaxCanaryHeaderLength bounds the header line, newline included
+const MaxCanaryHeaderLength = 256
+
+// canaryNonceSize is the size of the random nonce in bytes
+const canaryNonceSize = 16
+
+// CanaryHeader is the parsed first line of a canary
+type CanaryHeader struct {
+	EngagementID string
+	Nonce        string
+	Size         int64
+}
+
+// String returns the header line, including the trailing newline
+func (h CanaryHeader) String() string {
+	return fmt.Sprintf("%sengagement=%s nonce=%s size=%d\n", CanaryMagic, h.EngagementID, h.Nonce, h.Size)
+}
+
+// ParseCanaryHeader parses a header line, with or without its newline
+func ParseCanaryHeader(line string) (*CanaryHeader, error) {
+	line = strings.TrimSuffix(line, "\n")
+	if !strings.HasPrefix(line, CanaryMagic) {
+		return nil, errors.New("not a canary")
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, CanaryMagic))
+	if len(fields) != 3 {
+		return nil, errors.New("malformed canary header")
+	}
+
+	var h CanaryHeader
+	for i, name := range []string{"engagement", "nonce", "size"} {
+		value, ok := strings.CutPrefix(fields[i], name+"=")
+		if !ok {
+			return nil, fmt.Errorf("canary header is missing %s", name)
+		}
+		switch name {
+		case "engagement":
+			h.EngagementID = value
+		case "nonce":
+			h.Nonce = value
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid canary size %q", value)
+			}
+			h.Size = size
+		}
+	}
+
+	if !IsValidEngagementID(h.EngagementID) {
+		return nil, errors.New("invalid engagement ID in canary header")
+	}
+	if nonce, err := hex.DecodeString(h.Nonce); err != nil || len(nonce) != canaryNonceSize {
+		return nil, errors.New("invalid canary nonce")
+	}
+	if h.Size < int64(len(h.String())) {
+		return nil, errors.New("canary size is smaller than its header")
+	}
+	return &h, nil
+}
+
+// NewCanaryHeader returns a header with a fresh nonce for a canary of the
+// given total size
+func NewCanaryHeader(engagementID string, size int64) (*CanaryHeader, error) {
+	if !IsValidEngagementID(engagementID) {
+		return nil, fmt.Errorf("invalid engagement ID %q", engagementID)
+	}
+	nonce := make([]byte, canaryNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	h := &CanaryHeader{EngagementID: engagementID, Nonce: hex.EncodeToString(nonce), Size: size}
+	if size < int64(len(h.String())) {
+		return nil, fmt.Errorf("canary size must be at least %d bytes", len(h.String()))
+	}
+	return h, nil
+}
+
+// WriteCanary writes the complete canary described by h to w
+func WriteCanary(w io.Writer, h *CanaryHeader) error {
+	header := h.String()
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	pattern := newCanaryPattern(h.Nonce)
+	remaining := h.Size - int64(len(header))
+	buf := make([]byte, 32*1024)
+	for remaining > 0 {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		pattern.fill(buf[:n])
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return nil
+}
+
+// canaryPattern generates the pattern that follows a header
+type canaryPattern struct {
+	nonce  []byte
+	block  [sha256.Size]byte
+	offset int64
+}
+
+func newCanaryPattern(nonceHex string) *canaryPattern {
+	nonce, _ := hex.DecodeString(nonceHex)
+	return &canaryPattern{nonce: nonce}
+}
+
+// fill writes the next len(p) pattern bytes into p
+func (c *canaryPattern) fill(p []byte) {
+	for i := range p {
+		pos := c.offset % sha256.Size
+		if pos == 0 {
+			var counter [8]byte
+			binary.BigEndian.PutUint64(counter[:], uint64(c.offset/sha256.Size))
+			c.block = sha256.Sum256(append(append([]byte{}, c.nonce...), counter[:]...))
+		}
+		p[i] = c.block[pos]
+		c.offset++
+	}
+}
+
+// CanaryVerifier checks the pattern of a canary written to it, header
+// excluded. Finish reports whether the whole canary arrived intact.
+type CanaryVerifier struct {
+	Header   *CanaryHeader
+	pattern  *canaryPattern
+	expected []byte
+	received int64
+	err      error
+}
+
+// NewCanaryVerifier returns a verifier for the pattern following h
+func NewCanaryVerifier(h *CanaryHeader) *CanaryVerifier {
+	return &CanaryVerifier{Header: h, pattern: newCanaryPattern(h.Nonce)}
+}
+
+// Write implements io.Writer. It fails as soon as the data departs from the
+// pattern or runs past the declared size.
+func (v *CanaryVerifier) Write(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	body := v.Header.Size - int64(len(v.Header.String()))
+	if v.received+int64(len(p)) > body {
+		v.err = errors.New("canary is longer than its declared size")
+		return 0, v.err
+	}
+	if cap(v.expected) < len(p) {
+		v.expected = make([]byte, len(p))
+	}
+	expected := v.expected[:len(p)]
+	v.pattern.fill(expected)
+	if !bytes.Equal(p, expected) {
+		v.err = fmt.Errorf("canary pattern mismatch near byte %d", v.received)
+		return 0, v.err
+	}
+	v.received += int64(len(p))
+	return len(p), nil
+}
+
+// Finish returns nil if the complete pattern has been written
+func (v *CanaryVerifier) Finish() error {
+	if v.err != nil {
+		return v.err
+	}
+	if body := v.Header.Size - int64(len(v.Header.String())); v.received != body {
+		return fmt.Errorf("canary truncated: %d of %d pattern bytes", v.received, body)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// verifyCanary checks data the way the receiver does
+func verifyCanary(data []byte) error {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	h, err := ParseCanaryHeader(string(line) + "\n")
+	if err != nil {
+		return err
+	}
+	v := NewCanaryVerifier(h)
+	if _, err := v.Write(data[len(line)+1:]); err != nil {
+		return err
+	}
+	return v.Finish()
+}
+
+func TestCanaryRoundTrip(t *testing.T) {
+	for _, size := range []int64{100, 4096, 100_001} {
+		h, err := NewCanaryHeader("acme-2026", size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := WriteCanary(&buf, h); err != nil {
+			t.Fatal(err)
+		}
+		if int64(buf.Len()) != size {
+			t.Errorf("canary is %d bytes, want %d", buf.Len(), size)
+		}
+		if err := verifyCanary(buf.Bytes()); err != nil {
+			t.Errorf("size %d: %v", size, err)
+		}
+	}
+}
+
+func TestCanaryTampering(t *testing.T) {
+	h, err := NewCanaryHeader("acme-2026", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	WriteCanary(&buf, h)
+	data := buf.Bytes()
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-10] ^= 1
+	if err := verifyCanary(flipped); err == nil {
+		t.Error("modified canary verified")
+	}
+	if err := verifyCanary(data[:len(data)-1]); err == nil {
+		t.Error("truncated canary verified")
+	}
+	if err := verifyCanary(append(append([]byte{}, data...), 0)); err == nil {
+		t.Error("extended canary verified")
+	}
+
+	// A header with another nonce does not match the pattern
+	other, _ := NewCanaryHeader("acme-2026", 4096)
+	swapped := append([]byte(other.String()), data[len(h.String()):]...)
+	if err := verifyCanary(swapped); err == nil {
+		t.Error("canary verified under another nonce")
+	}
+}
+
+func TestParseCanaryHeaderRejects(t *testing.T) {
+	nonce := strings.Repeat("ab", 16)
+	for _, line := range []string{
+		"hello world\n",
+		CanaryMagic + "engagement=acme nonce=" + nonce + "\n",
+		CanaryMagic + "engagement=a/b nonce=" + nonce + " size=1000\n",
+		CanaryMagic + "engagement=acme nonce=abcd size=1000\n",
+		CanaryMagic + "engagement=acme nonce=" + nonce + " size=10\n",
+		CanaryMagic + "nonce=" + nonce + " engagement=acme size=1000\n",
+	} {
+		if _, err := ParseCanaryHeader(line); err == nil {
+			t.Errorf("ParseCanaryHeader(%q) accepted", line)
+		}
+	}
+
+	if _, err := NewCanaryHeader("acme", 10); err == nil {
+		t.Error("canary smaller than its header accepted")
+	}
+}
@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// Every payload starts with a random salt, followed by the encrypted
+// stream. The stream key is derived from the shared key, that salt and the
+// transfer ID, so no two transfers are ever encrypted under the same key:
+//
+//	salt (16 bytes) || encrypted stream
+
+// PayloadSaltSize is the length of the salt in front of every payload
+const PayloadSaltSize = 16
+
+// payloadKeyLabel separates the payload encryption key from other uses of
+// the shared key
+const payloadKeyLabel = "ssrfleak/payload-key/v1|"
+
+// PayloadKeySize is the length of a derived payload key (AES-256)
+const PayloadKeySize = 32
+
+// HKDF derives length bytes of key material from secret with HKDF-SHA256
+// (RFC 5869). A nil salt stands for a string of zeros. length must not
+// exceed 255 * 32 bytes.
+func HKDF(secret, salt, info []byte, length int) []byte {
+	// Extract
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	// Expand
+	if length > 255*sha256.Size {
+		panic("hkdf: requested length too large")
+	}
+	expand := hmac.New(sha256.New, prk)
+	var okm, block []byte
+	for counter := byte(1); len(okm) < length; counter++ {
+		expand.Reset()
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		okm = append(okm, block...)
+	}
+	return okm[:length]
+}
+
+// NewPayloadSalt returns a fresh random payload salt
+func NewPayloadSalt() ([]byte, error) {
+	salt := make([]byte, PayloadSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	return salt, nil
+}
+
+// DerivePayloadKey derives the key a transfer's payload is encrypted under
+// from the shared key, the payload salt and the transfer ID
+func DerivePayloadKey(sharedKey string, salt []byte, transferID string) []byte {
+	return HKDF([]byte(sharedKey), salt, []byte(payloadKeyLabel+transferID), PayloadKeySize)
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// unhex decodes a test vector
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHKDFVectors(t *testing.T) {
+	// RFC 5869 appendix A, test cases 1 and 3
+	tests := []struct {
+		name, secret, salt, info, okm string
+	}{
+		{
+			"basic",
+			"0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			"000102030405060708090a0b0c",
+			"f0f1f2f3f4f5f6f7f8f9",
+			"3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			"no salt or info",
+			"0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+			"",
+			"",
+			"8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+	}
+	for _, tt := range tests {
+		var salt []byte
+		if tt.salt != "" {
+			salt = unhex(t, tt.salt)
+		}
+		want := unhex(t, tt.okm)
+		got := HKDF(unhex(t, tt.secret), salt, unhex(t, tt.info), len(want))
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: HKDF = %x, want %x", tt.name, got, want)
+		}
+	}
+}
+
+func TestDerivePayloadKey(t *testing.T) {
+	salt, err := NewPayloadSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := DerivePayloadKey("shared", salt, testID)
+	if len(key) != PayloadKeySize {
+		t.Fatalf("key is %d bytes, want %d", len(key), PayloadKeySize)
+	}
+	if !bytes.Equal(key, DerivePayloadKey("shared", salt, testID)) {
+		t.Error("derivation is not deterministic")
+	}
+
+	other, _ := NewPayloadSalt()
+	for name, k := range map[string][]byte{
+		"other shared key":  DerivePayloadKey("other", salt, testID),
+		"other salt":        DerivePayloadKey("shared", other, testID),
+		"other transfer ID": DerivePayloadKey("shared", salt, testID[2:]+"cd"),
+		"request MAC key":   DeriveMACKey("shared", testID),
+	} {
+		if bytes.Equal(key, k) {
+			t.Errorf("payload key equals the key for %s", name)
+		}
+	}
+}
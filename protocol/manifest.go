@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// An engagement manifest scopes what the tools may be used for. The operator
+// signs it with an ed25519 key; the client refuses to send anywhere the
+// manifest does not allow and the receiver refuses transfers for any other
+// engagement. On disk it is a SignedManifest:
+//
+//	{"manifest": {...}, "signature": "<base64 ed25519 signature>"}
+//
+// The signature covers the manifest JSON with insignificant whitespace
+// removed, so the file may be reformatted without breaking it.
+
+// EngagementIDExpr is the accepted shape of an engagement ID as a regular
+// expression. It travels in init paths, so it is kept to path-safe characters.
+const EngagementIDExpr = `[A-Za-z0-9._-]{1,64}`
+
+var engagementIDPattern = regexp.MustCompile(`^` + EngagementIDExpr + `$`)
+
+// IsValidEngagementID reports whether id can be used as an engagement ID
+func IsValidEngagementID(id string) bool {
+	return engagementIDPattern.MatchString(id) && id != "." && id != ".."
+}
+
+// Manifest describes an authorised engagement
+type Manifest struct {
+	EngagementID string    `json:"engagement_id"`
+	AllowedURLs  []string  `json:"allowed_urls"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	// MaxTotalBytes caps the encrypted bytes transferred under the engagement
+	MaxTotalBytes int64 `json:"max_total_bytes"`
+}
+
+// SignedManifest is a manifest together with its signature
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+// Validate checks that the manifest fields are usable
+func (m *Manifest) Validate() error {
+	if !IsValidEngagementID(m.EngagementID) {
+		return fmt.Errorf("invalid engagement ID %q", m.EngagementID)
+	}
+	if len(m.AllowedURLs) == 0 {
+		return errors.New("manifest allows no receiver URLs")
+	}
+	for _, allowed := range m.AllowedURLs {
+		if _, err := parseScopeURL(allowed); err != nil {
+			return fmt.Errorf("invalid allowed URL %q: %v", allowed, err)
+		}
+	}
+	if m.NotBefore.IsZero() || m.NotAfter.IsZero() || !m.NotAfter.After(m.NotBefore) {
+		return errors.New("manifest must have a start before its end")
+	}
+	if m.MaxTotalBytes <= 0 {
+		return errors.New("max_total_bytes must be positive")
+	}
+	return nil
+}
+
+// CheckWindow returns an error unless now falls within the engagement window
+func (m *Manifest) CheckWindow(now time.Time) error {
+	if now.Before(m.NotBefore) {
+		return fmt.Errorf("engagement %s has not started (starts %s)", m.EngagementID, m.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(m.NotAfter) {
+		return fmt.Errorf("engagement %s ended %s", m.EngagementID, m.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// InScope reports whether baseURL is one of the allowed receiver URLs or
+// lies below one of them. Scheme and host must match exactly.
+func (m *Manifest) InScope(baseURL string) bool {
+	target, err := parseScopeURL(baseURL)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range m.AllowedURLs {
+		scope, err := parseScopeURL(allowed)
+		if err != nil {
+			continue
+		}
+		if target.Scheme != scope.Scheme || target.Host != scope.Host {
+			continue
+		}
+		if target.Path == scope.Path || strings.HasPrefix(target.Path, scope.Path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScopeURL parses an absolute http(s) URL and normalises it for
+// comparison: lowercase scheme and host, no trailing slash on the path
+func parseScopeURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.New("URL must not carry credentials, a query or a fragment")
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimRight(u.Path, "/")
+	return u, nil
+}
+
+// SignManifest validates m and returns it signed with key, ready to be
+// written to disk
+func SignManifest(m Manifest, key ed25519.PrivateKey) ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	signed := SignedManifest{
+		Manifest:  body,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, body)),
+	}
+	return json.MarshalIndent(signed, "", "  ")
+}
+
+// LoadManifest verifies a signed manifest against the operator's public key
+// and returns the manifest it carries
+func LoadManifest(data []byte, key ed25519.PublicKey) (*Manifest, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid manifest public key")
+	}
+	var signed SignedManifest
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	var body bytes.Buffer
+	if err := json.Compact(&body, signed.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(key, body.Bytes(), signature) {
+		return nil, errors.New("manifest signature is not valid")
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(signed.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ParsePublicKey decodes a hex ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("public key must be 64 hex characters")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// ParsePrivateKey decodes a hex ed25519 private key seed
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("private key must be 64 hex characters")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testManifest returns a manifest valid for the next hour
+func testManifest() Manifest {
+	now := time.Now().UTC()
+	return Manifest{
+		EngagementID:  "acme-2026",
+		AllowedURLs:   []string{"https://collector.example.com/acme", "http://10.0.0.5:8080"},
+		NotBefore:     now.Add(-time.Hour),
+		NotAfter:      now.Add(time.Hour),
+		MaxTotalBytes: 1 << 20,
+	}
+}
+
+func TestManifestSignAndLoad(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := SignManifest(testManifest(), private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := LoadManifest(data, public)
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	if m.EngagementID != "acme-2026" {
+		t.Errorf("engagement = %q", m.EngagementID)
+	}
+
+	otherPublic, _, _ := ed25519.GenerateKey(nil)
+	if _, err := LoadManifest(data, otherPublic); err == nil {
+		t.Error("manifest verified under another key")
+	}
+
+	tampered := strings.Replace(string(data), "acme-2026", "acme-2027", 1)
+	if _, err := LoadManifest([]byte(tampered), public); err == nil {
+		t.Error("tampered manifest verified")
+	}
+}
+
+func TestManifestWindow(t *testing.T) {
+	m := testManifest()
+	if err := m.CheckWindow(time.Now()); err != nil {
+		t.Errorf("CheckWindow(now): %v", err)
+	}
+	if err := m.CheckWindow(m.NotBefore.Add(-time.Second)); err == nil {
+		t.Error("accepted a time before the window")
+	}
+	if err := m.CheckWindow(m.NotAfter.Add(time.Second)); err == nil {
+		t.Error("accepted a time after the window")
+	}
+}
+
+func TestManifestScope(t *testing.T) {
+	m := testManifest()
+	tests := []struct {
+		url     string
+		inScope bool
+	}{
+		{"https://collector.example.com/acme", true},
+		{"https://collector.example.com/acme/", true},
+		{"https://COLLECTOR.example.com/acme/drop", true},
+		{"http://10.0.0.5:8080/", true},
+		{"http://10.0.0.5:8080/anything", true},
+		{"http://collector.example.com/acme", false},
+		{"https://collector.example.com/acme-other", false},
+		{"https://collector.example.com/", false},
+		{"https://collector.example.com.evil.test/acme", false},
+		{"https://user@collector.example.com/acme", false},
+		{"http://10.0.0.5:8081/", false},
+		{"collector.example.com/acme", false},
+	}
+	for _, tt := range tests {
+		if got := m.InScope(tt.url); got != tt.inScope {
+			t.Errorf("InScope(%q) = %v, want %v", tt.url, got, tt.inScope)
+		}
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	invalid := []func(m *Manifest){
+		func(m *Manifest) { m.EngagementID = "" },
+		func(m *Manifest) { m.EngagementID = "a/b" },
+		func(m *Manifest) { m.AllowedURLs = nil },
+		func(m *Manifest) { m.AllowedURLs = []string{"ftp://example.com"} },
+		func(m *Manifest) { m.NotAfter = m.NotBefore },
+		func(m *Manifest) { m.MaxTotalBytes = 0 },
+	}
+	for i, mutate := range invalid {
+		m := testManifest()
+		mutate(&m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("case %d: invalid manifest accepted", i)
+		}
+	}
+}
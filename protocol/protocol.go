@@ -0,0 +1,358 @@
+// Package protocol defines the wire format shared by the client and the
+// receiver. Every request is a GET whose path carries one message:
+//
+//	init/v3/<transferID>/<totalChunks>/<fileSize>/<engagementID>/<filename>/<mac>/@v/v1.info
+//	chunk/v3/<transferID>/<index>/<checksum>/<data>/<mac>/@v/v1.info
+//	complete/v3/<transferID>/<checksum>/<mac>/@v/v1.info
+//
+// The MAC authenticates everything before it (see Sign) and URLSuffix is
+// appended so the requests look like Go module proxy lookups.
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version is the protocol version spoken by this package. Version 2 added
+// the engagement ID to init messages; version 3 changed the payload to a
+// salted stream of AES-GCM segments under HKDF-derived keys.
+const Version = 3
+
+// URLSuffix is the suffix added to all request URLs
+const URLSuffix = "/@v/v1.info"
+
+// MaxPayloadLength is the maximum allowed length for a request path
+// (excluding the base URL and URLSuffix)
+const MaxPayloadLength = 2000
+
+// Sizes of the fixed-width fields, in hex characters
+const (
+	TransferIDLength = 64 // 32 random bytes
+	ChecksumLength   = 64 // SHA-256
+	MACLength        = 64 // HMAC-SHA256
+	maxIndexLength   = 10
+)
+
+// ChunkPathOverhead is the length of a signed chunk path excluding the data:
+// "chunk/v3/" + transferID + "/" + index + "/" + checksum + "/" + "/" + mac
+const ChunkPathOverhead = len("chunk/v3/") + TransferIDLength + 1 + maxIndexLength + 1 +
+	ChecksumLength + 1 + 1 + MACLength
+
+// MaxFilenameLength is the longest filename an init message may carry
+const MaxFilenameLength = 255
+
+// Action names a message type
+type Action string
+
+// Actions
+const (
+	ActionInit     Action = "init"
+	ActionChunk    Action = "chunk"
+	ActionComplete Action = "complete"
+)
+
+// Error codes for requests that cannot be decoded
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeUnknownAction      = "unknown_action"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeInvalidTransferID  = "invalid_transfer_id"
+	CodeInvalidTotalChunks = "invalid_total_chunks"
+	CodeInvalidFileSize    = "invalid_file_size"
+	CodeInvalidEngagement  = "invalid_engagement"
+	CodeInvalidFilename    = "invalid_filename"
+	CodeInvalidChunkIndex  = "invalid_chunk_index"
+	CodeInvalidChecksum    = "invalid_checksum"
+	CodeInvalidChunkData   = "invalid_chunk_data"
+	CodeMissingMAC         = "missing_mac"
+)
+
+// Error is a decoding or validation failure with a machine-readable code
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// errorf builds an Error with a formatted message
+func errorf(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	hexDigestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	hexDataPattern   = regexp.MustCompile(`^[0-9a-f]+$`)
+)
+
+// IsValidTransferID reports whether id is 32 bytes in lowercase hex
+func IsValidTransferID(id string) bool {
+	return hexDigestPattern.MatchString(id)
+}
+
+// Message is one of Init, Chunk or Complete
+type Message interface {
+	// Action returns the message type
+	Action() Action
+	// ID returns the transfer the message belongs to
+	ID() string
+	// Validate checks the message fields
+	Validate() error
+	// fields returns the path components after the transfer ID
+	fields() []string
+}
+
+// Init announces a new transfer
+type Init struct {
+	TransferID   string
+	TotalChunks  int
+	FileSize     int
+	EngagementID string
+	Filename     string
+}
+
+// Chunk carries one piece of the hex-encoded ciphertext
+type Chunk struct {
+	TransferID string
+	Index      int
+	Checksum   string
+	Data       string
+}
+
+// Complete asks the receiver to assemble a transfer
+type Complete struct {
+	TransferID string
+	Checksum   string
+}
+
+// Action implements Message
+func (m Init) Action() Action { return ActionInit }
+
+// Action implements Message
+func (m Chunk) Action() Action { return ActionChunk }
+
+// Action implements Message
+func (m Complete) Action() Action { return ActionComplete }
+
+// ID implements Message
+func (m Init) ID() string { return m.TransferID }
+
+// ID implements Message
+func (m Chunk) ID() string { return m.TransferID }
+
+// ID implements Message
+func (m Complete) ID() string { return m.TransferID }
+
+func (m Init) fields() []string {
+	return []string{strconv.Itoa(m.TotalChunks), strconv.Itoa(m.FileSize), m.EngagementID, m.Filename}
+}
+
+func (m Chunk) fields() []string {
+	return []string{strconv.Itoa(m.Index), m.Checksum, m.Data}
+}
+
+func (m Complete) fields() []string {
+	return []string{m.Checksum}
+}
+
+// Validate implements Message
+func (m Init) Validate() error {
+	if !IsValidTransferID(m.TransferID) {
+		return errorf(CodeInvalidTransferID, "invalid transfer ID")
+	}
+	if m.TotalChunks <= 0 {
+		return errorf(CodeInvalidTotalChunks, "total chunks must be positive, got %d", m.TotalChunks)
+	}
+	if m.FileSize < 0 {
+		return errorf(CodeInvalidFileSize, "file size must not be negative, got %d", m.FileSize)
+	}
+	if !IsValidEngagementID(m.EngagementID) {
+		return errorf(CodeInvalidEngagement, "invalid engagement ID")
+	}
+	if m.Filename == "" || m.Filename == "." || m.Filename == ".." ||
+		len(m.Filename) > MaxFilenameLength || strings.Contains(m.Filename, "/") {
+		return errorf(CodeInvalidFilename, "invalid filename")
+	}
+	return nil
+}
+
+// Validate implements Message
+func (m Chunk) Validate() error {
+	if !IsValidTransferID(m.TransferID) {
+		return errorf(CodeInvalidTransferID, "invalid transfer ID")
+	}
+	if m.Index < 0 {
+		return errorf(CodeInvalidChunkIndex, "chunk index must not be negative, got %d", m.Index)
+	}
+	if !hexDigestPattern.MatchString(m.Checksum) {
+		return errorf(CodeInvalidChecksum, "invalid chunk checksum")
+	}
+	if !hexDataPattern.MatchString(m.Data) {
+		return errorf(CodeInvalidChunkData, "chunk data must be lowercase hex")
+	}
+	return nil
+}
+
+// Validate implements Message
+func (m Complete) Validate() error {
+	if !IsValidTransferID(m.TransferID) {
+		return errorf(CodeInvalidTransferID, "invalid transfer ID")
+	}
+	if !hexDigestPattern.MatchString(m.Checksum) {
+		return errorf(CodeInvalidChecksum, "invalid checksum")
+	}
+	return nil
+}
+
+// versionSegment is how the version appears in a path
+func versionSegment(version int) string {
+	return "v" + strconv.Itoa(version)
+}
+
+// Path returns the unsigned path of a message
+func Path(m Message) string {
+	components := append([]string{string(m.Action()), versionSegment(Version), m.ID()}, m.fields()...)
+	return strings.Join(components, "/")
+}
+
+// Encode validates a message and returns its signed path, ready to be
+// appended to the base URL together with URLSuffix
+func Encode(m Message, macKey []byte) (string, error) {
+	if err := m.Validate(); err != nil {
+		return "", err
+	}
+	path := Sign(Path(m), macKey)
+	if len(path) > MaxPayloadLength {
+		return "", fmt.Errorf("payload length (%d) exceeds maximum allowed length (%d)",
+			len(path), MaxPayloadLength)
+	}
+	return path, nil
+}
+
+// Request is a decoded request path
+type Request struct {
+	Version int
+	Message Message
+	// Body is the signed part of the path and MAC the signature over it
+	Body string
+	MAC  string
+}
+
+// ParsePath decodes a request path. Leading and trailing slashes and
+// URLSuffix are ignored. The MAC is split off but not verified; see Verify.
+func ParsePath(path string) (*Request, error) {
+	path = strings.Trim(path, "/")
+	path = strings.TrimSuffix(path, strings.Trim(URLSuffix, "/"))
+	path = strings.Trim(path, "/")
+
+	components := strings.Split(path, "/")
+	if len(components) < 2 {
+		return nil, errorf(CodeInvalidRequest, "invalid request format")
+	}
+
+	action := Action(components[0])
+	switch action {
+	case ActionInit, ActionChunk, ActionComplete:
+	default:
+		return nil, errorf(CodeUnknownAction, "unknown action %q", components[0])
+	}
+
+	// The version comes first so that future layouts can differ
+	version, err := parseVersion(components[1])
+	if err != nil {
+		return nil, err
+	}
+	if version != Version {
+		return nil, errorf(CodeUnsupportedVersion,
+			"protocol version %d is not supported (this receiver speaks version %d)", version, Version)
+	}
+
+	if len(components) < 4 {
+		return nil, errorf(CodeMissingMAC, "request is not signed")
+	}
+	body := components[:len(components)-1]
+	args := body[2:]
+
+	var msg Message
+	switch action {
+	case ActionInit:
+		msg, err = decodeInit(args)
+	case ActionChunk:
+		msg, err = decodeChunk(args)
+	case ActionComplete:
+		msg, err = decodeComplete(args)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Request{
+		Version: version,
+		Message: msg,
+		Body:    strings.Join(body, "/"),
+		MAC:     components[len(components)-1],
+	}, nil
+}
+
+// parseVersion reads a "v<n>" path segment
+func parseVersion(segment string) (int, error) {
+	if !strings.HasPrefix(segment, "v") {
+		return 0, errorf(CodeUnsupportedVersion, "missing protocol version")
+	}
+	version, err := strconv.Atoi(segment[1:])
+	if err != nil || version <= 0 {
+		return 0, errorf(CodeUnsupportedVersion, "invalid protocol version %q", segment)
+	}
+	return version, nil
+}
+
+// decodeInit parses transferID/totalChunks/fileSize/engagementID/filename
+func decodeInit(args []string) (Message, error) {
+	if len(args) != 5 {
+		return nil, errorf(CodeInvalidRequest, "invalid init request format")
+	}
+	totalChunks, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errorf(CodeInvalidTotalChunks, "invalid total chunks")
+	}
+	fileSize, err := strconv.Atoi(args[2])
+	if err != nil {
+		return nil, errorf(CodeInvalidFileSize, "invalid file size")
+	}
+	return Init{
+		TransferID:   args[0],
+		TotalChunks:  totalChunks,
+		FileSize:     fileSize,
+		EngagementID: args[3],
+		Filename:     args[4],
+	}, nil
+}
+
+// decodeChunk parses transferID/index/checksum/data
+func decodeChunk(args []string) (Message, error) {
+	if len(args) != 4 {
+		return nil, errorf(CodeInvalidRequest, "invalid chunk request format")
+	}
+	index, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errorf(CodeInvalidChunkIndex, "invalid chunk index")
+	}
+	return Chunk{TransferID: args[0], Index: index, Checksum: args[2], Data: args[3]}, nil
+}
+
+// decodeComplete parses transferID/checksum
+func decodeComplete(args []string) (Message, error) {
+	if len(args) != 2 {
+		return nil, errorf(CodeInvalidRequest, "invalid complete request format")
+	}
+	return Complete{TransferID: args[0], Checksum: args[1]}, nil
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testID = strings.Repeat("ab", 32)
+
+func TestEncodeParseRoundTrip(t *testing.T) {
+	macKey := DeriveMACKey("shared", testID)
+	messages := []Message{
+		Init{TransferID: testID, TotalChunks: 3, FileSize: 1234, EngagementID: "acme-2026", Filename: "report.pdf"},
+		Chunk{TransferID: testID, Index: 2, Checksum: strings.Repeat("0f", 32), Data: "deadbeef"},
+		Complete{TransferID: testID, Checksum: strings.Repeat("1e", 32)},
+	}
+
+	for _, msg := range messages {
+		path, err := Encode(msg, macKey)
+		if err != nil {
+			t.Fatalf("Encode(%v): %v", msg, err)
+		}
+
+		req, err := ParsePath("/" + path + URLSuffix)
+		if err != nil {
+			t.Fatalf("ParsePath(%q): %v", path, err)
+		}
+		if req.Version != Version || req.Message != msg {
+			t.Errorf("decoded %+v, want %+v", req.Message, msg)
+		}
+		if !req.Verify("shared") {
+			t.Errorf("%s: MAC did not verify", msg.Action())
+		}
+		if req.Verify("other") {
+			t.Errorf("%s: MAC verified under the wrong key", msg.Action())
+		}
+	}
+}
+
+func TestParsePathRejects(t *testing.T) {
+	tests := []struct {
+		path string
+		code string
+	}{
+		{"init", CodeInvalidRequest},
+		{"upload/v3/" + testID + "/mac", CodeUnknownAction},
+		{"init/v1/" + testID + "/1/10/e/a.txt/mac", CodeUnsupportedVersion},
+		{"init/v2/" + testID + "/1/10/e/a.txt/mac", CodeUnsupportedVersion},
+		{"init/v4/" + testID + "/1/10/e/a.txt/mac", CodeUnsupportedVersion},
+		{"init/" + testID + "/1/10/e/a.txt/mac", CodeUnsupportedVersion},
+		{"init/v3/" + testID + "/1/10/a.txt/mac", CodeInvalidRequest},
+		{"init/v3/" + testID, CodeMissingMAC},
+		{"init/v3/xyz/1/10/e/a.txt/mac", CodeInvalidTransferID},
+		{"init/v3/" + testID + "/0/10/e/a.txt/mac", CodeInvalidTotalChunks},
+		{"init/v3/" + testID + "/1/-5/e/a.txt/mac", CodeInvalidFileSize},
+		{"init/v3/" + testID + "/1/10/e!/a.txt/mac", CodeInvalidEngagement},
+		{"init/v3/" + testID + "/1/10/../a.txt/mac", CodeInvalidEngagement},
+		{"init/v3/" + testID + "/1/10/e/../mac", CodeInvalidFilename},
+		{"chunk/v3/" + testID + "/-1/" + testID + "/abcd/mac", CodeInvalidChunkIndex},
+		{"chunk/v3/" + testID + "/0/short/abcd/mac", CodeInvalidChecksum},
+		{"chunk/v3/" + testID + "/0/" + testID + "/XYZ/mac", CodeInvalidChunkData},
+		{"complete/v3/" + testID + "/nothex/mac", CodeInvalidChecksum},
+	}
+
+	for _, tt := range tests {
+		_, err := ParsePath(tt.path)
+		var perr *Error
+		if !errors.As(err, &perr) || perr.Code != tt.code {
+			t.Errorf("ParsePath(%q) = %v, want code %s", tt.path, err, tt.code)
+		}
+	}
+}
+
+func TestChunkPathOverhead(t *testing.T) {
+	msg := Chunk{TransferID: testID, Index: 1<<31 - 1, Checksum: testID, Data: "00"}
+	path, err := Encode(msg, []byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(path) - len(msg.Data); got != ChunkPathOverhead {
+		t.Errorf("chunk overhead = %d, want %d", got, ChunkPathOverhead)
+	}
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// A status query asks the receiver whether an engagement is still active,
+// so that clients can be stopped centrally:
+//
+//	status/v3/<engagementID>/<mac>/@v/v1.info
+//
+// It is signed like a transfer message, under a key derived for the
+// engagement rather than for a transfer.
+
+// ActionStatus names a status query
+const ActionStatus Action = "status"
+
+// CodeEngagementActive answers a status query for an engagement that may
+// still be used
+const CodeEngagementActive = "engagement_active"
+
+// statusKeyLabel separates the status authentication key from other uses of
+// the shared key
+const statusKeyLabel = "ssrfleak/status-mac/v1|"
+
+// DeriveStatusKey derives the status query authentication key from the
+// shared key and the engagement ID
+func DeriveStatusKey(sharedKey, engagementID string) []byte {
+	mac := hmac.New(sha256.New, []byte(sharedKey))
+	mac.Write([]byte(statusKeyLabel + engagementID))
+	return mac.Sum(nil)
+}
+
+// StatusRequest is a decoded status query
+type StatusRequest struct {
+	Version      int
+	EngagementID string
+	Body         string
+	MAC          string
+}
+
+// EncodeStatus returns the signed path of a status query for an engagement
+func EncodeStatus(engagementID, sharedKey string) (string, error) {
+	if !IsValidEngagementID(engagementID) {
+		return "", errorf(CodeInvalidEngagement, "invalid engagement ID")
+	}
+	path := strings.Join([]string{string(ActionStatus), versionSegment(Version), engagementID}, "/")
+	return Sign(path, DeriveStatusKey(sharedKey, engagementID)), nil
+}
+
+// IsStatusPath reports whether a request path is a status query rather
+// than a transfer message
+func IsStatusPath(path string) bool {
+	return strings.HasPrefix(strings.TrimLeft(path, "/"), string(ActionStatus)+"/")
+}
+
+// ParseStatusPath decodes a status query path. The MAC is split off but not
+// verified; see Verify.
+func ParseStatusPath(path string) (*StatusRequest, error) {
+	path = strings.Trim(path, "/")
+	path = strings.TrimSuffix(path, strings.Trim(URLSuffix, "/"))
+	path = strings.Trim(path, "/")
+
+	components := strings.Split(path, "/")
+	if len(components) < 2 || components[0] != string(ActionStatus) {
+		return nil, errorf(CodeInvalidRequest, "invalid status request format")
+	}
+	version, err := parseVersion(components[1])
+	if err != nil {
+		return nil, err
+	}
+	if version != Version {
+		return nil, errorf(CodeUnsupportedVersion,
+			"protocol version %d is not supported (this receiver speaks version %d)", version, Version)
+	}
+	if len(components) == 3 {
+		return nil, errorf(CodeMissingMAC, "request is not signed")
+	}
+	if len(components) != 4 {
+		return nil, errorf(CodeInvalidRequest, "invalid status request format")
+	}
+	if !IsValidEngagementID(components[2]) {
+		return nil, errorf(CodeInvalidEngagement, "invalid engagement ID")
+	}
+
+	return &StatusRequest{
+		Version:      version,
+		EngagementID: components[2],
+		Body:         strings.Join(components[:3], "/"),
+		MAC:          components[3],
+	}, nil
+}
+
+// Verify reports whether the query's MAC is valid under the engagement key
+// derived from sharedKey
+func (r *StatusRequest) Verify(sharedKey string) bool {
+	received, err := hex.DecodeString(r.MAC)
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(ComputeMAC(DeriveStatusKey(sharedKey, r.EngagementID), r.Body))
+	return hmac.Equal(received, expected)
+}
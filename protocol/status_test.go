@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestStatusRoundTrip(t *testing.T) {
+	path, err := EncodeStatus("acme-2026", "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsStatusPath("/"+path) || IsStatusPath("init/v3/x") {
+		t.Error("IsStatusPath does not tell status queries from transfer messages")
+	}
+
+	req, err := ParseStatusPath("/" + path + URLSuffix)
+	if err != nil {
+		t.Fatalf("ParseStatusPath(%q): %v", path, err)
+	}
+	if req.EngagementID != "acme-2026" || req.Version != Version {
+		t.Errorf("decoded %+v", req)
+	}
+	if !req.Verify("shared") || req.Verify("other") {
+		t.Error("status MAC does not verify under exactly the shared key")
+	}
+
+	// The status key is not a transfer key for an ID of the same value
+	if string(DeriveStatusKey("shared", testID)) == string(DeriveMACKey("shared", testID)) {
+		t.Error("status and transfer keys coincide")
+	}
+}
+
+func TestParseStatusPathRejects(t *testing.T) {
+	tests := []struct {
+		path string
+		code string
+	}{
+		{"status", CodeInvalidRequest},
+		{"status/v3/acme", CodeMissingMAC},
+		{fmt.Sprintf("status/v%d/acme/%s", Version+1, testID), CodeUnsupportedVersion},
+		{"status/v3/ac%20me/" + testID, CodeInvalidEngagement},
+		{"status/v3/acme/" + testID + "/extra", CodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		_, err := ParseStatusPath(tt.path)
+		var perr *Error
+		if !errors.As(err, &perr) || perr.Code != tt.code {
+			t.Errorf("ParseStatusPath(%q) = %v, want code %s", tt.path, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+)
+
+// After the salt, a payload is a stream of AES-256-GCM segments so the
+// receiver can decrypt it without holding the whole file in memory:
+//
+//	prefix (7 random bytes) || segment 0 || segment 1 || ... || final segment
+//
+// Each segment seals up to StreamSegmentSize bytes of plaintext under the
+// nonce prefix || big-endian segment counter (4 bytes) || final flag (1 byte).
+// The final flag stops truncation and reordering going unnoticed.
+const (
+	StreamSegmentSize     = 64 * 1024
+	StreamNoncePrefixSize = 7
+	// StreamTagSize is the GCM tag sealed onto every segment
+	StreamTagSize = 16
+)
+
+// NewStreamAEAD returns the AES-256-GCM instance used for stream segments
+func NewStreamAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCMWithTagSize(block, StreamTagSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return gcm, nil
+}
+
+// StreamNonce builds the nonce for one segment
+func StreamNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, StreamNoncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[StreamNoncePrefixSize:], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// EncryptedSize returns the size in bytes of the payload, salt included,
+// for a plaintext of the given size (the hex payload is twice as long). An
+// empty plaintext still takes one segment.
+func EncryptedSize(plaintextSize int64) int64 {
+	segments := (plaintextSize + StreamSegmentSize - 1) / StreamSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return PayloadSaltSize + StreamNoncePrefixSize + plaintextSize + segments*StreamTagSize
+}
@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStreamNonceLayout(t *testing.T) {
+	prefix := []byte{1, 2, 3, 4, 5, 6, 7}
+	want := []byte{1, 2, 3, 4, 5, 6, 7, 0, 0, 1, 2, 1}
+	if got := StreamNonce(prefix, 258, true); !bytes.Equal(got, want) {
+		t.Errorf("StreamNonce = %x, want %x", got, want)
+	}
+	if got := StreamNonce(prefix, 258, false); got[len(got)-1] != 0 {
+		t.Errorf("non-final nonce %x has the final flag set", got)
+	}
+
+	aead, err := NewStreamAEAD(make([]byte, PayloadKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aead.NonceSize() != len(want) || aead.Overhead() != StreamTagSize {
+		t.Errorf("AEAD nonce %d, overhead %d do not match the stream layout", aead.NonceSize(), aead.Overhead())
+	}
+}
+
+func TestEncryptedSize(t *testing.T) {
+	overhead := int64(PayloadSaltSize + StreamNoncePrefixSize)
+	tests := []struct {
+		plaintext, want int64
+	}{
+		{0, overhead + StreamTagSize},
+		{1, overhead + 1 + StreamTagSize},
+		{StreamSegmentSize, overhead + StreamSegmentSize + StreamTagSize},
+		{StreamSegmentSize + 1, overhead + StreamSegmentSize + 1 + 2*StreamTagSize},
+	}
+	for _, tt := range tests {
+		if got := EncryptedSize(tt.plaintext); got != tt.want {
+			t.Errorf("EncryptedSize(%d) = %d, want %d", tt.plaintext, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Clients can pin the receiver's certificate by its fingerprint: the
+// SHA-256 of the DER-encoded leaf certificate, in lowercase hex. The
+// receiver logs it at startup.
+
+// CertificateFingerprint returns the fingerprint of a DER-encoded certificate
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseFingerprint normalises a fingerprint as printed by common tools:
+// an optional "sha256:" or "sha256/" prefix, upper or lower case hex and
+// colons between bytes are accepted
+func ParseFingerprint(s string) (string, error) {
+	fp := strings.ToLower(strings.TrimSpace(s))
+	fp = strings.TrimPrefix(strings.TrimPrefix(fp, "sha256:"), "sha256/")
+	fp = strings.ReplaceAll(fp, ":", "")
+	if !hexDigestPattern.MatchString(fp) {
+		return "", fmt.Errorf("invalid certificate fingerprint %q: want 64 hex characters of SHA-256", s)
+	}
+	return fp, nil
+}
@@ -0,0 +1,26 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	want := CertificateFingerprint([]byte("certificate"))
+	colons := strings.ToUpper(want[:2])
+	for i := 2; i < len(want); i += 2 {
+		colons += ":" + strings.ToUpper(want[i:i+2])
+	}
+
+	for _, s := range []string{want, strings.ToUpper(want), "sha256:" + want, "SHA256/" + want, colons, " " + want + "\n"} {
+		got, err := ParseFingerprint(s)
+		if err != nil || got != want {
+			t.Errorf("ParseFingerprint(%q) = %q, %v; want %q", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", want[:62], want + "00", "md5:" + want, strings.Repeat("zz", 32)} {
+		if _, err := ParseFingerprint(s); err == nil {
+			t.Errorf("ParseFingerprint(%q) accepted", s)
+		}
+	}
+}
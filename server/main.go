@@ -1,25 +1,93 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	modules "server/modules"
 )
 
+// subcommands run offline instead of starting the receiver
+var subcommands = map[string]func([]string) error{
+	"manifest": modules.RunManifestCommand,
+	"report":   modules.RunReportCommand,
+	"revoke":   modules.RunRevokeCommand,
+	"purge":    modules.RunPurgeCommand,
+	"verify":   modules.RunVerifyCommand,
+	"open":     modules.RunOpenCommand,
+}
+
 func main() {
-	// Parse command line flags
-	verbose := flag.Bool("v", false, "Enable verbose logging")
-	flag.Parse()
+	// Offline subcommands
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			return
+		}
+	}
+
+	// Load configuration from config file, environment and flags
+	cfg, err := modules.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	// Load the encryption keys; refuse to start without one
+	keyring, err := cfg.LoadKeyring()
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	modules.SetKeyring(keyring)
+
+	// Only transfers for a signed, current engagement are accepted
+	manifest, err := cfg.LoadManifest()
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if err := manifest.CheckWindow(time.Now()); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	modules.SetManifest(manifest)
+
+	modules.SetOutputDir(cfg.OutputDir)
+	modules.SetTransferRetention(time.Duration(cfg.TransferRetention))
+	modules.SetRetentionPolicy(cfg.Retention)
+	modules.SetLimits(cfg.Limits)
+	modules.SetSourcePolicy(cfg.Sources)
+	if cfg.OutputPublicKey != "" {
+		key, err := modules.ParseOutputPublicKey(cfg.OutputPublicKey)
+		if err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		modules.SetOutputPublicKey(key)
+		log.Printf("Received files are encrypted at rest; only \"open\" with the private key can read them")
+	}
+
+	// Every request and cleanup is recorded for the engagement report
+	if err := os.MkdirAll(cfg.OutputDir, 0700); err != nil {
+		log.Fatalf("Failed to create output directory: %v", err)
+	}
+	auditLog, err := modules.OpenAuditLog(cfg.AuditLogPath())
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	modules.SetAuditLog(auditLog)
 
-	// Set encryption key
-	encryptionKey := "abcdefghi1234567890" // Or from environment variable
-	modules.SetEncryptionKey(encryptionKey)
+	// Restore transfers that were in progress before a restart
+	if err := modules.ReplayJournal(); err != nil {
+		log.Fatalf("Failed to replay transfer journal: %v", err)
+	}
 
 	// Set verbose mode if flag is present
-	modules.SetVerboseMode(*verbose)
+	modules.SetVerboseMode(cfg.Verbose)
 
 	// Set up HTTP handler
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -32,17 +100,77 @@ func main() {
 		modules.HandleRequest(w, r)
 	})
 
+	// SIGINT or SIGTERM starts a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Start periodic cleanup routine
+	cleanupDone := make(chan struct{})
 	go func() {
-		for {
-			time.Sleep(5 * time.Minute)
-			modules.ScheduleCleanup()
-		}
+		modules.RunCleanup(ctx, time.Duration(cfg.CleanupInterval))
+		close(cleanupDone)
 	}()
 
 	// Start server
-	log.Println("Server starting on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Server error: %v", err)
+	server := &http.Server{Addr: cfg.ListenAddr}
+	serveErr := make(chan error, 1)
+	if !cfg.TLS.Enabled() {
+		log.Printf("Warning: serving plain HTTP; transfers are only protected by payload encryption")
+		log.Printf("Server starting on %s (output: %s)", cfg.ListenAddr, cfg.OutputDir)
+		go func() { serveErr <- server.ListenAndServe() }()
+	} else {
+		cert, err := cfg.TLS.LoadCertificate(cfg.OutputDir)
+		if err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		server.TLSConfig = modules.ServerTLSConfig(cert)
+		log.Printf("TLS certificate fingerprint (client --pin): %s", modules.CertificateFingerprint(cert))
+		log.Printf("Server starting with TLS on %s (output: %s)", cfg.ListenAddr, cfg.OutputDir)
+		go func() { serveErr <- server.ListenAndServeTLS("", "") }()
+	}
+
+	// Operator metrics, on loopback only
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", modules.HandleMetrics)
+		metricsServer = &http.Server{Addr: cfg.MetricsAddr, Handler: metricsMux}
+		log.Printf("Serving metrics on http://%s/metrics", cfg.MetricsAddr)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("ERROR: Metrics server error: %v", err)
+			}
+		}()
+	}
+
+	exitCode := 0
+	select {
+	case err := <-serveErr:
+		log.Printf("ERROR: Server error: %v", err)
+		exitCode = 1
+	case <-ctx.Done():
+		log.Printf("Shutting down; waiting up to %s for requests in progress", time.Duration(cfg.ShutdownTimeout))
+	}
+	// A second signal kills the process
+	stop()
+
+	// Stop accepting requests and let those in progress finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: requests still in progress at shutdown: %v", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	<-cleanupDone
+
+	// Settle every transfer, then flush the audit log
+	modules.FinishTransfers(shutdownCtx)
+	if err := auditLog.Close(); err != nil {
+		log.Printf("ERROR: Failed to close audit log: %v", err)
+		exitCode = 1
 	}
+	log.Printf("Server stopped")
+	os.Exit(exitCode)
 }
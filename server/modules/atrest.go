@@ -0,0 +1,375 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"protocol"
+)
+
+// Outputs can be kept encrypted at rest under an operator X25519 public
+// key, so that the receiver never holds anything it can read back:
+//
+//	atRestMagic || ephemeral X25519 public key (32 bytes) || stream
+//
+// The stream is the AES-256-GCM segment stream of stream.go under the key
+// HKDF-SHA256(X25519(ephemeral, recipient), ephemeral || recipient,
+// atRestInfo). Only the holder of the private key can open the file, which
+// the "open" command does offline. Nothing on the receiver identifies the
+// contents: the file is named after the digest of what is stored, and the
+// sidecar seals the original name, plaintext digest and size the same way.
+const (
+	// AtRestEncryption names the scheme in output sidecars
+	AtRestEncryption = "x25519-hkdf-sha256-aes256gcm/v1"
+	atRestMagic      = "SSRFLEAK-AT-REST/1\n"
+	atRestInfo       = "ssrfleak/at-rest/v1"
+)
+
+// outputRecipient is the public key outputs are encrypted to; nil stores
+// them in plaintext
+var outputRecipient *ecdh.PublicKey
+
+// SetOutputPublicKey makes the output store encrypt outputs to key. A nil
+// key stores plaintext.
+func SetOutputPublicKey(key *ecdh.PublicKey) {
+	outputRecipient = key
+}
+
+// recordedName is the filename kept in the audit log, deletion records and
+// server log. It is left out when outputs are encrypted at rest, as only the
+// sealed record may identify the contents.
+func recordedName(filename string) string {
+	if outputRecipient != nil {
+		return ""
+	}
+	return SanitiseFilename(filename)
+}
+
+// ParseOutputPublicKey parses a hex X25519 public key
+func ParseOutputPublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid output public key: %v", err)
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output public key: %v", err)
+	}
+	return key, nil
+}
+
+// ParseOutputPrivateKey parses a hex X25519 private key
+func ParseOutputPrivateKey(s string) (*ecdh.PrivateKey, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid output private key: %v", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output private key: %v", err)
+	}
+	return key, nil
+}
+
+// sealedFields are the parts of an encrypted output's record that would
+// identify its contents. They are sealed to the recipient like the output,
+// so the sidecar only describes the file as stored.
+type sealedFields struct {
+	OriginalName string `json:"original_name"`
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+	// SealedName stands in for OriginalName when the transfer resumed after
+	// a restart: the journal only kept its name sealed (see sealFilename)
+	SealedName string `json:"sealed_name,omitempty"`
+}
+
+// sealFilename seals a transfer's filename to the output recipient so the
+// journal can keep it without naming the contents. It returns "" when
+// outputs are not encrypted at rest.
+func sealFilename(filename string) (string, error) {
+	if outputRecipient == nil {
+		return "", nil
+	}
+	return sealFields(sealedFields{OriginalName: SanitiseFilename(filename)}, outputRecipient)
+}
+
+// sealFields encrypts fields to recipient, hex encoded for the sidecar
+func sealFields(fields sealedFields, recipient *ecdh.PublicKey) (string, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	var sealed bytes.Buffer
+	w, err := sealOutput(&sealed, recipient)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sealed.Bytes()), nil
+}
+
+// atRestKey derives the stream key from the X25519 shared secret
+func atRestKey(secret, ephemeral, recipient []byte) []byte {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	return protocol.HKDF(secret, salt, []byte(atRestInfo), 32)
+}
+
+// sealOutput starts an output encrypted to recipient on dst. Close must be
+// called to finish it.
+func sealOutput(dst io.Writer, recipient *ecdh.PublicKey) (io.WriteCloser, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	secret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %v", err)
+	}
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+
+	if _, err := io.WriteString(dst, atRestMagic); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(ephemeralPublic); err != nil {
+		return nil, err
+	}
+	return newStreamWriter(dst, atRestKey(secret, ephemeralPublic, recipient.Bytes()))
+}
+
+// openOutput decrypts an output sealed to the private key into dst. As with
+// decryptStream, dst must be discarded if an error is returned.
+func openOutput(dst io.Writer, src io.Reader, key *ecdh.PrivateKey) error {
+	reader := bufio.NewReader(src)
+	magic := make([]byte, len(atRestMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != atRestMagic {
+		return errors.New("not an output encrypted at rest")
+	}
+	ephemeralPublic := make([]byte, 32)
+	if _, err := io.ReadFull(reader, ephemeralPublic); err != nil {
+		return errors.New("encrypted output truncated")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralPublic)
+	if err != nil {
+		return fmt.Errorf("invalid ephemeral key: %v", err)
+	}
+	secret, err := key.ECDH(ephemeral)
+	if err != nil {
+		return fmt.Errorf("key agreement failed: %v", err)
+	}
+	return decryptStream(dst, reader, atRestKey(secret, ephemeralPublic, key.PublicKey().Bytes()))
+}
+
+// Unseal returns a copy of an encrypted output's record with the original
+// name, plaintext SHA-256 and size decrypted with the private key
+func (s *OutputStore) Unseal(record *StoredFile, key *ecdh.PrivateKey) (*StoredFile, error) {
+	if record.Encryption == "" {
+		return nil, fmt.Errorf("output of transfer %s is not encrypted", record.TransferID)
+	}
+	if record.Encryption != AtRestEncryption {
+		return nil, fmt.Errorf("output of transfer %s uses unknown encryption %q", record.TransferID, record.Encryption)
+	}
+	if hex.EncodeToString(key.PublicKey().Bytes()) != strings.ToLower(record.Recipient) {
+		return nil, fmt.Errorf("output of transfer %s is encrypted to another key (%s)", record.TransferID, record.Recipient)
+	}
+
+	fields, err := openFields(record.Sealed, key)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting record of transfer %s: %v", record.TransferID, err)
+	}
+	if fields.SealedName != "" {
+		name, err := openFields(fields.SealedName, key)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting name of transfer %s: %v", record.TransferID, err)
+		}
+		fields.OriginalName = name.OriginalName
+	}
+	opened := *record
+	opened.OriginalName, opened.SHA256, opened.Size = fields.OriginalName, fields.SHA256, fields.Size
+	return &opened, nil
+}
+
+// openFields decrypts fields sealed by sealFields
+func openFields(sealed string, key *ecdh.PrivateKey) (*sealedFields, error) {
+	data, err := hex.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed fields: %v", err)
+	}
+	var plain bytes.Buffer
+	if err := openOutput(&plain, bytes.NewReader(data), key); err != nil {
+		return nil, err
+	}
+	var fields sealedFields
+	if err := json.Unmarshal(plain.Bytes(), &fields); err != nil {
+		return nil, fmt.Errorf("invalid sealed fields: %v", err)
+	}
+	return &fields, nil
+}
+
+// Open decrypts a stored output into dst and checks it against the
+// plaintext SHA-256 sealed in its record. dst must be discarded if an error
+// is returned.
+func (s *OutputStore) Open(record *StoredFile, key *ecdh.PrivateKey, dst io.Writer) error {
+	opened, err := s.Unseal(record, key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(record.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if err := openOutput(io.MultiWriter(dst, hasher), f, key); err != nil {
+		return fmt.Errorf("error decrypting output of transfer %s: %v", record.TransferID, err)
+	}
+	if digest := hex.EncodeToString(hasher.Sum(nil)); digest != opened.SHA256 {
+		return fmt.Errorf("output of transfer %s decrypts to %s, recorded %s", record.TransferID, digest, opened.SHA256)
+	}
+	return nil
+}
+
+// RunOpenCommand implements the "open" subcommand, run offline with the
+// private key:
+//
+//	open keygen [-out <name>]
+//	open -key <file> [-output <dir>] [-to <dir>] [-engagement <id>] [<transfer ID> ...]
+//
+// Opened files are written to <to>/<transfer ID>/<original name>.
+func RunOpenCommand(args []string) error {
+	if len(args) > 0 && args[0] == "keygen" {
+		return outputKeygen(args[1:])
+	}
+
+	fs := flag.NewFlagSet("open", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "File holding the hex X25519 private key")
+	outputDir := fs.String("output", DefaultConfig().OutputDir, "Output root directory")
+	to := fs.String("to", "opened", "Directory to write the decrypted files to")
+	engagementID := fs.String("engagement", "", "Only open this engagement's outputs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		return fmt.Errorf("open needs the private key: -key <file>")
+	}
+	data, err := readSecretFile(*keyFile)
+	if err != nil {
+		return fmt.Errorf("error reading key: %v", err)
+	}
+	key, err := ParseOutputPrivateKey(string(data))
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range fs.Args() {
+		wanted[id] = true
+	}
+	found := make(map[string]bool)
+	store := NewOutputStore(*outputDir)
+	stored, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	opened := 0
+	for _, record := range stored {
+		if (len(wanted) > 0 && !wanted[record.TransferID]) || (*engagementID != "" && record.Engagement != *engagementID) {
+			continue
+		}
+		found[record.TransferID] = true
+		if record.Encryption == "" {
+			fmt.Printf("Skipped %s: stored in plaintext at %s\n", record.TransferID, record.Path)
+			continue
+		}
+		unsealed, path, err := openTo(store, record, key, *to)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Opened %s (%q, %d bytes) to %s\n", record.TransferID, unsealed.OriginalName, unsealed.Size, path)
+		opened++
+	}
+	var missing []string
+	for id := range wanted {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("no stored output for %s", strings.Join(missing, ", "))
+	}
+	fmt.Printf("Opened %d outputs\n", opened)
+	return nil
+}
+
+// openTo decrypts one output below dir, removing it again on failure. It
+// returns the unsealed record and the path written.
+func openTo(store *OutputStore, record *StoredFile, key *ecdh.PrivateKey, dir string) (*StoredFile, string, error) {
+	opened, err := store.Unseal(record, key)
+	if err != nil {
+		return nil, "", err
+	}
+	transferDir := filepath.Join(dir, record.TransferID)
+	if err := os.MkdirAll(transferDir, 0700); err != nil {
+		return nil, "", fmt.Errorf("error creating directory: %v", err)
+	}
+	path := filepath.Join(transferDir, SanitiseFilename(opened.OriginalName))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, "", fmt.Errorf("refusing to overwrite existing file %s", path)
+		}
+		return nil, "", fmt.Errorf("error creating file: %v", err)
+	}
+	if err := store.Open(record, key, f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, "", fmt.Errorf("error closing file: %v", err)
+	}
+	return opened, path, nil
+}
+
+// outputKeygen writes a new X25519 key pair for encrypting outputs
+func outputKeygen(args []string) error {
+	fs := flag.NewFlagSet("open keygen", flag.ContinueOnError)
+	out := fs.String("out", "output", "Write the key pair to <out>.key and <out>.pub")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+	if err := writeExclusive(*out+".key", []byte(hex.EncodeToString(key.Bytes())+"\n")); err != nil {
+		return err
+	}
+	if err := writeExclusive(*out+".pub", []byte(hex.EncodeToString(key.PublicKey().Bytes())+"\n")); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s.key (keep offline) and %s.pub (receiver output_public_key)\n", *out, *out)
+	return nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutputEncryptedAtRest(t *testing.T) {
+	resetState(t, DefaultLimits())
+	auditPath := withAuditLog(t)
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetOutputPublicKey(key.PublicKey())
+
+	plaintext := bytes.Repeat([]byte("exfiltrated "), 1000)
+	record := completeTransfer(t, testTransferID, plaintext)
+	if record.Encryption != AtRestEncryption || record.Recipient != hex.EncodeToString(key.PublicKey().Bytes()) {
+		t.Fatalf("record: %+v", record)
+	}
+	plaintextSHA256 := calculateSHA256(string(plaintext))
+
+	// Nothing the receiver keeps identifies the contents
+	if record.SHA256 != "" || record.Size != 0 || record.OriginalName != "" || filepath.Base(record.Path) != record.StoredSHA256 {
+		t.Errorf("record describes the plaintext: %+v", record)
+	}
+	for _, path := range []string{filepath.Join(filepath.Dir(record.Path), "meta.json"), auditPath} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(plaintextSHA256)) || bytes.Contains(data, []byte("file.txt")) {
+			t.Errorf("%s names the plaintext:\n%s", filepath.Base(path), data)
+		}
+	}
+	onDisk, err := os.ReadFile(record.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(onDisk, []byte("exfiltrated")) {
+		t.Error("output stored in plaintext")
+	}
+	if record.StoredSHA256 != calculateSHA256(string(onDisk)) || record.StoredSize != int64(len(onDisk)) {
+		t.Errorf("stored hash %s (%d bytes) does not match the file", record.StoredSHA256, record.StoredSize)
+	}
+
+	// Verify needs no key
+	report, err := outputStore.Verify("", readAudit(t, auditPath), time.Now())
+	if err != nil || report.Failed != 0 {
+		t.Fatalf("Verify: %v, %+v", err, report)
+	}
+	if !report.Files[0].Audited {
+		t.Error("encrypted output not matched to the audit log")
+	}
+
+	unsealed, err := outputStore.Unseal(record, key)
+	if err != nil {
+		t.Fatalf("Unseal: %v", err)
+	}
+	if unsealed.SHA256 != plaintextSHA256 || unsealed.Size != int64(len(plaintext)) || unsealed.OriginalName != "file.txt" {
+		t.Errorf("unsealed record: %+v", unsealed)
+	}
+
+	var opened bytes.Buffer
+	if err := outputStore.Open(record, key, &opened); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !bytes.Equal(opened.Bytes(), plaintext) {
+		t.Error("opened output differs from the plaintext")
+	}
+
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if err := outputStore.Open(record, other, &bytes.Buffer{}); err == nil {
+		t.Error("opened with another key")
+	}
+	onDisk[len(onDisk)-1] ^= 1
+	os.WriteFile(record.Path, onDisk, 0600)
+	if err := outputStore.Open(record, key, &bytes.Buffer{}); err == nil {
+		t.Error("opened a tampered output")
+	}
+}
+
+func TestJournalKeepsFilenameSealed(t *testing.T) {
+	resetState(t, DefaultLimits())
+	auditPath := withAuditLog(t)
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetOutputPublicKey(key.PublicKey())
+
+	payload := encryptForTest(t, testTransferID, []byte("resumed"), "test-key")
+	sendTransfer(t, testTransferID, payload, 64)
+	meta, err := os.ReadFile(filepath.Join(journal.transferDir(testTransferID), "meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(meta, []byte("file.txt")) || !bytes.Contains(meta, []byte("sealed_filename")) {
+		t.Errorf("journal does not keep the name sealed:\n%s", meta)
+	}
+
+	// After a restart the name is only known sealed, and still reaches the
+	// output's sealed record
+	simulateRestart(t)
+	expectCode(t, doRequest(fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256(payload))),
+		http.StatusOK, CodeTransferCompleted)
+	CleanupTransfer(testTransferID)
+	stored, err := outputStore.List()
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("List: %d outputs, %v", len(stored), err)
+	}
+	unsealed, err := outputStore.Unseal(stored[0], key)
+	if err != nil {
+		t.Fatalf("Unseal: %v", err)
+	}
+	if unsealed.OriginalName != "file.txt" || unsealed.Size != int64(len("resumed")) {
+		t.Errorf("unsealed record: %+v", unsealed)
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("file.txt")) {
+		t.Errorf("audit log names the plaintext:\n%s", data)
+	}
+}
+
+func TestRunOpenCommand(t *testing.T) {
+	resetState(t, DefaultLimits())
+	dir := t.TempDir()
+	name := filepath.Join(dir, "operator")
+	if err := RunOpenCommand([]string{"keygen", "-out", name}); err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	if err := RunOpenCommand([]string{"keygen", "-out", name}); err == nil {
+		t.Error("keygen overwrote an existing key")
+	}
+	public, _ := os.ReadFile(name + ".pub")
+	key, err := ParseOutputPublicKey(string(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetOutputPublicKey(key)
+	completeTransfer(t, testTransferID, []byte("custody"))
+
+	to := filepath.Join(dir, "opened")
+	args := []string{"-key", name + ".key", "-output", outputStore.root, "-to", to}
+	if err := RunOpenCommand(append(args, testTransferID)); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(to, testTransferID, "file.txt"))
+	if err != nil || string(data) != "custody" {
+		t.Errorf("opened %q, %v", data, err)
+	}
+	if err := RunOpenCommand(append(args, testTransferID)); err == nil {
+		t.Error("open overwrote an opened file")
+	}
+	if err := RunOpenCommand(append(args, "0000000000000000000000000000000000000000000000000000000000000000")); err == nil {
+		t.Error("open of an unknown transfer succeeded")
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"protocol"
+)
+
+// AuditLogName is the audit log's file name below the output root
+const AuditLogName = "audit.jsonl"
+
+// AuditEvent names what an audit record describes
+type AuditEvent string
+
+// Audit events
+const (
+	AuditInit     AuditEvent = "init"
+	AuditChunk    AuditEvent = "chunk"
+	AuditComplete AuditEvent = "complete"
+	AuditReject   AuditEvent = "reject"
+	AuditCleanup  AuditEvent = "cleanup"
+	AuditShutdown AuditEvent = "shutdown"
+)
+
+// AuditRecord is one line of the audit log. It describes a request or a
+// transfer by its metadata, sizes and hashes only; transfer contents are
+// never recorded.
+type AuditRecord struct {
+	Time       time.Time     `json:"time"`
+	Event      AuditEvent    `json:"event"`
+	TransferID string        `json:"transfer_id,omitempty"`
+	Engagement string        `json:"engagement,omitempty"`
+	Source     string        `json:"source,omitempty"`
+	State      TransferState `json:"state,omitempty"`
+
+	// init
+	Filename    string `json:"filename,omitempty"`
+	TotalChunks int    `json:"total_chunks,omitempty"`
+	Bytes       int64  `json:"bytes,omitempty"` // encrypted size declared at init
+	KeyID       string `json:"key_id,omitempty"`
+
+	// chunk
+	ChunkIndex  *int   `json:"chunk_index,omitempty"`
+	ChunkBytes  int    `json:"chunk_bytes,omitempty"`
+	ChunkSHA256 string `json:"chunk_sha256,omitempty"`
+	Received    int    `json:"received,omitempty"`
+
+	// complete
+	Checksum     string `json:"checksum,omitempty"`      // SHA-256 of the hex ciphertext
+	StoredSHA256 string `json:"stored_sha256,omitempty"` // of the file as stored, encrypted or not
+	StoredSize   int64  `json:"stored_size,omitempty"`
+	Canary       bool   `json:"canary,omitempty"`
+
+	// reject, cleanup and shutdown
+	Action      string     `json:"action,omitempty"`
+	Status      int        `json:"status,omitempty"`
+	Code        string     `json:"code,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	Initialised *time.Time `json:"initialised,omitempty"`
+	// Count is the number of rejections a throttled reject record stands
+	// for; zero means one
+	Count int `json:"count,omitempty"`
+}
+
+// AuditLog appends records to a JSON-lines file. Each record is written with
+// a single append so concurrent records never interleave.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// auditLog is where records go; nil disables auditing
+var auditLog *AuditLog
+
+// OpenAuditLog opens path for appending, creating it if needed
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	return &AuditLog{file: f}, nil
+}
+
+// SetAuditLog sets the audit log records are written to
+func SetAuditLog(a *AuditLog) {
+	auditLog = a
+}
+
+// Record appends one record
+func (a *AuditLog) Record(rec AuditRecord) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error encoding audit record: %v", err)
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+	if _, err := a.file.Write(line); err != nil {
+		return fmt.Errorf("error writing audit log: %v", err)
+	}
+	return nil
+}
+
+// Close flushes the audit log to disk and closes it
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Sync()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.file = nil
+	return err
+}
+
+// audit writes a record to the configured audit log. Failures are logged;
+// they never fail the request being audited.
+func audit(rec AuditRecord) {
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.Record(rec); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// auditReject records a rejected request
+func auditReject(r *http.Request, transferID string, e *RequestError) {
+	audit(AuditRecord{
+		Event:      AuditReject,
+		TransferID: transferID,
+		Source:     r.RemoteAddr,
+		State:      e.State,
+		Action:     requestAction(r),
+		Status:     e.Status,
+		Code:       e.Code,
+		Reason:     e.Message,
+	})
+}
+
+// auditCleanup records a transfer being dropped. The caller must hold
+// transfer.mu.
+func auditCleanup(transfer *FileTransfer, previous TransferState, reason string) {
+	created := transfer.Created
+	audit(AuditRecord{
+		Event:       AuditCleanup,
+		TransferID:  transfer.ID,
+		Engagement:  transfer.Engagement,
+		Source:      transfer.Source,
+		State:       previous,
+		Filename:    recordedName(transfer.Filename),
+		TotalChunks: transfer.TotalChunks,
+		Bytes:       int64(transfer.FileSize / 2),
+		Received:    len(transfer.Chunks),
+		Reason:      reason,
+		Initialised: &created,
+	})
+}
+
+// requestAction returns the action named by a request path, if any
+func requestAction(r *http.Request) string {
+	action, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch protocol.Action(action) {
+	case protocol.ActionInit, protocol.ActionChunk, protocol.ActionComplete:
+		return action
+	}
+	return ""
+}
+
+// ReadAuditLog reads every record from an audit log. A truncated last line,
+// as left by a crash mid-write, is ignored.
+func ReadAuditLog(r io.Reader) ([]AuditRecord, error) {
+	var records []AuditRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var pending error
+	for line := 1; scanner.Scan(); line++ {
+		if pending != nil {
+			return nil, pending
+		}
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			pending = fmt.Errorf("invalid audit record on line %d: %v", line, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit log: %v", err)
+	}
+	return records, nil
+}
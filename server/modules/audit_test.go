@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withAuditLog installs an audit log in a temporary file and returns its path
+func withAuditLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), AuditLogName)
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetAuditLog(a)
+	t.Cleanup(func() {
+		SetAuditLog(nil)
+		a.Close()
+	})
+	return path
+}
+
+// readAudit returns the records written so far
+func readAudit(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := ReadAuditLog(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAuditRecordsTransfer(t *testing.T) {
+	resetState(t, DefaultLimits())
+	path := withAuditLog(t)
+
+	data := encryptForTest(t, testTransferID, []byte("audited payload"), "test-key")
+	chunks := []string{data[:20], data[20:]}
+	doRequest(fmt.Sprintf("init/%s/2/%d/test-engagement/report.pdf", testTransferID, len(data)))
+	doRequest(chunkPath(testTransferID, 0, chunks[0]))
+	doRequest(fmt.Sprintf("chunk/%s/1/%s/%s", testTransferID, calculateSHA256("other"), chunks[1]))
+	doRequest(chunkPath(testTransferID, 1, chunks[1]))
+	doRequest(fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256(data)))
+
+	records := readAudit(t, path)
+	var events []string
+	for _, rec := range records {
+		events = append(events, string(rec.Event))
+		if rec.Source != "192.0.2.1:1234" || rec.TransferID != testTransferID || rec.Time.IsZero() {
+			t.Errorf("record %+v lacks its source, transfer or time", rec)
+		}
+	}
+	if got := strings.Join(events, ","); got != "init,chunk,reject,chunk,complete" {
+		t.Fatalf("events = %s", got)
+	}
+
+	init, chunk, reject, complete := records[0], records[1], records[2], records[4]
+	if init.Filename != "report.pdf" || init.TotalChunks != 2 || init.Bytes != int64(len(data)/2) ||
+		init.Engagement != "test-engagement" {
+		t.Errorf("init record %+v", init)
+	}
+	if chunk.ChunkIndex == nil || *chunk.ChunkIndex != 0 || chunk.ChunkBytes != 10 ||
+		chunk.ChunkSHA256 != calculateSHA256(chunks[0]) {
+		t.Errorf("chunk record %+v", chunk)
+	}
+	if reject.Code != ErrCodeChecksumMismatch || reject.Action != "chunk" || reject.Status != http.StatusBadRequest {
+		t.Errorf("reject record %+v", reject)
+	}
+	if complete.Checksum != calculateSHA256(data) || complete.StoredSize != int64(len("audited payload")) ||
+		complete.StoredSHA256 == "" || complete.State != StateCompleted {
+		t.Errorf("complete record %+v", complete)
+	}
+
+	// Sizes and hashes only: neither the ciphertext nor the plaintext is logged
+	raw, _ := os.ReadFile(path)
+	for _, content := range []string{chunks[0], chunks[1], "audited payload"} {
+		if bytes.Contains(raw, []byte(content)) {
+			t.Errorf("audit log contains transfer content %q", content)
+		}
+	}
+}
+
+func TestAuditRecordsRejectionsAndCleanup(t *testing.T) {
+	resetState(t, DefaultLimits())
+	path := withAuditLog(t)
+
+	doRawRequest("chunk/v3/not-a-transfer")
+	doRequest(fmt.Sprintf("init/%s/2/100/other-engagement/a.txt", testTransferID))
+	doRequest(fmt.Sprintf("init/%s/2/100/test-engagement/a.txt", testTransferID))
+	CleanupTransfer(testTransferID)
+
+	records := readAudit(t, path)
+	if len(records) != 4 {
+		t.Fatalf("got %d records: %+v", len(records), records)
+	}
+	if r := records[0]; r.Event != AuditReject || r.Action != "chunk" || r.Status != http.StatusBadRequest || r.Code == "" {
+		t.Errorf("malformed request record %+v", r)
+	}
+	if r := records[1]; r.Event != AuditReject || r.Code != ErrCodeUnknownEngagement || r.Action != "init" {
+		t.Errorf("engagement rejection record %+v", r)
+	}
+	if r := records[3]; r.Event != AuditCleanup || r.State != StateInitialised || r.Initialised == nil || r.Reason != "removed" {
+		t.Errorf("cleanup record %+v", r)
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	start := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	index := func(i int) *int { return &i }
+	idA, idB, idC := fmt.Sprintf("%064x", 1), fmt.Sprintf("%064x", 2), fmt.Sprintf("%064x", 3)
+
+	records := []AuditRecord{
+		{Time: at(0), Event: AuditInit, TransferID: idA, Engagement: "acme", Source: "10.0.0.1:5000", Filename: "a.txt", TotalChunks: 2, Bytes: 30},
+		{Time: at(1), Event: AuditChunk, TransferID: idA, Source: "10.0.0.1:5001", ChunkIndex: index(0), ChunkBytes: 20},
+		{Time: at(2), Event: AuditChunk, TransferID: idA, Source: "10.0.0.2:5002", ChunkIndex: index(1), ChunkBytes: 10},
+		{Time: at(2), Event: AuditChunk, TransferID: idA, Source: "10.0.0.2:5002", ChunkIndex: index(1), ChunkBytes: 10},
+		{Time: at(3), Event: AuditComplete, TransferID: idA, Source: "10.0.0.1:5003", StoredSHA256: "ab", StoredSize: 7},
+		{Time: at(4), Event: AuditInit, TransferID: idB, Engagement: "acme", Source: "10.0.0.1:5004", TotalChunks: 3, Bytes: 90},
+		{Time: at(5), Event: AuditChunk, TransferID: idB, Source: "10.0.0.1:5005", ChunkIndex: index(0), ChunkBytes: 30},
+		{Time: at(6), Event: AuditReject, TransferID: idB, Source: "10.0.0.3:5006", Code: ErrCodeChecksumMismatch},
+		{Time: at(40), Event: AuditCleanup, TransferID: idB, State: StateReceiving, Reason: "expired"},
+		{Time: at(41), Event: AuditInit, TransferID: idC, Engagement: "other", Source: "10.9.9.9:1", TotalChunks: 1, Bytes: 5},
+		{Time: at(42), Event: AuditReject, Source: "10.0.0.4:5007", Code: ErrCodeUnauthenticated},
+	}
+
+	report := BuildReport(records, "acme", at(60))
+	if len(report.Transfers) != 2 || report.Completed != 1 || report.Expired != 1 || report.StoredBytes != 7 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	a, b := report.Transfers[0], report.Transfers[1]
+	if a.Outcome != StateCompleted || a.ChunksReceived != 2 || a.ChunkRequests != 3 || a.ReceivedBytes != 30 ||
+		strings.Join(a.Sources, ",") != "10.0.0.1,10.0.0.2" {
+		t.Errorf("transfer A %+v", a)
+	}
+	if b.Outcome != StateExpired || b.Rejections != 1 || b.Finished == nil || !b.Finished.Equal(at(40)) {
+		t.Errorf("transfer B %+v", b)
+	}
+	if strings.Join(report.Sources, ",") != "10.0.0.1,10.0.0.2,10.0.0.3,10.0.0.4" {
+		t.Errorf("sources %v: the other engagement leaked in", report.Sources)
+	}
+	if len(report.Rejections) != 2 || !report.LastEvent.Equal(at(42)) {
+		t.Errorf("rejections %+v, last event %s", report.Rejections, report.LastEvent)
+	}
+
+	var md bytes.Buffer
+	if err := report.WriteMarkdown(&md); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Exfiltration test report: acme", "| Completed | 1 (7 bytes stored) |", "| checksum_mismatch | 1 | 10.0.0.3 |"} {
+		if !strings.Contains(md.String(), want) {
+			t.Errorf("Markdown report lacks %q:\n%s", want, md.String())
+		}
+	}
+
+	var js bytes.Buffer
+	if err := report.WriteJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	var decoded EngagementReport
+	if err := json.Unmarshal(js.Bytes(), &decoded); err != nil || len(decoded.Transfers) != 2 {
+		t.Errorf("JSON report does not round-trip: %v", err)
+	}
+}
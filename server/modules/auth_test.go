@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"protocol"
+)
+
+func TestUnauthenticatedRequestsRejected(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	initPath := fmt.Sprintf("init/%s/2/100/test-engagement/a.txt", testTransferID)
+	genuine := signWith("test-key", initPath)
+	unsigned := versioned(initPath)
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"MAC under wrong key", signWith("wrong-key", initPath)},
+		{"non-hex MAC", unsigned + "/not-a-mac"},
+		{"MAC for another transfer", unsigned + "/" + genuine[strings.LastIndex(genuine, "/")+1:] + "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectCode(t, doRawRequest(tt.path), http.StatusUnauthorized, ErrCodeUnauthenticated)
+		})
+	}
+
+	// An init path without a MAC does not decode at all
+	expectCode(t, doRawRequest(unsigned), http.StatusBadRequest, ErrCodeInvalidRequest)
+
+	transfersMutex.RLock()
+	count := len(transfers)
+	transfersMutex.RUnlock()
+	if count != 0 {
+		t.Errorf("unauthenticated init created %d transfers", count)
+	}
+}
+
+func TestForgedChunkDoesNotTouchTransfer(t *testing.T) {
+	resetState(t, DefaultLimits())
+	doRequest(fmt.Sprintf("init/%s/2/100/test-engagement/a.txt", testTransferID))
+
+	path := chunkPath(testTransferID, 0, "abcd")
+	expectCode(t, doRawRequest(signWith("wrong-key", path)), http.StatusUnauthorized, ErrCodeUnauthenticated)
+
+	// A modified body invalidates an otherwise genuine MAC
+	genuine := signWith("test-key", path)
+	mac := genuine[strings.LastIndex(genuine, "/")+1:]
+	tampered := versioned(chunkPath(testTransferID, 0, "abce"))
+	expectCode(t, doRawRequest(tampered+"/"+mac), http.StatusUnauthorized, ErrCodeUnauthenticated)
+
+	transfersMutex.RLock()
+	received := len(transfers[testTransferID].Chunks)
+	transfersMutex.RUnlock()
+	if received != 0 {
+		t.Errorf("forged chunk was stored")
+	}
+}
+
+func TestUnsupportedVersionRejected(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	next := protocol.Version + 1
+	path := fmt.Sprintf("init/v%d/%s/2/100/test-engagement/a.txt/%s", next, testTransferID, strings.Repeat("0", 64))
+	resp := expectCode(t, doRawRequest(path), http.StatusBadRequest, ErrCodeUnsupportedVersion)
+	if !strings.Contains(resp.Message, fmt.Sprintf("version %d", next)) {
+		t.Errorf("message %q does not name the rejected version", resp.Message)
+	}
+
+	// Paths from before versioning are rejected the same way
+	expectCode(t, doRawRequest(fmt.Sprintf("init/%s/2/100/test-engagement/a.txt", testTransferID)),
+		http.StatusBadRequest, ErrCodeUnsupportedVersion)
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"protocol"
+)
+
+// CodeCanaryVerified answers a completed canary transfer
+const CodeCanaryVerified = "canary_verified"
+
+// ErrCodeCanaryInvalid is returned when a canary does not verify
+const ErrCodeCanaryInvalid = "canary_invalid"
+
+// errCanaryInvalid marks a canary whose header or pattern is wrong
+var errCanaryInvalid = errors.New("canary verification failed")
+
+// CanaryProof records that a canary travelled the path to the receiver.
+// Only the header and hashes are kept, never the contents.
+type CanaryProof struct {
+	TransferID   string    `json:"transfer_id"`
+	EngagementID string    `json:"engagement_id"`
+	Nonce        string    `json:"nonce"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	Source       string    `json:"source"`
+	Initialised  time.Time `json:"initialised"`
+	VerifiedAt   time.Time `json:"verified_at"`
+}
+
+// payloadSink receives decrypted plaintext. It holds back the start of the
+// payload until it can tell whether it is a canary: ordinary payloads are
+// passed on to out, canaries are verified as they stream past and never
+// written anywhere.
+type payloadSink struct {
+	out        io.Writer
+	engagement string
+	head       []byte
+	decided    bool
+	canary     *protocol.CanaryVerifier
+}
+
+// Write implements io.Writer
+func (s *payloadSink) Write(p []byte) (int, error) {
+	if s.decided {
+		if err := s.forward(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	s.head = append(s.head, p...)
+	if err := s.decide(false); err != nil {
+		return 0, err
+	}
+	if s.decided {
+		head := s.head
+		s.head = nil
+		if err := s.forward(head); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide looks at the held back bytes. At the end of the payload whatever
+// has been held back must be settled.
+func (s *payloadSink) decide(final bool) error {
+	magic := []byte(protocol.CanaryMagic)
+	if !bytes.HasPrefix(s.head, magic) {
+		// Still a possible canary until more than a partial magic is seen
+		if !final && len(s.head) < len(magic) && bytes.HasPrefix(magic, s.head) {
+			return nil
+		}
+		s.decided = true
+		return nil
+	}
+
+	end := bytes.IndexByte(s.head, '\n')
+	if end < 0 {
+		if len(s.head) >= protocol.MaxCanaryHeaderLength || final {
+			return fmt.Errorf("%w: header line too long", errCanaryInvalid)
+		}
+		return nil
+	}
+
+	header, err := protocol.ParseCanaryHeader(string(s.head[:end+1]))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCanaryInvalid, err)
+	}
+	if header.EngagementID != s.engagement {
+		return fmt.Errorf("%w: canary is for engagement %s", errCanaryInvalid, header.EngagementID)
+	}
+	s.canary = protocol.NewCanaryVerifier(header)
+	s.head = s.head[end+1:]
+	s.decided = true
+	return nil
+}
+
+// forward sends plaintext on to the verifier or the output
+func (s *payloadSink) forward(p []byte) error {
+	if s.canary != nil {
+		if _, err := s.canary.Write(p); err != nil {
+			return fmt.Errorf("%w: %v", errCanaryInvalid, err)
+		}
+		return nil
+	}
+	_, err := s.out.Write(p)
+	return err
+}
+
+// Close settles anything still held back and finishes canary verification
+func (s *payloadSink) Close() error {
+	if !s.decided {
+		if err := s.decide(true); err != nil {
+			return err
+		}
+	}
+	if len(s.head) > 0 {
+		head := s.head
+		s.head = nil
+		if err := s.forward(head); err != nil {
+			return err
+		}
+	}
+	if s.canary != nil {
+		if err := s.canary.Finish(); err != nil {
+			return fmt.Errorf("%w: %v", errCanaryInvalid, err)
+		}
+	}
+	return nil
+}
+
+// IsCanary reports whether the payload turned out to be a canary
+func (s *payloadSink) IsCanary() bool {
+	return s.canary != nil
+}
+
+// canariesDir is where canary proofs are recorded
+func (s *OutputStore) canariesDir() string {
+	return filepath.Join(s.root, "canaries")
+}
+
+// RecordCanary writes the proof-of-path record for a verified canary
+func (s *OutputStore) RecordCanary(proof *CanaryProof) (string, error) {
+	if !protocol.IsValidTransferID(proof.TransferID) {
+		return "", fmt.Errorf("invalid transfer ID: %q", proof.TransferID)
+	}
+	if err := os.MkdirAll(s.canariesDir(), 0700); err != nil {
+		return "", fmt.Errorf("error creating canaries directory: %v", err)
+	}
+	data, err := json.MarshalIndent(proof, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error encoding canary proof: %v", err)
+	}
+	path := filepath.Join(s.canariesDir(), proof.TransferID+".json")
+	if err := writeExclusive(path, data); err != nil {
+		return "", err
+	}
+	return path, nil
+}
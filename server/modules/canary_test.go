@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"protocol"
+)
+
+// testCanary returns a canary of the given size for the test engagement
+func testCanary(t *testing.T, size int64) []byte {
+	t.Helper()
+	h, err := protocol.NewCanaryHeader("test-engagement", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := protocol.WriteCanary(&buf, h); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sinkPayload writes payload to a payloadSink in pieces of the given size
+func sinkPayload(payload []byte, piece int) (*payloadSink, []byte, error) {
+	var out bytes.Buffer
+	sink := &payloadSink{out: &out, engagement: "test-engagement"}
+	for i := 0; i < len(payload); i += piece {
+		end := min(i+piece, len(payload))
+		if _, err := sink.Write(payload[i:end]); err != nil {
+			return sink, out.Bytes(), err
+		}
+	}
+	err := sink.Close()
+	return sink, out.Bytes(), err
+}
+
+func TestPayloadSink(t *testing.T) {
+	canary := testCanary(t, 5000)
+	corrupt := append([]byte{}, canary...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		payload []byte
+		canary  bool
+		invalid bool
+	}{
+		{"ordinary", []byte("just a file\n"), false, false},
+		{"empty", nil, false, false},
+		{"partial magic", []byte("SSRFLEAK"), false, false},
+		{"canary", canary, true, false},
+		{"corrupt canary", corrupt, true, true},
+		{"truncated canary", canary[:len(canary)-1], true, true},
+	}
+	for _, tt := range tests {
+		for _, piece := range []int{1, 7, 64 * 1024} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, piece), func(t *testing.T) {
+				sink, out, err := sinkPayload(tt.payload, piece)
+				if tt.invalid {
+					if !errors.Is(err, errCanaryInvalid) {
+						t.Errorf("error = %v, want canary failure", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sink.IsCanary() != tt.canary {
+					t.Errorf("IsCanary = %v, want %v", sink.IsCanary(), tt.canary)
+				}
+				if tt.canary && len(out) != 0 {
+					t.Errorf("canary wrote %d bytes to the output", len(out))
+				}
+				if !tt.canary && !bytes.Equal(out, tt.payload) {
+					t.Errorf("output %q, want %q", out, tt.payload)
+				}
+			})
+		}
+	}
+}
+
+func TestCanaryTransferRecordsProof(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	canary := testCanary(t, 100_000)
+	data := encryptForTest(t, testTransferID, canary, "test-key")
+	sendTransfer(t, testTransferID, data, 1500)
+
+	rec := doRequest(fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256(data)))
+	expectCode(t, rec, http.StatusOK, CodeCanaryVerified)
+
+	// Nothing of the canary is stored
+	if entries, _ := os.ReadDir(outputStore.filesDir()); len(entries) != 0 {
+		t.Errorf("canary left %d entries in the output store", len(entries))
+	}
+
+	raw, err := os.ReadFile(filepath.Join(outputStore.canariesDir(), testTransferID+".json"))
+	if err != nil {
+		t.Fatalf("canary proof: %v", err)
+	}
+	var proof CanaryProof
+	if err := json.Unmarshal(raw, &proof); err != nil {
+		t.Fatal(err)
+	}
+	if proof.EngagementID != "test-engagement" || proof.Size != int64(len(canary)) ||
+		proof.SHA256 != calculateSHA256(string(canary)) || proof.Source == "" {
+		t.Errorf("unexpected proof %+v", proof)
+	}
+}
+
+func TestCanaryForOtherEngagementRejected(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	h, _ := protocol.NewCanaryHeader("other-engagement", 1000)
+	var buf bytes.Buffer
+	protocol.WriteCanary(&buf, h)
+	data := encryptForTest(t, testTransferID, buf.Bytes(), "test-key")
+	sendTransfer(t, testTransferID, data, 1500)
+
+	rec := doRequest(fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256(data)))
+	resp := expectCode(t, rec, http.StatusBadRequest, ErrCodeCanaryInvalid)
+	if resp.State != StateFailed {
+		t.Errorf("state = %s, want %s", resp.State, StateFailed)
+	}
+}
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"protocol"
+)
+
+// Duration is a time.Duration that reads as "30m"-style strings from JSON
+type Duration time.Duration
+
+// UnmarshalJSON parses a Go duration string such as "5m" or "1h30m"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config holds the server settings gathered from defaults, an optional
+// config file, environment variables and command line flags (in that order
+// of precedence, lowest first)
+type Config struct {
+	ListenAddr        string          `json:"listen_addr"`
+	MetricsAddr       string          `json:"metrics_addr"`
+	OutputDir         string          `json:"output_dir"`
+	KeyFile           string          `json:"key_file"`
+	KeyEnv            string          `json:"key_env"`
+	KeyringFile       string          `json:"keyring_file"`
+	ManifestFile      string          `json:"manifest_file"`
+	ManifestKey       string          `json:"manifest_key"`
+	AuditLog          string          `json:"audit_log"`
+	TransferRetention Duration        `json:"transfer_retention"`
+	CleanupInterval   Duration        `json:"cleanup_interval"`
+	ShutdownTimeout   Duration        `json:"shutdown_timeout"`
+	Retention         RetentionPolicy `json:"retention"`
+	Limits            Limits          `json:"limits"`
+	Sources           SourcePolicy    `json:"sources"`
+	OutputPublicKey   string          `json:"output_public_key"`
+	TLS               TLSConfig       `json:"tls"`
+	Verbose           bool            `json:"verbose"`
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:        ":8080",
+		MetricsAddr:       "127.0.0.1:9464",
+		OutputDir:         "received_files",
+		KeyEnv:            "SSRFLEAK_KEY",
+		TransferRetention: Duration(30 * time.Minute),
+		CleanupInterval:   Duration(5 * time.Minute),
+		ShutdownTimeout:   Duration(30 * time.Second),
+		Retention:         DefaultRetentionPolicy(),
+		Limits:            DefaultLimits(),
+		Sources:           DefaultSourcePolicy(),
+	}
+}
+
+// LoadConfig builds the server configuration from the given command line arguments
+func LoadConfig(arguments []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("SSRFLEAK_CONFIG"), "Path to a JSON config file")
+	listenAddr := fs.String("listen", "", "Listen address (default \":8080\")")
+	metricsAddr := fs.String("metrics-addr", "", "Loopback address serving Prometheus /metrics, empty to disable (default \"127.0.0.1:9464\")")
+	outputDir := fs.String("output", "", "Output root directory (default \"received_files\")")
+	keyFile := fs.String("key-file", "", "Read the encryption key from this file")
+	keyEnv := fs.String("key-env", "", "Read the encryption key from this environment variable (default \"SSRFLEAK_KEY\")")
+	keyringFile := fs.String("keyring", "", "Read several \"<key ID> <key>\" lines from this file instead of a single key")
+	manifestFile := fs.String("manifest", "", "Signed engagement manifest")
+	manifestKey := fs.String("manifest-key", "", "Hex ed25519 public key the manifest is signed with")
+	auditLog := fs.String("audit-log", "", "Append audit records to this file (default <output>/audit.jsonl)")
+	retention := fs.Duration("transfer-retention", 0, "Drop incomplete transfers idle for longer than this (default 30m)")
+	cleanupInterval := fs.Duration("cleanup-interval", 0, "How often stale transfers are cleaned up (default 5m)")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "How long to wait for requests and verification in progress at shutdown (default 30s)")
+	maxOutputAge := fs.Duration("max-output-age", 0, "Delete received files older than this, 0 to keep them (default 720h)")
+	maxOutputBytes := fs.Int64("max-output-bytes", 0, "Delete the oldest received files beyond this total size, 0 for no limit (default 10 GiB)")
+	maxFileSize := fs.Int("max-file-size", 0, "Largest accepted transfer in bytes of hex data")
+	maxChunks := fs.Int("max-chunks", 0, "Largest accepted chunk count per transfer")
+	maxTransfers := fs.Int("max-transfers", 0, "Maximum number of concurrent transfers")
+	memoryBudget := fs.Int64("memory-budget", 0, "Maximum bytes of chunk data held in memory across all transfers")
+	allowSources := fs.String("allow-sources", "", "Comma-separated CIDRs or addresses requests are accepted from (default any)")
+	sourceRate := fs.Float64("source-rate", 0, "Requests per second accepted from each source, 0 for no limit (default 10)")
+	sourceBurst := fs.Int("source-burst", 0, "Requests a source may send in a burst (default 20)")
+	sourceConcurrency := fs.Int("source-concurrency", 0, "Requests each source may have in progress, 0 for no limit (default 4)")
+	outputPublicKey := fs.String("output-public-key", "", "Encrypt received files at rest to this hex X25519 public key (see \"open keygen\")")
+	tlsCert := fs.String("tls-cert", "", "Serve TLS with this PEM certificate file")
+	tlsKey := fs.String("tls-key", "", "Serve TLS with this PEM key file")
+	tlsSelfSigned := fs.Bool("tls-self-signed", false, "Serve TLS with a self-signed certificate kept in <output>/tls")
+	verbose := fs.Bool("v", false, "Enable verbose logging")
+
+	if err := fs.Parse(arguments); err != nil {
+		return cfg, err
+	}
+
+	// Config file
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse config file %s: %v", *configPath, err)
+		}
+	}
+
+	// Environment variables
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	// Flags that were explicitly given
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = *listenAddr
+		case "metrics-addr":
+			cfg.MetricsAddr = *metricsAddr
+		case "output":
+			cfg.OutputDir = *outputDir
+		case "key-file":
+			cfg.KeyFile = *keyFile
+		case "key-env":
+			cfg.KeyEnv = *keyEnv
+		case "keyring":
+			cfg.KeyringFile = *keyringFile
+		case "manifest":
+			cfg.ManifestFile = *manifestFile
+		case "manifest-key":
+			cfg.ManifestKey = *manifestKey
+		case "audit-log":
+			cfg.AuditLog = *auditLog
+		case "transfer-retention":
+			cfg.TransferRetention = Duration(*retention)
+		case "cleanup-interval":
+			cfg.CleanupInterval = Duration(*cleanupInterval)
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = Duration(*shutdownTimeout)
+		case "max-output-age":
+			cfg.Retention.MaxAge = Duration(*maxOutputAge)
+		case "max-output-bytes":
+			cfg.Retention.MaxTotalBytes = *maxOutputBytes
+		case "max-file-size":
+			cfg.Limits.MaxFileSize = *maxFileSize
+		case "max-chunks":
+			cfg.Limits.MaxChunks = *maxChunks
+		case "max-transfers":
+			cfg.Limits.MaxConcurrentTransfers = *maxTransfers
+		case "memory-budget":
+			cfg.Limits.MemoryBudget = *memoryBudget
+		case "allow-sources":
+			cfg.Sources.AllowedCIDRs = splitList(*allowSources)
+		case "source-rate":
+			cfg.Sources.RequestsPerSecond = *sourceRate
+		case "source-burst":
+			cfg.Sources.Burst = *sourceBurst
+		case "source-concurrency":
+			cfg.Sources.MaxConcurrent = *sourceConcurrency
+		case "output-public-key":
+			cfg.OutputPublicKey = *outputPublicKey
+		case "tls-cert":
+			cfg.TLS.CertFile = *tlsCert
+		case "tls-key":
+			cfg.TLS.KeyFile = *tlsKey
+		case "tls-self-signed":
+			cfg.TLS.SelfSigned = *tlsSelfSigned
+		case "v":
+			cfg.Verbose = *verbose
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+// applyEnv overrides settings from SSRFLEAK_* environment variables
+func applyEnv(cfg *Config) error {
+	if v := os.Getenv("SSRFLEAK_LISTEN"); v != "" {
+		cfg.ListenAddr = v
+	}
+	if v := os.Getenv("SSRFLEAK_METRICS_ADDR"); v != "" {
+		cfg.MetricsAddr = v
+	}
+	if v := os.Getenv("SSRFLEAK_OUTPUT_DIR"); v != "" {
+		cfg.OutputDir = v
+	}
+	if v := os.Getenv("SSRFLEAK_KEY_FILE"); v != "" {
+		cfg.KeyFile = v
+	}
+	if v := os.Getenv("SSRFLEAK_KEY_ENV"); v != "" {
+		cfg.KeyEnv = v
+	}
+	if v := os.Getenv("SSRFLEAK_KEYRING"); v != "" {
+		cfg.KeyringFile = v
+	}
+	if v := os.Getenv("SSRFLEAK_MANIFEST"); v != "" {
+		cfg.ManifestFile = v
+	}
+	if v := os.Getenv("SSRFLEAK_MANIFEST_KEY"); v != "" {
+		cfg.ManifestKey = v
+	}
+	if v := os.Getenv("SSRFLEAK_AUDIT_LOG"); v != "" {
+		cfg.AuditLog = v
+	}
+	if v := os.Getenv("SSRFLEAK_TRANSFER_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid SSRFLEAK_TRANSFER_RETENTION: %v", err)
+		}
+		cfg.TransferRetention = Duration(d)
+	}
+	if v := os.Getenv("SSRFLEAK_CLEANUP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid SSRFLEAK_CLEANUP_INTERVAL: %v", err)
+		}
+		cfg.CleanupInterval = Duration(d)
+	}
+	if v := os.Getenv("SSRFLEAK_SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid SSRFLEAK_SHUTDOWN_TIMEOUT: %v", err)
+		}
+		cfg.ShutdownTimeout = Duration(d)
+	}
+	if v := os.Getenv("SSRFLEAK_MAX_OUTPUT_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid SSRFLEAK_MAX_OUTPUT_AGE: %v", err)
+		}
+		cfg.Retention.MaxAge = Duration(d)
+	}
+	if v := os.Getenv("SSRFLEAK_MAX_OUTPUT_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SSRFLEAK_MAX_OUTPUT_BYTES: %v", err)
+		}
+		cfg.Retention.MaxTotalBytes = n
+	}
+	if v := os.Getenv("SSRFLEAK_ALLOW_SOURCES"); v != "" {
+		cfg.Sources.AllowedCIDRs = splitList(v)
+	}
+	if v := os.Getenv("SSRFLEAK_OUTPUT_PUBLIC_KEY"); v != "" {
+		cfg.OutputPublicKey = v
+	}
+	if v := os.Getenv("SSRFLEAK_TLS_CERT"); v != "" {
+		cfg.TLS.CertFile = v
+	}
+	if v := os.Getenv("SSRFLEAK_TLS_KEY"); v != "" {
+		cfg.TLS.KeyFile = v
+	}
+	if v := os.Getenv("SSRFLEAK_TLS_SELF_SIGNED"); v == "1" || v == "true" {
+		cfg.TLS.SelfSigned = true
+	}
+	if v := os.Getenv("SSRFLEAK_VERBOSE"); v == "1" || v == "true" {
+		cfg.Verbose = true
+	}
+	return nil
+}
+
+// splitList splits a comma-separated setting, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen address must not be empty")
+	}
+	if c.MetricsAddr != "" {
+		if err := CheckMetricsAddr(c.MetricsAddr); err != nil {
+			return err
+		}
+	}
+	if c.OutputDir == "" {
+		return fmt.Errorf("output directory must not be empty")
+	}
+	if c.KeyFile == "" && c.KeyEnv == "" && c.KeyringFile == "" {
+		return fmt.Errorf("no key source configured: set key_file, key_env or keyring_file")
+	}
+	if c.ManifestFile == "" || c.ManifestKey == "" {
+		return fmt.Errorf("no engagement manifest configured: set manifest_file and manifest_key")
+	}
+	if c.TransferRetention <= 0 {
+		return fmt.Errorf("transfer retention must be positive")
+	}
+	if c.CleanupInterval <= 0 {
+		return fmt.Errorf("cleanup interval must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive")
+	}
+	if err := c.Retention.Validate(); err != nil {
+		return err
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+	if err := c.Sources.Validate(); err != nil {
+		return err
+	}
+	if c.OutputPublicKey != "" {
+		if _, err := ParseOutputPublicKey(c.OutputPublicKey); err != nil {
+			return err
+		}
+	}
+	return c.Limits.Validate()
+}
+
+// readSecretFile reads a key or keyring file, warning if other users can
+// read it
+func readSecretFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning: key file %s is accessible by other users (mode %04o)",
+			path, info.Mode().Perm())
+	}
+	return os.ReadFile(path)
+}
+
+// LoadKeyring reads the keys requests are accepted under: the keyring file
+// if one is configured, otherwise the single key from LoadKey under
+// DefaultKeyID. Keys themselves are never logged.
+func (c Config) LoadKeyring() (*Keyring, error) {
+	if c.KeyringFile == "" {
+		key, err := c.LoadKey()
+		if err != nil {
+			return nil, err
+		}
+		keyring := NewKeyring()
+		return keyring, keyring.Add(DefaultKeyID, key)
+	}
+
+	data, err := readSecretFile(c.KeyringFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %v", err)
+	}
+	keyring, err := ParseKeyring(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %v", c.KeyringFile, err)
+	}
+	return keyring, nil
+}
+
+// LoadKey reads the encryption key from the configured key source.
+// The key itself is never logged.
+func (c Config) LoadKey() (string, error) {
+	if c.KeyFile != "" {
+		data, err := readSecretFile(c.KeyFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read key file: %v", err)
+		}
+		key := strings.TrimRight(string(data), "\r\n")
+		if key == "" {
+			return "", fmt.Errorf("key file %s is empty", c.KeyFile)
+		}
+		return key, nil
+	}
+
+	key := os.Getenv(c.KeyEnv)
+	if key == "" {
+		return "", fmt.Errorf("no encryption key supplied: environment variable %s is empty", c.KeyEnv)
+	}
+	return key, nil
+}
+
+// AuditLogPath returns the audit log file, by default inside the output root
+func (c Config) AuditLogPath() string {
+	if c.AuditLog != "" {
+		return c.AuditLog
+	}
+	return filepath.Join(c.OutputDir, AuditLogName)
+}
+
+// LoadManifest reads the engagement manifest and verifies its signature
+func (c Config) LoadManifest() (*protocol.Manifest, error) {
+	key, err := protocol.ParsePublicKey(c.ManifestKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest key: %v", err)
+	}
+	data, err := os.ReadFile(c.ManifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return protocol.LoadManifest(data, key)
+}
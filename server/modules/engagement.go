@@ -0,0 +1,239 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"protocol"
+)
+
+// Error codes for transfers outside the engagement
+const (
+	ErrCodeUnknownEngagement       = "unknown_engagement"
+	ErrCodeEngagementInactive      = "engagement_inactive"
+	ErrCodeEngagementBytesExceeded = "engagement_bytes_exceeded"
+)
+
+// engagement is the verified manifest transfers are accepted for
+var engagement *protocol.Manifest
+
+// SetManifest sets the engagement that transfers must belong to
+func SetManifest(m *protocol.Manifest) {
+	engagement = m
+	log.Printf("Accepting transfers for engagement %s (%s to %s, at most %d bytes)",
+		m.EngagementID, m.NotBefore.Format(time.RFC3339), m.NotAfter.Format(time.RFC3339), m.MaxTotalBytes)
+}
+
+// checkEngagement rejects requests that do not name the configured
+// engagement, arrive outside its window or after it was revoked
+func checkEngagement(engagementID string, now time.Time) *RequestError {
+	if engagement == nil || engagementID != engagement.EngagementID {
+		return newRequestError(http.StatusForbidden, ErrCodeUnknownEngagement,
+			"transfer does not belong to an authorised engagement")
+	}
+	if err := engagement.CheckWindow(now); err != nil {
+		return newRequestError(http.StatusForbidden, ErrCodeEngagementInactive, "%v", err)
+	}
+	return checkRevoked(engagementID)
+}
+
+// EngagementUsage records the bytes charged to an engagement over its
+// lifetime. It survives cleanup and restarts, so the manifest's byte limit
+// covers the whole engagement rather than the transfers still tracked.
+type EngagementUsage struct {
+	EngagementID string    `json:"engagement_id"`
+	Bytes        int64     `json:"bytes"`
+	Transfers    int       `json:"transfers"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// usageMutex serialises updates of the engagement usage records
+var usageMutex sync.Mutex
+
+// usagePath is where the usage of an engagement is recorded
+func (s *OutputStore) usagePath(engagementID string) string {
+	return filepath.Join(s.root, "engagements", engagementID+".json")
+}
+
+// loadUsage returns the recorded usage of an engagement, zero if none
+func loadUsage(engagementID string) (*EngagementUsage, error) {
+	usage := &EngagementUsage{EngagementID: engagementID}
+	data, err := os.ReadFile(outputStore.usagePath(engagementID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return usage, nil
+		}
+		return nil, fmt.Errorf("error reading engagement usage: %v", err)
+	}
+	if err := json.Unmarshal(data, usage); err != nil {
+		return nil, fmt.Errorf("invalid engagement usage record: %v", err)
+	}
+	return usage, nil
+}
+
+// saveUsage writes a usage record. The caller must hold usageMutex.
+func saveUsage(usage *EngagementUsage) error {
+	path := outputStore.usagePath(usage.EngagementID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating engagements directory: %v", err)
+	}
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding engagement usage: %v", err)
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// reserveEngagementBytes charges the encrypted size of a new transfer to
+// its engagement, rejecting it if that would go over the byte limit. Bytes
+// are charged when the transfer is initialised and only given back if the
+// receiver fails to record it, so failed and expired transfers count too.
+// A usage record that cannot be read or written rejects the transfer.
+func reserveEngagementBytes(engagementID string, fileSize int) *RequestError {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	usage, err := loadUsage(engagementID)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return newRequestError(http.StatusInternalServerError, ErrCodeJournalFailed,
+			"failed to read engagement usage")
+	}
+	if usage.Bytes+int64(fileSize/2) > engagement.MaxTotalBytes {
+		return newRequestError(http.StatusRequestEntityTooLarge, ErrCodeEngagementBytesExceeded,
+			"engagement %s allows at most %d bytes, %d already used", engagementID, engagement.MaxTotalBytes, usage.Bytes)
+	}
+
+	usage.Bytes += int64(fileSize / 2)
+	usage.Transfers++
+	usage.UpdatedAt = time.Now().UTC()
+	if err := saveUsage(usage); err != nil {
+		log.Printf("ERROR: Failed to record usage of engagement %s: %v", engagementID, err)
+		return newRequestError(http.StatusInternalServerError, ErrCodeJournalFailed,
+			"failed to record engagement usage")
+	}
+	return nil
+}
+
+// refundEngagementBytes gives back a reservation for a transfer the
+// receiver failed to record
+func refundEngagementBytes(engagementID string, fileSize int) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	usage, err := loadUsage(engagementID)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return
+	}
+	usage.Bytes = max(usage.Bytes-int64(fileSize/2), 0)
+	usage.Transfers = max(usage.Transfers-1, 0)
+	usage.UpdatedAt = time.Now().UTC()
+	if err := saveUsage(usage); err != nil {
+		log.Printf("ERROR: Failed to refund usage of engagement %s: %v", engagementID, err)
+	}
+}
+
+// RunManifestCommand implements the "manifest" subcommand:
+//
+//	manifest keygen -out <prefix>
+//	manifest sign -key <file> -id <engagement> -url <url> [-url <url>...]
+//	    -start <RFC3339> -end <RFC3339> -max-bytes <n> -out <file>
+func RunManifestCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: manifest keygen|sign [options]")
+	}
+	switch args[0] {
+	case "keygen":
+		return manifestKeygen(args[1:])
+	case "sign":
+		return manifestSign(args[1:])
+	default:
+		return fmt.Errorf("unknown manifest command %q", args[0])
+	}
+}
+
+// manifestKeygen writes a new ed25519 key pair as <prefix>.key and <prefix>.pub
+func manifestKeygen(args []string) error {
+	fs := flag.NewFlagSet("manifest keygen", flag.ContinueOnError)
+	out := fs.String("out", "manifest", "Write the key pair to <out>.key and <out>.pub")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+	if err := writeExclusive(*out+".key", []byte(hex.EncodeToString(private.Seed())+"\n")); err != nil {
+		return err
+	}
+	if err := writeExclusive(*out+".pub", []byte(hex.EncodeToString(public)+"\n")); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s.key (keep offline) and %s.pub\n", *out, *out)
+	return nil
+}
+
+// urlList collects a repeatable -url flag
+type urlList []string
+
+func (u *urlList) String() string     { return strings.Join(*u, ",") }
+func (u *urlList) Set(v string) error { *u = append(*u, v); return nil }
+
+// manifestSign signs a manifest built from the command line
+func manifestSign(args []string) error {
+	fs := flag.NewFlagSet("manifest sign", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "Private key file from manifest keygen")
+	id := fs.String("id", "", "Engagement ID")
+	var urls urlList
+	fs.Var(&urls, "url", "Allowed receiver base URL (repeatable)")
+	start := fs.String("start", "", "Start of the engagement window (RFC 3339)")
+	end := fs.String("end", "", "End of the engagement window (RFC 3339)")
+	maxBytes := fs.Int64("max-bytes", 0, "Maximum encrypted bytes transferred under the engagement")
+	out := fs.String("out", "", "Write the signed manifest to this file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" || *out == "" {
+		return fmt.Errorf("-key and -out are required")
+	}
+
+	keyData, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %v", err)
+	}
+	key, err := protocol.ParsePrivateKey(string(keyData))
+	if err != nil {
+		return err
+	}
+
+	m := protocol.Manifest{EngagementID: *id, AllowedURLs: urls, MaxTotalBytes: *maxBytes}
+	if m.NotBefore, err = time.Parse(time.RFC3339, *start); err != nil {
+		return fmt.Errorf("invalid -start: %v", err)
+	}
+	if m.NotAfter, err = time.Parse(time.RFC3339, *end); err != nil {
+		return fmt.Errorf("invalid -end: %v", err)
+	}
+
+	data, err := protocol.SignManifest(m, key)
+	if err != nil {
+		return err
+	}
+	if err := writeExclusive(*out, append(data, '\n')); err != nil {
+		return err
+	}
+	fmt.Printf("Signed manifest for engagement %s written to %s\n", m.EngagementID, *out)
+	return nil
+}
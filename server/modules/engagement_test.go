@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInitRequiresEngagement(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	rec := doRequest(fmt.Sprintf("init/%s/1/10/other-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusForbidden, ErrCodeUnknownEngagement)
+
+	// Without a manifest nothing is accepted
+	engagement = nil
+	rec = doRequest(fmt.Sprintf("init/%s/1/10/test-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusForbidden, ErrCodeUnknownEngagement)
+
+	transfersMutex.RLock()
+	count := len(transfers)
+	transfersMutex.RUnlock()
+	if count != 0 {
+		t.Errorf("rejected init created %d transfers", count)
+	}
+}
+
+func TestInitOutsideEngagementWindow(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	m := testManifest()
+	m.NotBefore = time.Now().Add(-2 * time.Hour)
+	m.NotAfter = time.Now().Add(-time.Hour)
+	SetManifest(m)
+
+	rec := doRequest(fmt.Sprintf("init/%s/1/10/test-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusForbidden, ErrCodeEngagementInactive)
+}
+
+func TestInitBeyondEngagementBytes(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	m := testManifest()
+	m.MaxTotalBytes = 100
+	SetManifest(m)
+
+	// 160 hex characters are 80 bytes; a second transfer would make 160
+	rec := doRequest(fmt.Sprintf("init/%064x/1/160/test-engagement/a.txt", 1))
+	expectCode(t, rec, http.StatusOK, CodeTransferInitialised)
+	rec = doRequest(fmt.Sprintf("init/%064x/1/160/test-engagement/b.txt", 2))
+	expectCode(t, rec, http.StatusRequestEntityTooLarge, ErrCodeEngagementBytesExceeded)
+	rec = doRequest(fmt.Sprintf("init/%064x/1/40/test-engagement/c.txt", 3))
+	expectCode(t, rec, http.StatusOK, CodeTransferInitialised)
+}
+
+func TestEngagementBytesSurviveCleanupAndRestart(t *testing.T) {
+	resetState(t, DefaultLimits())
+	SetTransferRetention(time.Minute)
+	defer SetTransferRetention(30 * time.Minute)
+
+	completeTransfer(t, testTransferID, []byte("already exfiltrated"))
+	usage, err := loadUsage("test-engagement")
+	if err != nil || usage.Bytes == 0 || usage.Transfers != 1 {
+		t.Fatalf("usage after one transfer: %+v, %v", usage, err)
+	}
+	m := testManifest()
+	m.MaxTotalBytes = usage.Bytes + 50
+	SetManifest(m)
+
+	// Nothing of the finished transfer is tracked any more
+	transfersMutex.Lock()
+	for _, transfer := range transfers {
+		transfer.LastUpdated = time.Now().Add(-2 * time.Minute)
+	}
+	transfersMutex.Unlock()
+	ScheduleCleanup()
+	simulateRestart(t)
+	transfersMutex.RLock()
+	tracked := len(transfers)
+	transfersMutex.RUnlock()
+	if tracked != 0 {
+		t.Fatalf("%d transfers still tracked", tracked)
+	}
+
+	rec := doRequest(fmt.Sprintf("init/%064x/1/160/test-engagement/b.txt", 2))
+	expectCode(t, rec, http.StatusRequestEntityTooLarge, ErrCodeEngagementBytesExceeded)
+	rec = doRequest(fmt.Sprintf("init/%064x/1/40/test-engagement/c.txt", 3))
+	expectCode(t, rec, http.StatusOK, CodeTransferInitialised)
+}
+
+func TestJournalFailureRefundsEngagementBytes(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	// A file where the journal directory belongs makes RecordInit fail
+	if err := os.WriteFile(filepath.Join(outputStore.root, "journal"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	rec := doRequest(fmt.Sprintf("init/%s/1/160/test-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusInternalServerError, ErrCodeJournalFailed)
+
+	usage, err := loadUsage("test-engagement")
+	if err != nil || usage.Bytes != 0 || usage.Transfers != 0 {
+		t.Errorf("usage after a failed init: %+v, %v", usage, err)
+	}
+}
@@ -1,15 +1,17 @@
 package server
 
 import (
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"protocol"
 )
 
 // Global verbose mode flag
@@ -21,13 +23,32 @@ type FileTransfer struct {
 	Filename    string
 	TotalChunks int
 	FileSize    int
-	Chunks      map[int]string // Map of chunk index to chunk data
+	Engagement  string
+	KeyID       string // keyring entry the transfer's requests are signed with
+	Source      string // remote address of the init request
 	Created     time.Time
-	LastUpdated time.Time
-	Checksum    string
+
+	// SealedFilename is Filename sealed to the output recipient, journaled
+	// in its place when outputs are encrypted at rest
+	SealedFilename string
+
+	// interrupted is set by a shutdown to stop the transfer's verification;
+	// chunkReader checks it before every read
+	interrupted atomic.Bool
+
+	// mu guards the fields below. Each transfer is locked on its own so a
+	// slow request never holds up other transfers.
+	mu     sync.Mutex
+	Chunks map[int]string // Map of chunk index to chunk data
+	// BufferedBytes is the total size of Chunks, counted against the memory budget
+	BufferedBytes int
+	State         TransferState
+	LastUpdated   time.Time
+	Checksum      string
 }
 
-// In-memory storage for file transfers
+// In-memory storage for file transfers. transfersMutex only guards the map
+// itself; when both locks are needed it is taken before a transfer's mu.
 var (
 	transfers      = make(map[string]*FileTransfer)
 	transfersMutex sync.RWMutex
@@ -48,139 +69,267 @@ func IsVerboseMode() bool {
 
 // HandleRequest processes incoming GET requests for file transfer
 func HandleRequest(w http.ResponseWriter, r *http.Request) {
-	// Parse path components
-	path := strings.Trim(r.URL.Path, "/")
-	components := strings.Split(path, "/")
+	// Refuse sources outside the allowlist or over their limits
+	now := time.Now()
+	release, reqErr := admitSource(r, now)
+	if reqErr != nil {
+		if reqErr.Status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		auditSourceReject(r, reqErr, now)
+		respondError(w, "", reqErr)
+		return
+	}
+	defer release()
+
+	// Status queries are not transfer messages
+	if protocol.IsStatusPath(r.URL.Path) {
+		handleStatusRequest(w, r)
+		return
+	}
 
-	if len(components) < 2 {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
+	// Decode the message carried in the path
+	req, err := protocol.ParsePath(r.URL.Path)
+	if err != nil {
+		writeError(w, r, "", decodeError(err))
+		return
+	}
+	transferID := req.Message.ID()
+
+	// Reject unauthenticated requests before any transfer state is touched
+	keyID, ok := keyring.Match(req.Verify)
+	if !ok {
+		writeError(w, r, transferID, newRequestError(http.StatusUnauthorized, ErrCodeUnauthenticated,
+			"request is not authenticated"))
 		return
 	}
 
 	// Determine request type
-	action := components[0]
-
-	switch action {
-	case "init":
-		handleInitRequest(w, r, components)
-	case "chunk":
-		handleChunkRequest(w, r, components)
-	case "complete":
-		handleCompleteRequest(w, r, components)
-	default:
-		http.Error(w, "Unknown action", http.StatusBadRequest)
+	switch msg := req.Message.(type) {
+	case protocol.Init:
+		handleInitRequest(w, r, msg, keyID)
+	case protocol.Chunk:
+		handleChunkRequest(w, r, msg, keyID)
+	case protocol.Complete:
+		handleCompleteRequest(w, r, msg, keyID)
 	}
 }
 
 // handleInitRequest processes initialization requests
-func handleInitRequest(w http.ResponseWriter, r *http.Request, components []string) {
-	// Expected format: init/transferID/totalChunks/fileSize/filename
-	if len(components) != 5 {
-		http.Error(w, "Invalid init request format", http.StatusBadRequest)
+func handleInitRequest(w http.ResponseWriter, r *http.Request, msg protocol.Init, keyID string) {
+	transferID := msg.TransferID
+	totalChunks := msg.TotalChunks
+	fileSize := msg.FileSize
+	filename := msg.Filename
+
+	if reqErr := checkInitLimits(totalChunks, fileSize); reqErr != nil {
+		writeError(w, r, transferID, reqErr)
 		return
 	}
-
-	transferID := components[1]
-	totalChunks, err := strconv.Atoi(components[2])
-	if err != nil {
-		http.Error(w, "Invalid total chunks", http.StatusBadRequest)
+	if reqErr := checkEngagement(msg.EngagementID, time.Now()); reqErr != nil {
+		writeError(w, r, transferID, reqErr)
 		return
 	}
 
-	fileSize, err := strconv.Atoi(components[3])
+	sealedFilename, err := sealFilename(filename)
 	if err != nil {
-		http.Error(w, "Invalid file size", http.StatusBadRequest)
+		log.Printf("ERROR: Failed to seal filename of transfer %s: %v", transferID, err)
+		writeError(w, r, transferID, newRequestError(http.StatusInternalServerError, ErrCodeJournalFailed,
+			"failed to record transfer"))
 		return
 	}
 
-	filename := components[4]
-
 	// Create new transfer record
 	transfer := &FileTransfer{
 		ID:          transferID,
 		Filename:    filename,
 		TotalChunks: totalChunks,
 		FileSize:    fileSize,
+		Engagement:  msg.EngagementID,
+		KeyID:       keyID,
+		Source:      r.RemoteAddr,
 		Chunks:      make(map[int]string),
+		State:       StateInitialised,
 		Created:     time.Now(),
 		LastUpdated: time.Now(),
+
+		SealedFilename: sealedFilename,
 	}
 
-	// Store the transfer
+	// Store the transfer; an existing transfer is never replaced.
+	// The new transfer stays locked until it has been journaled.
 	transfersMutex.Lock()
+	if existing, exists := transfers[transferID]; exists {
+		transfersMutex.Unlock()
+		existing.mu.Lock()
+		state := existing.State
+		existing.mu.Unlock()
+		writeError(w, r, transferID, &RequestError{
+			Status:  http.StatusConflict,
+			Code:    ErrCodeTransferExists,
+			Message: "transfer already initialised",
+			State:   state,
+		})
+		return
+	}
+	if countActiveTransfers() >= limits.MaxConcurrentTransfers {
+		transfersMutex.Unlock()
+		writeError(w, r, transferID, newRequestError(http.StatusServiceUnavailable, ErrCodeTooManyTransfers,
+			"receiver already has %d transfers in progress", limits.MaxConcurrentTransfers))
+		return
+	}
+	transfer.mu.Lock()
 	transfers[transferID] = transfer
 	transfersMutex.Unlock()
 
-	log.Printf("Initialized transfer %s for file '%s': expecting %d chunks, %d bytes",
-		transferID, filename, totalChunks, fileSize)
+	// The engagement's usage is on disk, so it is charged outside
+	// transfersMutex while the new transfer is still locked
+	if reqErr := reserveEngagementBytes(msg.EngagementID, fileSize); reqErr != nil {
+		transfer.transition(StateFailed)
+		transfer.mu.Unlock()
+		removeTransfer(transfer)
+		writeError(w, r, transferID, reqErr)
+		return
+	}
+
+	if err := journal.RecordInit(transfer); err != nil {
+		transfer.transition(StateFailed)
+		transfer.mu.Unlock()
+		removeTransfer(transfer)
+		refundEngagementBytes(msg.EngagementID, fileSize)
+		log.Printf("ERROR: Failed to journal transfer %s: %v", transferID, err)
+		writeError(w, r, transferID, newRequestError(http.StatusInternalServerError, ErrCodeJournalFailed,
+			"failed to record transfer"))
+		return
+	}
+	transfer.mu.Unlock()
+
+	audit(AuditRecord{
+		Event:       AuditInit,
+		TransferID:  transferID,
+		Engagement:  msg.EngagementID,
+		Source:      transfer.Source,
+		State:       StateInitialised,
+		KeyID:       keyID,
+		Filename:    recordedName(filename),
+		TotalChunks: totalChunks,
+		Bytes:       int64(fileSize / 2),
+	})
+	log.Printf("Initialized transfer %s for file '%s' (engagement %s, key %s): expecting %d chunks, %d bytes",
+		transferID, recordedName(filename), msg.EngagementID, keyID, totalChunks, fileSize)
 
 	// Respond with success
-	fmt.Fprint(w, "OK")
+	writeJSON(w, http.StatusOK, Response{
+		OK:         true,
+		Code:       CodeTransferInitialised,
+		TransferID: transferID,
+		State:      StateInitialised,
+		Total:      totalChunks,
+	})
 }
 
 // handleChunkRequest processes incoming chunk data
-func handleChunkRequest(w http.ResponseWriter, r *http.Request, components []string) {
-	// Expected format: chunk/transferID/index/checksum/data
-	if len(components) != 5 {
-		http.Error(w, "Invalid chunk request format", http.StatusBadRequest)
+func handleChunkRequest(w http.ResponseWriter, r *http.Request, msg protocol.Chunk, keyID string) {
+	transferID := msg.TransferID
+	chunkIndex := msg.Index
+	chunkData := msg.Data
+
+	// Verify the chunk data with checksum
+	if calculateSHA256(chunkData) != msg.Checksum {
+		metrics.chunkChecksumFailures.Add(1)
+		writeError(w, r, transferID, newRequestError(http.StatusBadRequest, ErrCodeChecksumMismatch,
+			"checksum verification failed for chunk %d", chunkIndex))
 		return
 	}
 
-	transferID := components[1]
-	chunkIndex, err := strconv.Atoi(components[2])
-	if err != nil {
-		http.Error(w, "Invalid chunk index", http.StatusBadRequest)
+	// Find the transfer record
+	transfer, reqErr := lookupTransfer(transferID)
+	if reqErr != nil {
+		writeError(w, r, transferID, reqErr)
+		return
+	}
+	if reqErr := checkTransferKey(transfer, keyID); reqErr != nil {
+		writeError(w, r, transferID, reqErr)
 		return
 	}
 
-	chunkChecksum := components[3]
-	chunkData := components[4]
+	transfer.mu.Lock()
 
-	// Verify the chunk data with checksum
-	if calculateMD5(chunkData) != chunkChecksum {
-		http.Error(w, "Checksum verification failed", http.StatusBadRequest)
+	// Chunks are only accepted until the transfer is being verified
+	if transfer.State != StateInitialised && transfer.State != StateReceiving {
+		reqErr := stateError(transfer, "cannot accept chunks in state %s")
+		transfer.mu.Unlock()
+		writeError(w, r, transferID, reqErr)
 		return
 	}
 
-	// Find the transfer record
-	transfersMutex.Lock()
-	transfer, exists := transfers[transferID]
-	if !exists {
-		transfersMutex.Unlock()
-		http.Error(w, "Transfer not found", http.StatusNotFound)
+	// Enforce chunk range, transfer size and memory budget
+	delta := len(chunkData) - len(transfer.Chunks[chunkIndex])
+	if reqErr := checkChunkLimits(transfer, chunkIndex, delta); reqErr != nil {
+		transfer.mu.Unlock()
+		writeError(w, r, transferID, reqErr)
+		return
+	}
+	if reqErr := reserveMemory(delta); reqErr != nil {
+		transfer.mu.Unlock()
+		writeError(w, r, transferID, reqErr)
+		return
+	}
+
+	// Persist the chunk before acknowledging it
+	if err := journal.RecordChunk(transferID, chunkIndex, chunkData); err != nil {
+		reserveMemory(-delta)
+		transfer.mu.Unlock()
+		log.Printf("ERROR: Failed to journal chunk %d of transfer %s: %v", chunkIndex, transferID, err)
+		writeError(w, r, transferID, newRequestError(http.StatusInternalServerError, ErrCodeJournalFailed,
+			"failed to record chunk %d", chunkIndex))
 		return
 	}
 
 	// Store the chunk
+	firstChunk := transfer.State == StateInitialised
+	transfer.transition(StateReceiving)
+	if firstChunk {
+		persistState(transfer)
+	}
 	transfer.Chunks[chunkIndex] = chunkData
-	transfer.LastUpdated = time.Now()
-	transfersMutex.Unlock()
+	transfer.BufferedBytes += delta
+	response := Response{
+		OK:         true,
+		Code:       CodeChunkReceived,
+		TransferID: transferID,
+		State:      transfer.State,
+		Received:   len(transfer.Chunks),
+		Total:      transfer.TotalChunks,
+	}
+	transfer.mu.Unlock()
+	metrics.chunksReceived.Add(1)
+
+	audit(AuditRecord{
+		Event:       AuditChunk,
+		TransferID:  transferID,
+		Engagement:  transfer.Engagement,
+		Source:      r.RemoteAddr,
+		State:       response.State,
+		ChunkIndex:  &chunkIndex,
+		ChunkBytes:  len(chunkData) / 2,
+		ChunkSHA256: msg.Checksum,
+		Received:    response.Received,
+	})
 
 	if verboseMode {
 		log.Printf("Received chunk %d/%d for transfer %s (file: %s)",
-			chunkIndex+1, transfer.TotalChunks, transferID, transfer.Filename)
+			chunkIndex+1, response.Total, transferID, recordedName(transfer.Filename))
 	}
 
 	// Respond with success
-	fmt.Fprint(w, "OK")
+	writeJSON(w, http.StatusOK, response)
 }
 
-// handleCompleteRequest processes completion requests and concatenates all chunks
-func handleCompleteRequest(w http.ResponseWriter, r *http.Request, components []string) {
-	// Debug: In ra thông tin gói complete nhận được
-	if verboseMode {
-		log.Printf("DEBUG: Received complete request: %s", strings.Join(components, "/"))
-	}
-
-	// Expected format: complete/transferID/checksum
-	if len(components) != 3 {
-		log.Printf("ERROR: Invalid complete request format, got %d components instead of 3", len(components))
-		http.Error(w, "Invalid complete request format", http.StatusBadRequest)
-		return
-	}
-
-	transferID := components[1]
-	expectedChecksum := components[2]
+// handleCompleteRequest processes completion requests and assembles all chunks
+func handleCompleteRequest(w http.ResponseWriter, r *http.Request, msg protocol.Complete, keyID string) {
+	transferID := msg.TransferID
+	expectedChecksum := msg.Checksum
 
 	if verboseMode {
 		log.Printf("DEBUG: Processing complete request for transferID=%s with checksum=%s",
@@ -188,18 +337,30 @@ func handleCompleteRequest(w http.ResponseWriter, r *http.Request, components []
 	}
 
 	// Find the transfer record
-	transfersMutex.Lock()
-	transfer, exists := transfers[transferID]
-	if !exists {
+	transfer, reqErr := lookupTransfer(transferID)
+	if reqErr != nil {
 		log.Printf("ERROR: Transfer not found with ID: %s", transferID)
-		transfersMutex.Unlock()
-		http.Error(w, "Transfer not found", http.StatusNotFound)
+		writeError(w, r, transferID, reqErr)
+		return
+	}
+	if reqErr := checkTransferKey(transfer, keyID); reqErr != nil {
+		writeError(w, r, transferID, reqErr)
+		return
+	}
+
+	transfer.mu.Lock()
+
+	// Only a transfer that is still receiving can be completed
+	if transfer.State != StateInitialised && transfer.State != StateReceiving {
+		reqErr := stateError(transfer, "cannot complete a transfer in state %s")
+		transfer.mu.Unlock()
+		writeError(w, r, transferID, reqErr)
 		return
 	}
 
 	if verboseMode {
 		log.Printf("DEBUG: Found transfer record: filename=%s, totalChunks=%d, receivedChunks=%d",
-			transfer.Filename, transfer.TotalChunks, len(transfer.Chunks))
+			recordedName(transfer.Filename), transfer.TotalChunks, len(transfer.Chunks))
 
 		// Debug: Liệt kê các chunk đã nhận
 		var missingChunks []int
@@ -220,64 +381,187 @@ func handleCompleteRequest(w http.ResponseWriter, r *http.Request, components []
 	if len(transfer.Chunks) != transfer.TotalChunks {
 		log.Printf("ERROR: Incomplete transfer, got %d chunks but expected %d",
 			len(transfer.Chunks), transfer.TotalChunks)
-		transfersMutex.Unlock()
-		http.Error(w, fmt.Sprintf("Missing chunks: %d/%d received",
-			len(transfer.Chunks), transfer.TotalChunks), http.StatusBadRequest)
+		reqErr := &RequestError{
+			Status: http.StatusBadRequest,
+			Code:   ErrCodeMissingChunks,
+			Message: fmt.Sprintf("missing chunks: %d/%d received",
+				len(transfer.Chunks), transfer.TotalChunks),
+			State: transfer.State,
+		}
+		transfer.mu.Unlock()
+		writeError(w, r, transferID, reqErr)
 		return
 	}
 
-	// Concatenate all chunks in correct order
-	if verboseMode {
-		log.Printf("DEBUG: Starting chunk concatenation for transfer %s", transferID)
-	}
-	completeData := ConcatenateChunks(transfer)
-	if verboseMode {
-		log.Printf("DEBUG: Concatenation complete, data size: %d bytes", len(completeData))
-	}
+	// Freeze the transfer while it is verified and processed. Nothing modifies
+	// its chunks in the verifying state, so they are read without the lock. A
+	// shutdown only flags the transfer as interrupted; releasing the chunks is
+	// left to this handler once processing has returned.
+	transfer.transition(StateVerifying)
+	persistState(transfer)
+	transfer.mu.Unlock()
 
-	// Verify the full data checksum
-	actualChecksum := calculateMD5(completeData)
+	// Verify, decrypt and save the file in one streaming pass
 	if verboseMode {
-		log.Printf("DEBUG: Calculated checksum: %s, expected: %s", actualChecksum, expectedChecksum)
+		log.Printf("DEBUG: Processing completed transfer to save file...")
 	}
-
-	if actualChecksum != expectedChecksum {
-		log.Printf("ERROR: Checksum verification failed. Expected: %s, Got: %s",
-			expectedChecksum, actualChecksum)
-		transfersMutex.Unlock()
-		http.Error(w, "Full data checksum verification failed", http.StatusBadRequest)
+	stored, proof, err := ProcessCompletedTransfer(transfer, expectedChecksum)
+	if err != nil {
+		transfer.mu.Lock()
+		failTransfer(transfer)
+		transfer.mu.Unlock()
+
+		reqErr := &RequestError{
+			Status:  http.StatusInternalServerError,
+			Code:    ErrCodeProcessingFailed,
+			Message: fmt.Sprintf("error processing transfer: %v", err),
+			State:   StateFailed,
+		}
+		switch {
+		case errors.Is(err, errChecksumMismatch):
+			metrics.fileChecksumFailures.Add(1)
+			log.Printf("ERROR: Checksum verification failed for transfer %s", transferID)
+			reqErr.Status = http.StatusBadRequest
+			reqErr.Code = ErrCodeFullChecksumMismatch
+			reqErr.Message = "full data checksum verification failed"
+		case errors.Is(err, errDecryption):
+			metrics.decryptionFailures.Add(1)
+			log.Printf("ERROR: Failed to decrypt transfer %s: %v", transferID, err)
+			reqErr.Status = http.StatusBadRequest
+			reqErr.Code = ErrCodeDecryptionFailed
+			reqErr.Message = "payload could not be decrypted"
+		case errors.Is(err, errInterrupted):
+			reqErr.Status = http.StatusServiceUnavailable
+			reqErr.Code = ErrCodeShuttingDown
+			reqErr.Message = err.Error()
+		case errors.Is(err, errCanaryInvalid):
+			log.Printf("ERROR: Canary for transfer %s did not verify: %v", transferID, err)
+			reqErr.Status = http.StatusBadRequest
+			reqErr.Code = ErrCodeCanaryInvalid
+			reqErr.Message = err.Error()
+		default:
+			log.Printf("ERROR: Failed to process completed transfer: %v", err)
+		}
+		writeError(w, r, transferID, reqErr)
 		return
 	}
 
 	log.Printf("DEBUG: Checksum verified successfully")
 
-	// Store the checksum
-	transfer.Checksum = expectedChecksum
-	transfersMutex.Unlock()
-
-	// Process the completed transfer (save to file)
-	if verboseMode {
-		log.Printf("DEBUG: Processing completed transfer to save file...")
+	record := AuditRecord{
+		Event:       AuditComplete,
+		TransferID:  transferID,
+		Engagement:  transfer.Engagement,
+		Source:      r.RemoteAddr,
+		State:       StateCompleted,
+		TotalChunks: transfer.TotalChunks,
+		Bytes:       int64(transfer.FileSize / 2),
+		Checksum:    expectedChecksum,
+		Canary:      proof != nil,
 	}
-	outputPath, err := ProcessCompletedTransfer(transferID)
-	if err != nil {
-		log.Printf("ERROR: Failed to process completed transfer: %v", err)
-		http.Error(w, fmt.Sprintf("Error processing transfer: %v", err), http.StatusInternalServerError)
-		return
+	if proof != nil {
+		record.StoredSHA256, record.StoredSize = proof.SHA256, proof.Size
+	} else {
+		record.StoredSHA256, record.StoredSize = stored.storedDigest()
+		metrics.bytesStored.Add(record.StoredSize)
+		metrics.filesStored.Add(1)
+	}
+	audit(record)
+
+	code := CodeTransferCompleted
+	if proof != nil {
+		code = CodeCanaryVerified
+		log.Printf("Transfer %s completed successfully: canary verified", transferID)
+	} else {
+		log.Printf("Transfer %s completed successfully: saved to %s",
+			transferID, stored.Path)
 	}
-
-	log.Printf("Transfer %s completed successfully: saved to %s",
-		transferID, outputPath)
 
 	// Respond with success
-	fmt.Fprint(w, "OK")
+	writeJSON(w, http.StatusOK, Response{
+		OK:         true,
+		Code:       code,
+		TransferID: transferID,
+		State:      StateCompleted,
+		Received:   transfer.TotalChunks,
+		Total:      transfer.TotalChunks,
+	})
 	if verboseMode {
 		log.Printf("DEBUG: Complete request processed successfully")
 	}
 }
 
-// calculateMD5 computes MD5 hash of a string
-func calculateMD5(data string) string {
-	hash := md5.Sum([]byte(data))
+// lookupTransfer finds a transfer by ID
+func lookupTransfer(transferID string) (*FileTransfer, *RequestError) {
+	transfersMutex.RLock()
+	transfer, exists := transfers[transferID]
+	transfersMutex.RUnlock()
+
+	if !exists {
+		return nil, newRequestError(http.StatusNotFound, ErrCodeTransferNotFound,
+			"transfer not found")
+	}
+	return transfer, nil
+}
+
+// checkTransferKey rejects a request signed with another key than the
+// transfer's init request
+func checkTransferKey(transfer *FileTransfer, keyID string) *RequestError {
+	if transfer.KeyID != keyID {
+		return newRequestError(http.StatusUnauthorized, ErrCodeUnauthenticated,
+			"request is not signed with the transfer's key")
+	}
+	return nil
+}
+
+// stateError rejects a request that is not valid in the transfer's current
+// state. The caller must hold transfer.mu.
+func stateError(transfer *FileTransfer, format string) *RequestError {
+	// A transfer can expire between lookup and locking
+	if transfer.State == StateExpired {
+		return newRequestError(http.StatusNotFound, ErrCodeTransferNotFound,
+			"transfer not found")
+	}
+	return &RequestError{
+		Status:  http.StatusConflict,
+		Code:    ErrCodeInvalidState,
+		Message: fmt.Sprintf(format, transfer.State),
+		State:   transfer.State,
+	}
+}
+
+// removeTransfer drops a transfer from the map if it is still registered
+func removeTransfer(transfer *FileTransfer) {
+	transfersMutex.Lock()
+	if transfers[transfer.ID] == transfer {
+		delete(transfers, transfer.ID)
+	}
+	transfersMutex.Unlock()
+}
+
+// failTransfer marks a transfer as failed and releases its chunk data.
+// The caller must hold transfer.mu.
+func failTransfer(transfer *FileTransfer) {
+	transfer.transition(StateFailed)
+	releaseTransferMemory(transfer)
+	transfer.Chunks = nil
+	persistState(transfer)
+	if err := journal.DropChunks(transfer.ID); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// decodeError turns a protocol decoding failure into a RequestError
+func decodeError(err error) *RequestError {
+	var perr *protocol.Error
+	if errors.As(err, &perr) {
+		return newRequestError(http.StatusBadRequest, perr.Code, "%s", perr.Message)
+	}
+	return newRequestError(http.StatusBadRequest, ErrCodeInvalidRequest, "%v", err)
+}
+
+// calculateSHA256 computes the SHA-256 hash of a string
+func calculateSHA256(data string) string {
+	hash := sha256.Sum256([]byte(data))
 	return hex.EncodeToString(hash[:])
 }
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"protocol"
+)
+
+// journalMeta is the on-disk record of a transfer's init metadata and state
+type journalMeta struct {
+	ID          string        `json:"id"`
+	Filename    string        `json:"filename,omitempty"`
+	TotalChunks int           `json:"total_chunks"`
+	FileSize    int           `json:"file_size"`
+	Engagement  string        `json:"engagement"`
+	KeyID       string        `json:"key_id"`
+	Source      string        `json:"source"`
+	State       TransferState `json:"state"`
+	Created     time.Time     `json:"created"`
+	LastUpdated time.Time     `json:"last_updated"`
+	Checksum    string        `json:"checksum,omitempty"`
+
+	// SealedFilename replaces Filename when outputs are encrypted at rest
+	SealedFilename string `json:"sealed_filename,omitempty"`
+}
+
+// Journal persists transfer metadata and received chunks below the output
+// root so that partial transfers survive a server restart. Each transfer has
+// a directory holding meta.json and one file per received chunk.
+type Journal struct {
+	root string
+}
+
+// NewJournal returns a journal stored under <outputRoot>/journal
+func NewJournal(outputRoot string) *Journal {
+	return &Journal{root: filepath.Join(outputRoot, "journal")}
+}
+
+// transferDir returns the journal directory for a transfer
+func (j *Journal) transferDir(transferID string) string {
+	return filepath.Join(j.root, transferID)
+}
+
+// chunkPath returns the journal file for one chunk of a transfer
+func (j *Journal) chunkPath(transferID string, index int) string {
+	return filepath.Join(j.transferDir(transferID), "chunks", strconv.Itoa(index))
+}
+
+// RecordInit creates the journal entry for a new transfer
+func (j *Journal) RecordInit(transfer *FileTransfer) error {
+	if !protocol.IsValidTransferID(transfer.ID) {
+		return fmt.Errorf("invalid transfer ID: %q", transfer.ID)
+	}
+	if err := os.MkdirAll(filepath.Join(j.transferDir(transfer.ID), "chunks"), 0700); err != nil {
+		return fmt.Errorf("error creating journal entry: %v", err)
+	}
+	return j.RecordState(transfer)
+}
+
+// RecordState rewrites the metadata of a transfer, including its state
+func (j *Journal) RecordState(transfer *FileTransfer) error {
+	meta := journalMeta{
+		ID:          transfer.ID,
+		Filename:    transfer.Filename,
+		TotalChunks: transfer.TotalChunks,
+		FileSize:    transfer.FileSize,
+		Engagement:  transfer.Engagement,
+		KeyID:       transfer.KeyID,
+		Source:      transfer.Source,
+		State:       transfer.State,
+		Created:     transfer.Created,
+		LastUpdated: transfer.LastUpdated,
+		Checksum:    transfer.Checksum,
+
+		SealedFilename: transfer.SealedFilename,
+	}
+	// The name is only journaled sealed when outputs are encrypted at rest
+	if outputRecipient != nil {
+		meta.Filename = ""
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("error encoding journal metadata: %v", err)
+	}
+	return writeFileAtomic(filepath.Join(j.transferDir(transfer.ID), "meta.json"), data)
+}
+
+// RecordChunk stores the data of one received chunk
+func (j *Journal) RecordChunk(transferID string, index int, data string) error {
+	return writeFileAtomic(j.chunkPath(transferID, index), []byte(data))
+}
+
+// DropChunks deletes the stored chunks of a transfer but keeps its metadata
+func (j *Journal) DropChunks(transferID string) error {
+	chunksDir := filepath.Join(j.transferDir(transferID), "chunks")
+	if err := os.RemoveAll(chunksDir); err != nil {
+		return fmt.Errorf("error removing journal chunks: %v", err)
+	}
+	return nil
+}
+
+// Remove deletes the journal entry of a transfer
+func (j *Journal) Remove(transferID string) error {
+	if !protocol.IsValidTransferID(transferID) {
+		return fmt.Errorf("invalid transfer ID: %q", transferID)
+	}
+	if err := os.RemoveAll(j.transferDir(transferID)); err != nil {
+		return fmt.Errorf("error removing journal entry: %v", err)
+	}
+	return nil
+}
+
+// Load reads every journal entry back into FileTransfer records.
+// Entries that cannot be read are logged and skipped.
+func (j *Journal) Load() ([]*FileTransfer, error) {
+	entries, err := os.ReadDir(j.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading journal: %v", err)
+	}
+
+	var loaded []*FileTransfer
+	for _, entry := range entries {
+		if !entry.IsDir() || !protocol.IsValidTransferID(entry.Name()) {
+			continue
+		}
+
+		transfer, err := j.loadTransfer(entry.Name())
+		if err != nil {
+			log.Printf("Warning: skipping journal entry %s: %v", entry.Name(), err)
+			continue
+		}
+		loaded = append(loaded, transfer)
+	}
+
+	return loaded, nil
+}
+
+// loadTransfer reads one journal entry
+func (j *Journal) loadTransfer(transferID string) (*FileTransfer, error) {
+	data, err := os.ReadFile(filepath.Join(j.transferDir(transferID), "meta.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta journalMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	if meta.ID != transferID {
+		return nil, fmt.Errorf("metadata is for transfer %q", meta.ID)
+	}
+
+	transfer := &FileTransfer{
+		ID:          meta.ID,
+		Filename:    meta.Filename,
+		TotalChunks: meta.TotalChunks,
+		FileSize:    meta.FileSize,
+		Engagement:  meta.Engagement,
+		KeyID:       meta.KeyID,
+		Source:      meta.Source,
+		Chunks:      make(map[int]string),
+		State:       meta.State,
+		Created:     meta.Created,
+		LastUpdated: meta.LastUpdated,
+		Checksum:    meta.Checksum,
+
+		SealedFilename: meta.SealedFilename,
+	}
+
+	// Chunks do not rewrite meta.json, so take activity from the files too
+	if last := j.lastActivity(transferID); last.After(transfer.LastUpdated) {
+		transfer.LastUpdated = last
+	}
+
+	chunkFiles, err := os.ReadDir(filepath.Join(j.transferDir(transferID), "chunks"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, chunkFile := range chunkFiles {
+		index, err := strconv.Atoi(chunkFile.Name())
+		if err != nil || index < 0 || index >= transfer.TotalChunks {
+			continue
+		}
+		chunk, err := os.ReadFile(j.chunkPath(transferID, index))
+		if err != nil {
+			return nil, err
+		}
+		transfer.Chunks[index] = string(chunk)
+		transfer.BufferedBytes += len(chunk)
+	}
+
+	return transfer, nil
+}
+
+// PruneStale removes journal entries that are not tracked in memory and
+// have not been updated within the retention period
+func (j *Journal) PruneStale(now time.Time, retention time.Duration, tracked map[string]*FileTransfer) {
+	entries, err := os.ReadDir(j.root)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		id := entry.Name()
+		if _, ok := tracked[id]; ok || !protocol.IsValidTransferID(id) {
+			continue
+		}
+
+		if now.Sub(j.lastActivity(id)) <= retention {
+			continue
+		}
+
+		if err := j.Remove(id); err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		audit(AuditRecord{Event: AuditCleanup, TransferID: id, Reason: "stale journal entry"})
+		log.Printf("Pruned stale journal entry %s", id)
+	}
+}
+
+// lastActivity returns the most recent modification time of a journal
+// entry's metadata or chunk directory
+func (j *Journal) lastActivity(transferID string) time.Time {
+	var last time.Time
+	for _, path := range []string{
+		filepath.Join(j.transferDir(transferID), "meta.json"),
+		filepath.Join(j.transferDir(transferID), "chunks"),
+	} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// writeFileAtomic writes data to path through a temporary file and rename,
+// so a crash never leaves a half-written file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating journal file: %v", err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing journal file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("error syncing journal file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error closing journal file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error committing journal file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// simulateRestart drops all in-memory state and replays the journal
+func simulateRestart(t *testing.T) {
+	t.Helper()
+	transfersMutex.Lock()
+	transfers = make(map[string]*FileTransfer)
+	bufferedBytes.Store(0)
+	transfersMutex.Unlock()
+
+	if err := ReplayJournal(); err != nil {
+		t.Fatalf("ReplayJournal: %v", err)
+	}
+}
+
+func TestJournalReplayResumesTransfer(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	data := encryptForTest(t, testTransferID, []byte("survives a restart"), "test-key")
+	half := len(data) / 2
+
+	doRequest(fmt.Sprintf("init/%s/2/%d/test-engagement/a.txt", testTransferID, len(data)))
+	expectCode(t, doRequest(chunkPath(testTransferID, 0, data[:half])), http.StatusOK, CodeChunkReceived)
+
+	simulateRestart(t)
+
+	transfersMutex.RLock()
+	transfer, exists := transfers[testTransferID]
+	transfersMutex.RUnlock()
+	if !exists {
+		t.Fatal("transfer was not replayed from the journal")
+	}
+	if transfer.State != StateReceiving || len(transfer.Chunks) != 1 {
+		t.Fatalf("replayed state = %s with %d chunks, want receiving with 1", transfer.State, len(transfer.Chunks))
+	}
+	if got := bufferedBytes.Load(); got != int64(half) {
+		t.Errorf("bufferedBytes = %d, want %d", got, half)
+	}
+
+	expectCode(t, doRequest(chunkPath(testTransferID, 1, data[half:])), http.StatusOK, CodeChunkReceived)
+	completePath := fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256(data))
+	expectCode(t, doRequest(completePath), http.StatusOK, CodeTransferCompleted)
+
+	// A completed transfer is still known after another restart
+	simulateRestart(t)
+	expectCode(t, doRequest(completePath), http.StatusConflict, ErrCodeInvalidState)
+}
+
+func TestJournalReplayFailsInterruptedVerification(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	sendTransfer(t, testTransferID, "abcdef0123", 4)
+	transfersMutex.Lock()
+	transfer := transfers[testTransferID]
+	transfer.transition(StateVerifying)
+	persistState(transfer)
+	transfersMutex.Unlock()
+
+	simulateRestart(t)
+
+	transfersMutex.RLock()
+	state := transfers[testTransferID].State
+	transfersMutex.RUnlock()
+	if state != StateFailed {
+		t.Errorf("state after replay = %s, want %s", state, StateFailed)
+	}
+	if got := bufferedBytes.Load(); got != 0 {
+		t.Errorf("bufferedBytes = %d, want 0", got)
+	}
+}
+
+func TestCleanupPrunesJournal(t *testing.T) {
+	resetState(t, DefaultLimits())
+	SetTransferRetention(time.Minute)
+	defer SetTransferRetention(30 * time.Minute)
+
+	doRequest(fmt.Sprintf("init/%s/2/100/test-engagement/a.txt", testTransferID))
+	doRequest(chunkPath(testTransferID, 0, "abcd"))
+
+	transfersMutex.Lock()
+	transfers[testTransferID].LastUpdated = time.Now().Add(-2 * time.Minute)
+	transfersMutex.Unlock()
+
+	ScheduleCleanup()
+	simulateRestart(t)
+
+	transfersMutex.RLock()
+	_, exists := transfers[testTransferID]
+	transfersMutex.RUnlock()
+	if exists {
+		t.Error("expired transfer was replayed from the journal")
+	}
+}
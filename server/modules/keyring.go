@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// DefaultKeyID names the single key given with key_file or key_env
+const DefaultKeyID = "default"
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Keyring holds every shared key clients may currently use, by key ID, so
+// that keys can be rotated: a new key is added while clients holding the
+// old one are still out, and the old one is removed once they are done.
+// A transfer is bound to the key its init request was signed with.
+type Keyring struct {
+	ids  []string
+	keys map[string]string
+}
+
+// NewKeyring returns an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]string)}
+}
+
+// Add adds a key under a new key ID. Key IDs and keys must be unique.
+func (k *Keyring) Add(id, key string) error {
+	if !keyIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid key ID %q", id)
+	}
+	if key == "" {
+		return fmt.Errorf("key %s is empty", id)
+	}
+	if _, exists := k.keys[id]; exists {
+		return fmt.Errorf("duplicate key ID %s", id)
+	}
+	for other, existing := range k.keys {
+		if existing == key {
+			return fmt.Errorf("keys %s and %s are the same", other, id)
+		}
+	}
+	k.ids = append(k.ids, id)
+	k.keys[id] = key
+	return nil
+}
+
+// IDs returns the key IDs in the order they were added
+func (k *Keyring) IDs() []string {
+	return append([]string(nil), k.ids...)
+}
+
+// Key returns the key with the given ID
+func (k *Keyring) Key(id string) (string, bool) {
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// Match returns the ID of the first key that valid accepts, typically by
+// checking a request MAC under it
+func (k *Keyring) Match(valid func(sharedKey string) bool) (string, bool) {
+	for _, id := range k.ids {
+		if valid(k.keys[id]) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// ParseKeyring reads a keyring file: one "<key ID> <key>" pair per line.
+// Blank lines and lines starting with # are ignored.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	keyring := NewKeyring()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, key, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("keyring line %d: expected \"<key ID> <key>\"", line)
+		}
+		if err := keyring.Add(id, strings.TrimSpace(key)); err != nil {
+			return nil, fmt.Errorf("keyring line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading keyring: %v", err)
+	}
+	if len(keyring.ids) == 0 {
+		return nil, fmt.Errorf("keyring is empty")
+	}
+	return keyring, nil
+}
+
+// Active keyring
+var keyring = NewKeyring()
+
+// SetKeyring replaces the keys requests are accepted under. Transfers bound
+// to a key that is no longer in the keyring cannot continue.
+func SetKeyring(k *Keyring) {
+	keyring = k
+	log.Printf("Keyring has been set: %s", strings.Join(k.IDs(), ", "))
+}
+
+// SetEncryptionKey sets a single shared key from external source
+func SetEncryptionKey(key string) {
+	k := NewKeyring()
+	if err := k.Add(DefaultKeyID, key); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	keyring = k
+	log.Printf("Encryption key has been set")
+}
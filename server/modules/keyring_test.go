@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"protocol"
+)
+
+// testKeyring is a keyring in the middle of a rotation
+const testKeyring = `# retiring
+2026-q1 first-shared-key
+
+2026-q2 second-shared-key
+`
+
+// doRequestWith signs path under sharedKey and sends it through HandleRequest
+func doRequestWith(sharedKey, path string) int {
+	return doRawRequest(signWith(sharedKey, path) + protocol.URLSuffix).Code
+}
+
+func TestParseKeyring(t *testing.T) {
+	keyring, err := ParseKeyring([]byte(testKeyring))
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	if ids := strings.Join(keyring.IDs(), ","); ids != "2026-q1,2026-q2" {
+		t.Errorf("IDs = %s", ids)
+	}
+	if key, ok := keyring.Key("2026-q2"); !ok || key != "second-shared-key" {
+		t.Errorf("Key(2026-q2) = %q, %v", key, ok)
+	}
+
+	for name, data := range map[string]string{
+		"empty":          "# nothing\n",
+		"missing key":    "2026-q1\n",
+		"invalid key ID": "2026/q1 key\n",
+		"duplicate ID":   "a one\na two\n",
+		"duplicate key":  "a same\nb same\n",
+	} {
+		if _, err := ParseKeyring([]byte(data)); err == nil {
+			t.Errorf("%s: keyring accepted", name)
+		}
+	}
+}
+
+func TestKeyRotationRoundTrip(t *testing.T) {
+	resetState(t, DefaultLimits())
+	keyring, _ := ParseKeyring([]byte(testKeyring))
+	SetKeyring(keyring)
+
+	// A client holding any key in the keyring can complete a transfer
+	for i, id := range keyring.IDs() {
+		sharedKey, _ := keyring.Key(id)
+		transferID := fmt.Sprintf("%064x", i+1)
+		plaintext := []byte("sent under key " + id)
+		data := encryptForTest(t, transferID, plaintext, sharedKey)
+
+		if code := doRequestWith(sharedKey, fmt.Sprintf("init/%s/2/%d/test-engagement/%s.txt",
+			transferID, len(data), id)); code != http.StatusOK {
+			t.Fatalf("%s: init status %d", id, code)
+		}
+		half := len(data) / 2
+		for index, chunk := range []string{data[:half], data[half:]} {
+			if code := doRequestWith(sharedKey, chunkPath(transferID, index, chunk)); code != http.StatusOK {
+				t.Fatalf("%s: chunk %d status %d", id, index, code)
+			}
+		}
+		if code := doRequestWith(sharedKey, fmt.Sprintf("complete/%s/%s", transferID, calculateSHA256(data))); code != http.StatusOK {
+			t.Fatalf("%s: complete status %d", id, code)
+		}
+	}
+	stored, err := outputStore.List()
+	if err != nil || len(stored) != len(keyring.IDs()) {
+		t.Fatalf("stored %d outputs, %v", len(stored), err)
+	}
+	for _, record := range stored {
+		data, err := os.ReadFile(record.Path)
+		if err != nil || !strings.HasPrefix(string(data), "sent under key ") {
+			t.Errorf("%s: stored %q, %v", record.TransferID, data, err)
+		}
+	}
+
+	// A transfer stays bound to the key its init request was signed with
+	data := encryptForTest(t, testTransferID, []byte("mixed keys"), "first-shared-key")
+	doRequestWith("first-shared-key", fmt.Sprintf("init/%s/1/%d/test-engagement/a.txt", testTransferID, len(data)))
+	expectCode(t, doRawRequest(signWith("second-shared-key", chunkPath(testTransferID, 0, data))+protocol.URLSuffix),
+		http.StatusUnauthorized, ErrCodeUnauthenticated)
+
+	// Keys removed from the keyring are no longer accepted
+	rotated, _ := ParseKeyring([]byte("2026-q2 second-shared-key\n"))
+	SetKeyring(rotated)
+	if code := doRequestWith("first-shared-key", chunkPath(testTransferID, 0, data)); code != http.StatusUnauthorized {
+		t.Errorf("chunk under a removed key: status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
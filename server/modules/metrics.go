@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Counters exported on the metrics endpoint. They only ever increase and
+// start from zero at each process start.
+var metrics struct {
+	chunksReceived        atomic.Int64
+	chunkChecksumFailures atomic.Int64
+	fileChecksumFailures  atomic.Int64
+	decryptionFailures    atomic.Int64
+	bytesStored           atomic.Int64
+	filesStored           atomic.Int64
+	transferEvictions     atomic.Int64
+	outputEvictions       atomic.Int64
+}
+
+// CheckMetricsAddr checks that a metrics listen address is on loopback, so
+// the endpoint is never reachable from the relayed side
+func CheckMetricsAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid metrics address %q: %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("metrics address %q must be a loopback address", addr)
+	}
+	return nil
+}
+
+// WriteMetrics writes the current metrics in the Prometheus text format
+func WriteMetrics(w io.Writer) error {
+	transfersMutex.RLock()
+	active := countActiveTransfers()
+	transfersMutex.RUnlock()
+
+	type sample struct {
+		labels string
+		value  int64
+	}
+	families := []struct {
+		name, kind, help string
+		samples          []sample
+	}{
+		{"ssrfleak_active_transfers", "gauge", "Transfers initialised, receiving or being verified.",
+			[]sample{{"", int64(active)}}},
+		{"ssrfleak_chunks_received_total", "counter", "Chunks accepted.",
+			[]sample{{"", metrics.chunksReceived.Load()}}},
+		{"ssrfleak_checksum_failures_total", "counter", "Chunks or whole transfers whose checksum did not match.",
+			[]sample{
+				{`{scope="chunk"}`, metrics.chunkChecksumFailures.Load()},
+				{`{scope="transfer"}`, metrics.fileChecksumFailures.Load()},
+			}},
+		{"ssrfleak_decryption_failures_total", "counter", "Transfers whose payload could not be decrypted.",
+			[]sample{{"", metrics.decryptionFailures.Load()}}},
+		{"ssrfleak_stored_bytes_total", "counter", "Bytes of received files written to the output directory, as stored.",
+			[]sample{{"", metrics.bytesStored.Load()}}},
+		{"ssrfleak_stored_files_total", "counter", "Files written to the output directory.",
+			[]sample{{"", metrics.filesStored.Load()}}},
+		{"ssrfleak_cleanup_evictions_total", "counter", "Idle transfers and expired outputs removed by cleanup.",
+			[]sample{
+				{`{kind="transfer"}`, metrics.transferEvictions.Load()},
+				{`{kind="output"}`, metrics.outputEvictions.Load()},
+			}},
+	}
+
+	for _, family := range families {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind); err != nil {
+			return err
+		}
+		for _, s := range family.samples {
+			if _, err := fmt.Fprintf(w, "%s%s %d\n", family.name, s.labels, s.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// HandleMetrics serves the metrics to loopback clients only
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if ip := net.ParseIP(sourceHost(r.RemoteAddr)); ip == nil || !ip.IsLoopback() {
+		http.Error(w, "metrics are only served locally", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteMetrics(w)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readMetrics returns the samples of the metrics output by name and labels
+func readMetrics(t *testing.T) map[string]int64 {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf); err != nil {
+		t.Fatalf("WriteMetrics: %v", err)
+	}
+	samples := make(map[string]int64)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			t.Fatalf("malformed sample %q", line)
+		}
+		samples[name] = n
+	}
+	return samples
+}
+
+func TestMetricsCounters(t *testing.T) {
+	resetState(t, DefaultLimits())
+	SetTransferRetention(time.Minute)
+	defer SetTransferRetention(30 * time.Minute)
+	before := readMetrics(t)
+
+	// One file stored and one transfer left active
+	plaintext := []byte("metrics payload")
+	payload := encryptForTest(t, testTransferID, plaintext, "test-key")
+	chunks := sendTransfer(t, testTransferID, payload, 32)
+	expectCode(t, doRequest(fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256(payload))),
+		http.StatusOK, CodeTransferCompleted)
+	idleID := fmt.Sprintf("%064x", 1)
+	sendTransfer(t, idleID, "abcd", 4)
+	chunks++
+
+	// A corrupted chunk, a payload under the wrong key and a bad full checksum
+	expectCode(t, doRequest(fmt.Sprintf("chunk/%s/0/%s/abcd", idleID, calculateSHA256("abce"))),
+		http.StatusBadRequest, ErrCodeChecksumMismatch)
+	wrongKeyID := fmt.Sprintf("%064x", 2)
+	wrongKey := encryptForTest(t, wrongKeyID, plaintext, "other-key")
+	chunks += sendTransfer(t, wrongKeyID, wrongKey, 64)
+	expectCode(t, doRequest(fmt.Sprintf("complete/%s/%s", wrongKeyID, calculateSHA256(wrongKey))),
+		http.StatusBadRequest, ErrCodeDecryptionFailed)
+	badSumID := fmt.Sprintf("%064x", 3)
+	chunks += sendTransfer(t, badSumID, "abcd", 4)
+	expectCode(t, doRequest(fmt.Sprintf("complete/%s/%s", badSumID, calculateSHA256("abce"))),
+		http.StatusBadRequest, ErrCodeFullChecksumMismatch)
+
+	after := readMetrics(t)
+	want := map[string]int64{
+		"ssrfleak_active_transfers":                          1,
+		"ssrfleak_chunks_received_total":                     int64(chunks),
+		`ssrfleak_checksum_failures_total{scope="chunk"}`:    1,
+		`ssrfleak_checksum_failures_total{scope="transfer"}`: 1,
+		"ssrfleak_decryption_failures_total":                 1,
+		"ssrfleak_stored_bytes_total":                        int64(len(plaintext)),
+		"ssrfleak_stored_files_total":                        1,
+	}
+	for name, delta := range want {
+		got := after[name]
+		if name != "ssrfleak_active_transfers" {
+			got -= before[name]
+		}
+		if got != delta {
+			t.Errorf("%s = %d, want %d", name, got, delta)
+		}
+	}
+
+	// Cleanup evicts the idle transfer
+	transfersMutex.Lock()
+	transfers[idleID].LastUpdated = time.Now().Add(-2 * time.Minute)
+	transfersMutex.Unlock()
+	ScheduleCleanup()
+	evicted := readMetrics(t)
+	if got := evicted[`ssrfleak_cleanup_evictions_total{kind="transfer"}`] - before[`ssrfleak_cleanup_evictions_total{kind="transfer"}`]; got != 1 {
+		t.Errorf("transfer evictions = %d, want 1", got)
+	}
+	if got := evicted["ssrfleak_active_transfers"]; got != 0 {
+		t.Errorf("active transfers after cleanup = %d, want 0", got)
+	}
+}
+
+func TestMetricsLocalOnly(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"127.0.0.1:40000", http.StatusOK},
+		{"[::1]:40000", http.StatusOK},
+		{"192.0.2.1:40000", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		HandleMetrics(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("metrics from %s: status %d, want %d", tt.remoteAddr, rec.Code, tt.status)
+		}
+	}
+
+	for addr, valid := range map[string]bool{
+		"127.0.0.1:9464": true,
+		"[::1]:9464":     true,
+		"localhost:9464": true,
+		":9464":          false,
+		"0.0.0.0:9464":   false,
+		"10.0.0.1:9464":  false,
+	} {
+		if err := CheckMetricsAddr(addr); (err == nil) != valid {
+			t.Errorf("CheckMetricsAddr(%q) = %v, want valid %v", addr, err, valid)
+		}
+	}
+}
@@ -1,162 +1,334 @@
 package server
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
-	"path/filepath"
-	"strings"
 	"time"
+
+	"protocol"
 )
 
-// Global encryption key
-var encryptionKey string = "abcd" // Default value
+// Output store, transfer journal and stale transfer retention,
+// overridable from the config
+var (
+	outputStore       = NewOutputStore("received_files")
+	journal           = NewJournal("received_files")
+	transferRetention = 30 * time.Minute
+)
 
-// SetEncryptionKey sets the encryption key from external source
-func SetEncryptionKey(key string) {
-	encryptionKey = key
-	log.Printf("Encryption key has been set")
+// SetOutputDir sets the root directory that received files and the
+// transfer journal are written to
+func SetOutputDir(dir string) {
+	outputStore = NewOutputStore(dir)
+	journal = NewJournal(dir)
 }
 
-// ConcatenateChunks combines all chunks in a file transfer into a single string
-func ConcatenateChunks(transfer *FileTransfer) string {
-	var builder strings.Builder
-	builder.Grow(transfer.FileSize) // Pre-allocate memory for efficiency
+// SetTransferRetention sets how long an idle, incomplete transfer is kept
+func SetTransferRetention(retention time.Duration) {
+	transferRetention = retention
+}
 
-	// Append chunks in order
-	for i := 0; i < transfer.TotalChunks; i++ {
-		chunk, exists := transfer.Chunks[i]
-		if exists {
-			builder.WriteString(chunk)
-		} else {
-			log.Printf("Warning: Missing chunk %d for transfer %s", i, transfer.ID)
+// Errors from ProcessCompletedTransfer that map to specific response codes
+var (
+	errChecksumMismatch = errors.New("full data checksum verification failed")
+	errDecryption       = errors.New("decryption failed")
+)
+
+// chunkReader reads the chunks of a transfer in order as one continuous
+// stream, without concatenating them. The transfer must not change while
+// it is read, which the verifying state guarantees. Reading stops with
+// errInterrupted once a shutdown has interrupted the transfer.
+type chunkReader struct {
+	transfer *FileTransfer
+	index    int
+	offset   int
+}
+
+// Read implements io.Reader
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.transfer.interrupted.Load() {
+		return 0, errInterrupted
+	}
+	for r.index < r.transfer.TotalChunks {
+		chunk := r.transfer.Chunks[r.index]
+		if r.offset < len(chunk) {
+			n := copy(p, chunk[r.offset:])
+			r.offset += n
+			return n, nil
 		}
+		r.index++
+		r.offset = 0
 	}
-
-	return builder.String()
+	return 0, io.EOF
 }
 
-// DecryptAES256 decrypts data that was encrypted with AES-256
-func DecryptAES256(encryptedHex string) ([]byte, error) {
+// decryptPayload reads the salt in front of a transfer's payload, derives
+// the transfer's key from it and decrypts the stream that follows into dst
+func decryptPayload(dst io.Writer, src io.Reader, transfer *FileTransfer) error {
+	sharedKey, ok := keyring.Key(transfer.KeyID)
+	if !ok {
+		return fmt.Errorf("key %q is no longer in the keyring", transfer.KeyID)
+	}
+	salt := make([]byte, protocol.PayloadSaltSize)
+	if _, err := io.ReadFull(src, salt); err != nil {
+		return fmt.Errorf("ciphertext too short")
+	}
+	return decryptStream(dst, src, protocol.DerivePayloadKey(sharedKey, salt, transfer.ID))
+}
 
-	// Convert the hex string to bytes
-	encryptedData, err := hex.DecodeString(encryptedHex)
+// ProcessCompletedTransfer verifies, decrypts and stores a transfer in a
+// single streaming pass over its chunks: the hex stream is hashed, decoded
+// and decrypted segment by segment straight into the output store, so peak
+// memory does not grow with the file. The output is only committed once the
+// full checksum matches and every segment authenticated.
+// Canaries are verified instead of stored and a proof is returned for them.
+// The transfer must be in the verifying state; on success it is completed
+// and its chunk data released.
+func ProcessCompletedTransfer(transfer *FileTransfer, expectedChecksum string) (*StoredFile, *CanaryProof, error) {
+	pending, err := outputStore.Create(transfer.ID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode hex: %v", err)
+		return nil, nil, fmt.Errorf("error storing file: %v", err)
 	}
 
-	// Convert string key to 32-byte key using SHA-256
 	hasher := sha256.New()
-	hasher.Write([]byte(encryptionKey)) // Sử dụng biến global
-	key := hasher.Sum(nil)
-
-	// Phần còn lại giữ nguyên
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	plainHasher := sha256.New()
+	sink := &payloadSink{out: pending, engagement: transfer.Engagement}
+	source := io.TeeReader(&chunkReader{transfer: transfer}, hasher)
+	decryptErr := decryptPayload(io.MultiWriter(plainHasher, sink), hex.NewDecoder(source), transfer)
+	if decryptErr == nil {
+		decryptErr = sink.Close()
 	}
 
-	// Create GCM mode which provides authenticated encryption
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	// Hash whatever decryption did not consume before comparing checksums
+	if _, err := io.Copy(io.Discard, source); err != nil {
+		pending.Abort()
+		return nil, nil, fmt.Errorf("error reading chunks: %w", err)
 	}
 
-	// The nonce is at the beginning of the ciphertext
-	nonceSize := gcm.NonceSize()
-	if len(encryptedData) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
+	actualChecksum := hex.EncodeToString(hasher.Sum(nil))
+	if verboseMode {
+		log.Printf("DEBUG: Calculated checksum: %s, expected: %s", actualChecksum, expectedChecksum)
 	}
-
-	nonce, ciphertext := encryptedData[:nonceSize], encryptedData[nonceSize:]
-
-	// Decrypt and authenticate data
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	if actualChecksum != expectedChecksum {
+		pending.Abort()
+		return nil, nil, errChecksumMismatch
 	}
-
-	return plaintext, nil
-}
-
-// ProcessCompletedTransfer handles a completed transfer, decrypts the data and saves to a file
-func ProcessCompletedTransfer(transferID string) (string, error) {
-	transfersMutex.RLock()
-	transfer, exists := transfers[transferID]
-	transfersMutex.RUnlock()
-
-	if !exists {
-		return "", fmt.Errorf("transfer not found: %s", transferID)
+	if errors.Is(decryptErr, errCanaryInvalid) {
+		pending.Abort()
+		return nil, nil, decryptErr
 	}
-
-	// Concatenate all chunks
-	hexData := ConcatenateChunks(transfer)
-
-	// Decrypt the data
-	outputData, err := DecryptAES256(hexData)
-	if err != nil {
-		return "", fmt.Errorf("error decrypting data: %v", err)
+	if decryptErr != nil {
+		pending.Abort()
+		return nil, nil, fmt.Errorf("%w: %v", errDecryption, decryptErr)
 	}
 
 	if verboseMode {
-		log.Printf("Successfully decrypted data for transfer %s", transferID)
+		log.Printf("Successfully decrypted data for transfer %s", transfer.ID)
 	}
 
-	// Create output directory if it doesn't exist
-	outputDir := "received_files"
-	os.MkdirAll(outputDir, 0755)
+	// Keep the result and complete the transfer in one step, unless a
+	// shutdown interrupted it in the meantime. Once completed, a shutdown
+	// leaves it alone.
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	if transfer.interrupted.Load() {
+		pending.Abort()
+		return nil, nil, errInterrupted
+	}
 
-	// Use the original filename if available, fallback to transfer ID if not
-	var outputFilename string
-	if transfer.Filename != "" {
-		outputFilename = transfer.Filename
+	// A canary only proves the path; nothing of it is kept
+	var stored *StoredFile
+	var proof *CanaryProof
+	if sink.IsCanary() {
+		pending.Abort()
+		header := sink.canary.Header
+		proof = &CanaryProof{
+			TransferID:   transfer.ID,
+			EngagementID: header.EngagementID,
+			Nonce:        header.Nonce,
+			Size:         header.Size,
+			SHA256:       hex.EncodeToString(plainHasher.Sum(nil)),
+			Source:       transfer.Source,
+			Initialised:  transfer.Created,
+			VerifiedAt:   time.Now(),
+		}
+		path, err := outputStore.RecordCanary(proof)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error recording canary: %v", err)
+		}
+		log.Printf("Verified canary %s for engagement %s from %s: %d bytes, proof recorded in %s",
+			transfer.ID, proof.EngagementID, proof.Source, proof.Size, path)
 	} else {
-		outputFilename = transfer.ID + ".bin"
+		// Move the output to its content-addressed name
+		stored, err = pending.Commit(StoredFile{
+			OriginalName:     transfer.Filename,
+			Engagement:       transfer.Engagement,
+			Source:           transfer.Source,
+			CiphertextSHA256: actualChecksum,
+			InitialisedAt:    transfer.Created,
+			sealedName:       transfer.SealedFilename,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("error storing file: %v", err)
+		}
+		if stored.Encryption != "" {
+			log.Printf("Processed transfer %s: saved %d encrypted bytes to %s", transfer.ID, stored.StoredSize, stored.Path)
+		} else {
+			log.Printf("Processed transfer %s: saved %d bytes to %s (original name: %q)",
+				transfer.ID, stored.Size, stored.Path, stored.OriginalName)
+		}
 	}
 
-	// Create output file
-	outputPath := filepath.Join(outputDir, outputFilename)
-	err = os.WriteFile(outputPath, outputData, 0644)
-	if err != nil {
-		return "", fmt.Errorf("error writing file: %v", err)
+	// Mark the transfer completed and release its chunk data
+	transfer.Checksum = expectedChecksum
+	transfer.transition(StateCompleted)
+	releaseTransferMemory(transfer)
+	transfer.Chunks = nil
+	persistState(transfer)
+	if err := journal.DropChunks(transfer.ID); err != nil {
+		log.Printf("Warning: %v", err)
 	}
-
-	log.Printf("Processed transfer %s: saved %d bytes to %s",
-		transfer.ID, len(outputData), outputPath)
-
-	return outputPath, nil
+	return stored, proof, nil
 }
 
 // CleanupTransfer removes a transfer from memory
 func CleanupTransfer(transferID string) {
 	transfersMutex.Lock()
-	delete(transfers, transferID)
+	if transfer, exists := transfers[transferID]; exists {
+		transfer.mu.Lock()
+		auditCleanup(transfer, transfer.State, "removed")
+		releaseTransferMemory(transfer)
+		transfer.mu.Unlock()
+		delete(transfers, transferID)
+	}
 	transfersMutex.Unlock()
 
+	if err := journal.Remove(transferID); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
 	if verboseMode {
 		log.Printf("Cleaned up transfer %s", transferID)
 	}
 }
 
-// ScheduleCleanup removes old transfers that haven't been completed
+// ScheduleCleanup expires and removes transfers that have been idle for longer
+// than the retention period, including finished ones kept for duplicate detection
 func ScheduleCleanup() {
 	// This could run in a goroutine on a timer
+	now := time.Now()
+	var expired []string
+
 	transfersMutex.Lock()
-	defer transfersMutex.Unlock()
+	for id, transfer := range transfers {
+		transfer.mu.Lock()
 
-	now := time.Now()
-	timeout := 30 * time.Minute
+		// Remove transfers that haven't been updated within the retention period.
+		// Transfers being verified are left to finish.
+		previousState := transfer.State
+		if now.Sub(transfer.LastUpdated) <= transferRetention || transfer.transition(StateExpired) != nil {
+			transfer.mu.Unlock()
+			continue
+		}
+
+		auditCleanup(transfer, previousState, "expired")
+		releaseTransferMemory(transfer)
+		transfer.mu.Unlock()
+
+		delete(transfers, id)
+		expired = append(expired, id)
+		log.Printf("Auto-cleaned up stale transfer %s (file: %s, state: %s)",
+			id, recordedName(transfer.Filename), previousState)
+	}
 
+	tracked := make(map[string]*FileTransfer, len(transfers))
 	for id, transfer := range transfers {
-		// Remove transfers that haven't been updated in 30 minutes
-		if now.Sub(transfer.LastUpdated) > timeout {
-			delete(transfers, id)
-			log.Printf("Auto-cleaned up stale transfer %s (file: %s)",
-				id, transfer.Filename)
+		tracked[id] = transfer
+	}
+	transfersMutex.Unlock()
+	metrics.transferEvictions.Add(int64(len(expired)))
+
+	// Disk cleanup happens outside the global lock
+	for _, id := range expired {
+		if err := journal.Remove(id); err != nil {
+			log.Printf("Warning: %v", err)
 		}
 	}
+
+	// Journal entries left behind without an in-memory transfer
+	journal.PruneStale(now, transferRetention, tracked)
+
+	// Rate accounting for sources that have gone quiet
+	pruneSources(now)
+
+	// Received files past their retention
+	deleted, err := ApplyRetention(now)
+	if err != nil {
+		log.Printf("ERROR: Failed to apply retention policy: %v", err)
+	}
+	metrics.outputEvictions.Add(int64(len(deleted)))
+}
+
+// ReplayJournal restores the transfers recorded in the journal, typically
+// at startup. Transfers that were interrupted while being verified are
+// marked as failed, since their completion cannot be resumed.
+func ReplayJournal() error {
+	loaded, err := journal.Load()
+	if err != nil {
+		return err
+	}
+
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+
+	for _, transfer := range loaded {
+		if _, exists := transfers[transfer.ID]; exists {
+			continue
+		}
+
+		switch transfer.State {
+		case StateExpired:
+			if err := journal.Remove(transfer.ID); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			continue
+		case StateVerifying:
+			log.Printf("Transfer %s was interrupted during verification, marking failed", transfer.ID)
+			transfer.transition(StateFailed)
+			persistState(transfer)
+			fallthrough
+		case StateCompleted, StateFailed:
+			// Only the record is kept for duplicate detection
+			transfer.Chunks = nil
+			transfer.BufferedBytes = 0
+			if err := journal.DropChunks(transfer.ID); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+
+		transfers[transfer.ID] = transfer
+		bufferedBytes.Add(int64(transfer.BufferedBytes))
+	}
+
+	if len(loaded) > 0 {
+		log.Printf("Replayed %d transfers from journal (%d bytes of chunk data)",
+			len(loaded), bufferedBytes.Load())
+	}
+	if bufferedBytes.Load() > limits.MemoryBudget {
+		log.Printf("Warning: replayed chunk data exceeds the memory budget of %d bytes",
+			limits.MemoryBudget)
+	}
+	return nil
+}
+
+// persistState records the current state of a transfer in the journal.
+// Failures are logged; the in-memory state stays authoritative.
+func persistState(transfer *FileTransfer) {
+	if err := journal.RecordState(transfer); err != nil {
+		log.Printf("Warning: failed to journal state of transfer %s: %v", transfer.ID, err)
+	}
 }
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Error codes returned when a request is rejected by a resource limit
+const (
+	ErrCodeFileTooLarge         = "file_too_large"
+	ErrCodeTooManyChunks        = "too_many_chunks"
+	ErrCodeTooManyTransfers     = "too_many_transfers"
+	ErrCodeMemoryBudgetExceeded = "memory_budget_exceeded"
+	ErrCodeChunkIndexOutOfRange = "chunk_index_out_of_range"
+	ErrCodeTransferSizeExceeded = "transfer_size_exceeded"
+)
+
+// Limits bounds the resources the receiver commits to transfers.
+// Sizes are measured in bytes of hex-encoded data as sent on the wire.
+type Limits struct {
+	MaxFileSize            int   `json:"max_file_size"`
+	MaxChunks              int   `json:"max_chunks"`
+	MaxConcurrentTransfers int   `json:"max_concurrent_transfers"`
+	MemoryBudget           int64 `json:"memory_budget"`
+}
+
+// DefaultLimits returns the limits used when none are configured
+func DefaultLimits() Limits {
+	return Limits{
+		MaxFileSize:            256 << 20,
+		MaxChunks:              200000,
+		MaxConcurrentTransfers: 16,
+		MemoryBudget:           512 << 20,
+	}
+}
+
+// Validate checks that every limit is positive
+func (l Limits) Validate() error {
+	if l.MaxFileSize <= 0 || l.MaxChunks <= 0 || l.MaxConcurrentTransfers <= 0 || l.MemoryBudget <= 0 {
+		return fmt.Errorf("all limits must be positive: %+v", l)
+	}
+	return nil
+}
+
+// Active limits and the number of chunk bytes currently held in memory
+var (
+	limits        = DefaultLimits()
+	bufferedBytes atomic.Int64
+)
+
+// SetLimits replaces the active resource limits. It must be called before
+// the server starts handling requests.
+func SetLimits(l Limits) {
+	transfersMutex.Lock()
+	limits = l
+	transfersMutex.Unlock()
+}
+
+// checkInitLimits checks the sizes announced by an init request against the limits
+func checkInitLimits(totalChunks, fileSize int) *RequestError {
+	if fileSize > limits.MaxFileSize {
+		return newRequestError(http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge,
+			"file size %d exceeds limit of %d", fileSize, limits.MaxFileSize)
+	}
+	if totalChunks > limits.MaxChunks {
+		return newRequestError(http.StatusRequestEntityTooLarge, ErrCodeTooManyChunks,
+			"chunk count %d exceeds limit of %d", totalChunks, limits.MaxChunks)
+	}
+	return nil
+}
+
+// checkChunkLimits validates a chunk against its transfer. delta is the
+// change in buffered bytes if the chunk is stored.
+// The caller must hold transfer.mu.
+func checkChunkLimits(transfer *FileTransfer, chunkIndex int, delta int) *RequestError {
+	if chunkIndex < 0 || chunkIndex >= transfer.TotalChunks {
+		return newRequestError(http.StatusBadRequest, ErrCodeChunkIndexOutOfRange,
+			"chunk index %d outside [0, %d)", chunkIndex, transfer.TotalChunks)
+	}
+	if transfer.BufferedBytes+delta > transfer.FileSize {
+		return newRequestError(http.StatusRequestEntityTooLarge, ErrCodeTransferSizeExceeded,
+			"chunk data exceeds announced file size of %d", transfer.FileSize)
+	}
+	return nil
+}
+
+// reserveMemory takes delta bytes from the global memory budget, failing
+// if the budget would be exceeded. A negative delta always succeeds.
+func reserveMemory(delta int) *RequestError {
+	for {
+		current := bufferedBytes.Load()
+		next := current + int64(delta)
+		if delta > 0 && next > limits.MemoryBudget {
+			return newRequestError(http.StatusServiceUnavailable, ErrCodeMemoryBudgetExceeded,
+				"receiver memory budget of %d bytes exhausted", limits.MemoryBudget)
+		}
+		if bufferedBytes.CompareAndSwap(current, next) {
+			return nil
+		}
+	}
+}
+
+// releaseTransferMemory returns a transfer's buffered bytes to the budget.
+// The caller must hold transfer.mu.
+func releaseTransferMemory(transfer *FileTransfer) {
+	bufferedBytes.Add(-int64(transfer.BufferedBytes))
+	transfer.BufferedBytes = 0
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"protocol"
+)
+
+const testTransferID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// testManifest is an engagement that is current and allows 1 MiB
+func testManifest() *protocol.Manifest {
+	return &protocol.Manifest{
+		EngagementID:  "test-engagement",
+		AllowedURLs:   []string{"http://127.0.0.1"},
+		NotBefore:     time.Now().Add(-time.Hour),
+		NotAfter:      time.Now().Add(time.Hour),
+		MaxTotalBytes: 1 << 20,
+	}
+}
+
+// resetState clears all transfers and installs the given limits
+func resetState(t *testing.T, l Limits) {
+	t.Helper()
+	transfersMutex.Lock()
+	transfers = make(map[string]*FileTransfer)
+	bufferedBytes.Store(0)
+	limits = l
+	transfersMutex.Unlock()
+	SetOutputDir(t.TempDir())
+	SetEncryptionKey("test-key")
+	SetManifest(testManifest())
+	SetSourcePolicy(SourcePolicy{})
+	SetOutputPublicKey(nil)
+}
+
+// versioned inserts the protocol version into an "action/transferID/..." path
+func versioned(path string) string {
+	action, rest, _ := strings.Cut(path, "/")
+	return fmt.Sprintf("%s/v%d/%s", action, protocol.Version, rest)
+}
+
+// signWith signs an "action/transferID/..." path under sharedKey
+func signWith(sharedKey, path string) string {
+	transferID := strings.Split(path, "/")[1]
+	return protocol.Sign(versioned(path), protocol.DeriveMACKey(sharedKey, transferID))
+}
+
+// doRequest signs path with the test key, sends it through HandleRequest
+// and returns the recorded response
+func doRequest(path string) *httptest.ResponseRecorder {
+	return doRawRequest(signWith("test-key", path) + protocol.URLSuffix)
+}
+
+// doRawRequest sends path through HandleRequest as it is
+func doRawRequest(path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/"+path, nil)
+	rec := httptest.NewRecorder()
+	HandleRequest(rec, req)
+	return rec
+}
+
+// chunkPath builds a valid chunk request for data
+func chunkPath(transferID string, index int, data string) string {
+	return fmt.Sprintf("chunk/%s/%d/%s/%s", transferID, index, calculateSHA256(data), data)
+}
+
+// expectCode checks the status and code of a response and returns it
+func expectCode(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) Response {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("status = %d, want %d (body %q)", rec.Code, status, rec.Body.String())
+	}
+	var resp Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v (body %q)", err, rec.Body.String())
+	}
+	if resp.Code != code {
+		t.Errorf("code = %q, want %q (message %q)", resp.Code, code, resp.Message)
+	}
+	return resp
+}
+
+func TestInitRejectsFileTooLarge(t *testing.T) {
+	l := DefaultLimits()
+	l.MaxFileSize = 100
+	resetState(t, l)
+
+	rec := doRequest(fmt.Sprintf("init/%s/1/101/test-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusRequestEntityTooLarge, ErrCodeFileTooLarge)
+
+	if rec := doRequest(fmt.Sprintf("init/%s/1/100/test-engagement/a.txt", testTransferID)); rec.Code != http.StatusOK {
+		t.Errorf("init at the limit failed: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestInitRejectsTooManyChunks(t *testing.T) {
+	l := DefaultLimits()
+	l.MaxChunks = 10
+	resetState(t, l)
+
+	rec := doRequest(fmt.Sprintf("init/%s/11/100/test-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusRequestEntityTooLarge, ErrCodeTooManyChunks)
+}
+
+func TestInitRejectsInvalidSizes(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	rec := doRequest(fmt.Sprintf("init/%s/0/100/test-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusBadRequest, ErrCodeInvalidTotalChunks)
+
+	rec = doRequest(fmt.Sprintf("init/%s/-3/100/test-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusBadRequest, ErrCodeInvalidTotalChunks)
+
+	rec = doRequest(fmt.Sprintf("init/%s/1/-1/test-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusBadRequest, ErrCodeInvalidFileSize)
+}
+
+func TestInitRejectsTooManyTransfers(t *testing.T) {
+	l := DefaultLimits()
+	l.MaxConcurrentTransfers = 2
+	resetState(t, l)
+
+	for i := 0; i < 2; i++ {
+		id := fmt.Sprintf("%064x", i)
+		if rec := doRequest(fmt.Sprintf("init/%s/1/10/test-engagement/a.txt", id)); rec.Code != http.StatusOK {
+			t.Fatalf("init %d failed: %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := doRequest(fmt.Sprintf("init/%064x/1/10/test-engagement/a.txt", 2))
+	expectCode(t, rec, http.StatusServiceUnavailable, ErrCodeTooManyTransfers)
+
+	// Freeing a slot lets the next transfer in
+	CleanupTransfer(fmt.Sprintf("%064x", 0))
+	if rec := doRequest(fmt.Sprintf("init/%064x/1/10/test-engagement/a.txt", 2)); rec.Code != http.StatusOK {
+		t.Errorf("init after cleanup failed: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestChunkRejectsIndexOutOfRange(t *testing.T) {
+	resetState(t, DefaultLimits())
+	doRequest(fmt.Sprintf("init/%s/2/100/test-engagement/a.txt", testTransferID))
+
+	for _, index := range []int{2, 1000} {
+		rec := doRequest(chunkPath(testTransferID, index, "abcd"))
+		expectCode(t, rec, http.StatusBadRequest, ErrCodeChunkIndexOutOfRange)
+	}
+
+	// Negative indices never decode
+	rec := doRequest(chunkPath(testTransferID, -1, "abcd"))
+	expectCode(t, rec, http.StatusBadRequest, ErrCodeInvalidChunkIndex)
+}
+
+func TestChunkRejectsDataBeyondFileSize(t *testing.T) {
+	resetState(t, DefaultLimits())
+	doRequest(fmt.Sprintf("init/%s/2/6/test-engagement/a.txt", testTransferID))
+
+	if rec := doRequest(chunkPath(testTransferID, 0, "abcd")); rec.Code != http.StatusOK {
+		t.Fatalf("first chunk failed: %d %q", rec.Code, rec.Body.String())
+	}
+	rec := doRequest(chunkPath(testTransferID, 1, "abcd"))
+	expectCode(t, rec, http.StatusRequestEntityTooLarge, ErrCodeTransferSizeExceeded)
+}
+
+func TestChunkRejectsMemoryBudgetExceeded(t *testing.T) {
+	l := DefaultLimits()
+	l.MemoryBudget = 10
+	resetState(t, l)
+
+	idA := fmt.Sprintf("%064x", 1)
+	idB := fmt.Sprintf("%064x", 2)
+	doRequest(fmt.Sprintf("init/%s/2/100/test-engagement/a.txt", idA))
+	doRequest(fmt.Sprintf("init/%s/2/100/test-engagement/b.txt", idB))
+
+	if rec := doRequest(chunkPath(idA, 0, "abcdef")); rec.Code != http.StatusOK {
+		t.Fatalf("first chunk failed: %d %q", rec.Code, rec.Body.String())
+	}
+	rec := doRequest(chunkPath(idB, 0, "abcdef"))
+	expectCode(t, rec, http.StatusServiceUnavailable, ErrCodeMemoryBudgetExceeded)
+
+	// Resending a chunk of the same size does not consume more budget
+	if rec := doRequest(chunkPath(idA, 0, "abcdef")); rec.Code != http.StatusOK {
+		t.Errorf("retransmitted chunk failed: %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Cleaning up a transfer returns its bytes to the budget
+	CleanupTransfer(idA)
+	if rec := doRequest(chunkPath(idB, 0, "abcdef")); rec.Code != http.StatusOK {
+		t.Errorf("chunk after cleanup failed: %d %q", rec.Code, rec.Body.String())
+	}
+}
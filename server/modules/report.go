@@ -0,0 +1,374 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TransferSummary is the outcome of one transfer as told by the audit log
+type TransferSummary struct {
+	TransferID     string        `json:"transfer_id"`
+	Engagement     string        `json:"engagement"`
+	Sources        []string      `json:"sources"`
+	Filename       string        `json:"filename"`
+	Outcome        TransferState `json:"outcome"`
+	Canary         bool          `json:"canary,omitempty"`
+	TotalChunks    int           `json:"total_chunks"`
+	ChunksReceived int           `json:"chunks_received"`
+	ChunkRequests  int           `json:"chunk_requests"`
+	DeclaredBytes  int64         `json:"declared_bytes"`
+	ReceivedBytes  int64         `json:"received_bytes"`
+	Checksum       string        `json:"checksum,omitempty"`
+	StoredSHA256   string        `json:"stored_sha256,omitempty"`
+	StoredSize     int64         `json:"stored_size,omitempty"`
+	Rejections     int           `json:"rejections"`
+	Initialised    time.Time     `json:"initialised"`
+	Finished       *time.Time    `json:"finished,omitempty"`
+
+	chunks map[int]int
+}
+
+// RejectionSummary counts rejected requests with one code
+type RejectionSummary struct {
+	Code    string   `json:"code"`
+	Count   int      `json:"count"`
+	Sources []string `json:"sources"`
+}
+
+// EngagementReport summarises an audit log for the engagement deliverable
+type EngagementReport struct {
+	Engagement    string             `json:"engagement,omitempty"`
+	GeneratedAt   time.Time          `json:"generated_at"`
+	FirstEvent    time.Time          `json:"first_event"`
+	LastEvent     time.Time          `json:"last_event"`
+	Sources       []string           `json:"sources"`
+	Transfers     []*TransferSummary `json:"transfers"`
+	Completed     int                `json:"completed"`
+	Canaries      int                `json:"canaries"`
+	Failed        int                `json:"failed"`
+	Expired       int                `json:"expired"`
+	StoredBytes   int64              `json:"stored_bytes"`
+	ReceivedBytes int64              `json:"received_bytes"`
+	Rejections    []RejectionSummary `json:"rejections"`
+}
+
+// BuildReport summarises audit records. With a non-empty engagement only
+// its transfers, and rejections that cannot be tied to another engagement,
+// are included.
+func BuildReport(records []AuditRecord, engagementID string, now time.Time) *EngagementReport {
+	report := &EngagementReport{Engagement: engagementID, GeneratedAt: now.UTC()}
+	byID := make(map[string]*TransferSummary)
+	sources := make(map[string]bool)
+	rejections := make(map[string]*RejectionSummary)
+
+	for _, rec := range records {
+		summary := byID[rec.TransferID]
+		if rec.Event == AuditInit && summary == nil {
+			summary = &TransferSummary{
+				TransferID:    rec.TransferID,
+				Engagement:    rec.Engagement,
+				Filename:      rec.Filename,
+				Outcome:       StateInitialised,
+				TotalChunks:   rec.TotalChunks,
+				DeclaredBytes: rec.Bytes,
+				Initialised:   rec.Time,
+				chunks:        make(map[int]int),
+			}
+			byID[rec.TransferID] = summary
+			report.Transfers = append(report.Transfers, summary)
+		}
+
+		engagement := rec.Engagement
+		if summary != nil {
+			engagement = summary.Engagement
+		}
+		if engagementID != "" && engagement != "" && engagement != engagementID {
+			continue
+		}
+
+		if report.FirstEvent.IsZero() || rec.Time.Before(report.FirstEvent) {
+			report.FirstEvent = rec.Time
+		}
+		if rec.Time.After(report.LastEvent) {
+			report.LastEvent = rec.Time
+		}
+		if rec.Source != "" {
+			sources[sourceHost(rec.Source)] = true
+		}
+
+		if rec.Event == AuditReject {
+			r := rejections[rec.Code]
+			if r == nil {
+				r = &RejectionSummary{Code: rec.Code}
+				rejections[rec.Code] = r
+			}
+			r.Count += max(rec.Count, 1)
+			if rec.Source != "" && !containsString(r.Sources, sourceHost(rec.Source)) {
+				r.Sources = append(r.Sources, sourceHost(rec.Source))
+			}
+			if summary != nil {
+				summary.Rejections++
+				// A complete request rejected in processing fails its transfer
+				if rec.State == StateFailed && summary.Outcome != StateCompleted {
+					summary.Outcome = StateFailed
+					finished := rec.Time
+					summary.Finished = &finished
+				}
+			}
+			continue
+		}
+		if summary == nil {
+			continue
+		}
+
+		if rec.Source != "" && !containsString(summary.Sources, sourceHost(rec.Source)) {
+			summary.Sources = append(summary.Sources, sourceHost(rec.Source))
+		}
+		switch rec.Event {
+		case AuditChunk:
+			summary.ChunkRequests++
+			if rec.ChunkIndex != nil {
+				summary.chunks[*rec.ChunkIndex] = rec.ChunkBytes
+			}
+			if summary.Outcome == StateInitialised {
+				summary.Outcome = StateReceiving
+			}
+		case AuditComplete:
+			summary.Outcome = StateCompleted
+			summary.Canary = rec.Canary
+			summary.Checksum = rec.Checksum
+			summary.StoredSHA256 = rec.StoredSHA256
+			summary.StoredSize = rec.StoredSize
+			finished := rec.Time
+			summary.Finished = &finished
+		case AuditShutdown:
+			// Transfers failed by a shutdown end here; others resume
+			if rec.State == StateFailed && summary.Outcome != StateCompleted {
+				summary.Outcome = StateFailed
+				finished := rec.Time
+				summary.Finished = &finished
+			}
+		case AuditCleanup:
+			// Cleaning up a finished transfer does not change its outcome
+			if rec.State.IsActive() {
+				summary.Outcome = StateExpired
+				finished := rec.Time
+				summary.Finished = &finished
+			}
+		}
+	}
+
+	kept := report.Transfers[:0]
+	for _, summary := range report.Transfers {
+		if engagementID != "" && summary.Engagement != engagementID {
+			continue
+		}
+		summary.ChunksReceived = len(summary.chunks)
+		for _, n := range summary.chunks {
+			summary.ReceivedBytes += int64(n)
+		}
+		sort.Strings(summary.Sources)
+		report.ReceivedBytes += summary.ReceivedBytes
+
+		switch summary.Outcome {
+		case StateCompleted:
+			if summary.Canary {
+				report.Canaries++
+			} else {
+				report.Completed++
+				report.StoredBytes += summary.StoredSize
+			}
+		case StateFailed:
+			report.Failed++
+		case StateExpired:
+			report.Expired++
+		}
+		kept = append(kept, summary)
+	}
+	report.Transfers = kept
+
+	for source := range sources {
+		report.Sources = append(report.Sources, source)
+	}
+	sort.Strings(report.Sources)
+	for _, r := range rejections {
+		sort.Strings(r.Sources)
+		report.Rejections = append(report.Rejections, *r)
+	}
+	sort.Slice(report.Rejections, func(i, j int) bool {
+		if report.Rejections[i].Count != report.Rejections[j].Count {
+			return report.Rejections[i].Count > report.Rejections[j].Count
+		}
+		return report.Rejections[i].Code < report.Rejections[j].Code
+	})
+	return report
+}
+
+// sourceHost strips the port from a remote address
+func sourceHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *EngagementReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteMarkdown writes the report as a Markdown document
+func (r *EngagementReport) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	title := "Exfiltration test report"
+	if r.Engagement != "" {
+		title += ": " + r.Engagement
+	}
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	fmt.Fprintf(&b, "Generated %s from the receiver audit log.\n\n", r.GeneratedAt.Format(time.RFC3339))
+
+	b.WriteString("## Summary\n\n")
+	b.WriteString("| | |\n|---|---|\n")
+	if !r.FirstEvent.IsZero() {
+		fmt.Fprintf(&b, "| Activity | %s to %s |\n", r.FirstEvent.Format(time.RFC3339), r.LastEvent.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "| Source addresses | %s |\n", markdownList(r.Sources))
+	fmt.Fprintf(&b, "| Transfers | %d |\n", len(r.Transfers))
+	fmt.Fprintf(&b, "| Completed | %d (%d bytes stored) |\n", r.Completed, r.StoredBytes)
+	fmt.Fprintf(&b, "| Canaries verified | %d |\n", r.Canaries)
+	fmt.Fprintf(&b, "| Failed | %d |\n", r.Failed)
+	fmt.Fprintf(&b, "| Expired | %d |\n", r.Expired)
+	fmt.Fprintf(&b, "| Encrypted bytes received | %d |\n", r.ReceivedBytes)
+	rejected := 0
+	for _, rej := range r.Rejections {
+		rejected += rej.Count
+	}
+	fmt.Fprintf(&b, "| Rejected requests | %d |\n\n", rejected)
+
+	b.WriteString("## Transfers\n\n")
+	if len(r.Transfers) == 0 {
+		b.WriteString("No transfers were recorded.\n\n")
+	} else {
+		b.WriteString("| Transfer | Source | File | Outcome | Chunks | Bytes received | Initialised | Finished | Stored SHA-256 |\n")
+		b.WriteString("|---|---|---|---|---|---|---|---|---|\n")
+		for _, t := range r.Transfers {
+			outcome := string(t.Outcome)
+			if t.Canary {
+				outcome += " (canary)"
+			}
+			finished := "-"
+			if t.Finished != nil {
+				finished = t.Finished.Format(time.RFC3339)
+			}
+			stored := "-"
+			if t.StoredSHA256 != "" {
+				stored = "`" + t.StoredSHA256 + "`"
+			}
+			fmt.Fprintf(&b, "| `%s` | %s | %s | %s | %d/%d | %d of %d | %s | %s | %s |\n",
+				t.TransferID[:16], markdownList(t.Sources), markdownEscape(t.Filename), outcome,
+				t.ChunksReceived, t.TotalChunks, t.ReceivedBytes, t.DeclaredBytes,
+				t.Initialised.Format(time.RFC3339), finished, stored)
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("## Rejected requests\n\n")
+	if len(r.Rejections) == 0 {
+		b.WriteString("No requests were rejected.\n")
+	} else {
+		b.WriteString("| Code | Count | Sources |\n|---|---|---|\n")
+		for _, rej := range r.Rejections {
+			fmt.Fprintf(&b, "| %s | %d | %s |\n", rej.Code, rej.Count, markdownList(rej.Sources))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// markdownList joins values for a table cell
+func markdownList(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	escaped := make([]string, len(values))
+	for i, v := range values {
+		escaped[i] = markdownEscape(v)
+	}
+	return strings.Join(escaped, ", ")
+}
+
+// markdownEscape keeps a value from breaking out of a table cell
+func markdownEscape(s string) string {
+	return strings.NewReplacer(`|`, `\|`, "`", "\\`", "\n", " ").Replace(s)
+}
+
+// RunReportCommand implements the "report" subcommand:
+//
+//	report [-output <dir> | -audit-log <file>] [-engagement <id>] [-format markdown|json] [-out <file>]
+func RunReportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	outputDir := fs.String("output", DefaultConfig().OutputDir, "Output root directory holding audit.jsonl")
+	auditPath := fs.String("audit-log", "", "Audit log to read (default <output>/audit.jsonl)")
+	engagementID := fs.String("engagement", "", "Only report on this engagement")
+	format := fs.String("format", "markdown", "Report format: markdown or json")
+	out := fs.String("out", "", "Write the report to this file instead of standard output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "markdown" && *format != "json" {
+		return fmt.Errorf("unknown report format %q", *format)
+	}
+	if *auditPath == "" {
+		*auditPath = filepath.Join(*outputDir, AuditLogName)
+	}
+
+	f, err := os.Open(*auditPath)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %v", err)
+	}
+	records, err := ReadAuditLog(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	report := BuildReport(records, *engagementID, time.Now())
+	write := report.WriteMarkdown
+	if *format == "json" {
+		write = report.WriteJSON
+	}
+	if *out == "" {
+		return write(os.Stdout)
+	}
+
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating report: %v", err)
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	return file.Close()
+}
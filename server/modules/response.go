@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"protocol"
+)
+
+// Codes returned in successful responses
+const (
+	CodeTransferInitialised = "transfer_initialised"
+	CodeChunkReceived       = "chunk_received"
+	CodeTransferCompleted   = "transfer_completed"
+)
+
+// Error codes for requests that cannot be decoded, shared with the protocol
+// package so the client sees the same codes
+const (
+	ErrCodeInvalidRequest     = protocol.CodeInvalidRequest
+	ErrCodeUnknownAction      = protocol.CodeUnknownAction
+	ErrCodeUnsupportedVersion = protocol.CodeUnsupportedVersion
+	ErrCodeInvalidTransferID  = protocol.CodeInvalidTransferID
+	ErrCodeInvalidTotalChunks = protocol.CodeInvalidTotalChunks
+	ErrCodeInvalidFileSize    = protocol.CodeInvalidFileSize
+	ErrCodeInvalidChunkIndex  = protocol.CodeInvalidChunkIndex
+	ErrCodeUnauthenticated    = "unauthenticated"
+)
+
+// Error codes for protocol misuse
+const (
+	ErrCodeChecksumMismatch     = "checksum_mismatch"
+	ErrCodeTransferNotFound     = "transfer_not_found"
+	ErrCodeTransferExists       = "transfer_exists"
+	ErrCodeInvalidState         = "invalid_state"
+	ErrCodeMissingChunks        = "missing_chunks"
+	ErrCodeFullChecksumMismatch = "full_checksum_mismatch"
+	ErrCodeDecryptionFailed     = "decryption_failed"
+	ErrCodeProcessingFailed     = "processing_failed"
+	ErrCodeJournalFailed        = "journal_failed"
+	ErrCodeShuttingDown         = "shutting_down"
+)
+
+// Response is the JSON body of every reply from the receiver
+type Response struct {
+	OK         bool          `json:"ok"`
+	Code       string        `json:"code"`
+	Message    string        `json:"message,omitempty"`
+	TransferID string        `json:"transfer_id,omitempty"`
+	State      TransferState `json:"state,omitempty"`
+	Received   int           `json:"received,omitempty"`
+	Total      int           `json:"total,omitempty"`
+}
+
+// RequestError is a rejected request with a machine-readable code
+type RequestError struct {
+	Status  int
+	Code    string
+	Message string
+	State   TransferState
+}
+
+// Error implements the error interface
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// newRequestError builds a RequestError with a formatted message
+func newRequestError(status int, code string, format string, args ...interface{}) *RequestError {
+	return &RequestError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeJSON sends resp with the given HTTP status
+func writeJSON(w http.ResponseWriter, status int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil && verboseMode {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// writeError sends a RequestError to the client and records the rejection
+func writeError(w http.ResponseWriter, r *http.Request, transferID string, e *RequestError) {
+	auditReject(r, transferID, e)
+	respondError(w, transferID, e)
+}
+
+// respondError sends a RequestError to the client without recording it
+func respondError(w http.ResponseWriter, transferID string, e *RequestError) {
+	if verboseMode {
+		log.Printf("Rejected request for transfer %q: %v", transferID, e)
+	}
+	writeJSON(w, e.Status, Response{
+		OK:         false,
+		Code:       e.Code,
+		Message:    e.Message,
+		TransferID: transferID,
+		State:      e.State,
+	})
+}
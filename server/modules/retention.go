@@ -0,0 +1,359 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"protocol"
+)
+
+// Reasons recorded for deleted outputs
+const (
+	DeleteReasonMaxAge   = "max_age"
+	DeleteReasonMaxTotal = "max_total_bytes"
+	DeleteReasonPurge    = "purge"
+)
+
+// DeletionManifestName is the deletion manifest's file name below the
+// output root
+const DeletionManifestName = "deletions.jsonl"
+
+// RetentionPolicy bounds how long and how much received output is kept.
+// A zero value disables that bound.
+type RetentionPolicy struct {
+	MaxAge        Duration `json:"max_age"`
+	MaxTotalBytes int64    `json:"max_total_bytes"`
+}
+
+// DefaultRetentionPolicy keeps outputs for 30 days and at most 10 GiB
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		MaxAge:        Duration(30 * 24 * time.Hour),
+		MaxTotalBytes: 10 << 30,
+	}
+}
+
+// Validate checks that the bounds are not negative
+func (p RetentionPolicy) Validate() error {
+	if p.MaxAge < 0 || p.MaxTotalBytes < 0 {
+		return fmt.Errorf("retention bounds must not be negative: %+v", p)
+	}
+	return nil
+}
+
+// Active retention policy, overridable from the config
+var retentionPolicy = DefaultRetentionPolicy()
+
+// SetRetentionPolicy replaces the retention policy for received outputs
+func SetRetentionPolicy(p RetentionPolicy) {
+	retentionPolicy = p
+}
+
+// DeletionRecord is one line of the deletion manifest. It identifies what
+// was destroyed, and why, without keeping any of it.
+type DeletionRecord struct {
+	Time         time.Time  `json:"time"`
+	Kind         string     `json:"kind"` // "output" or "journal"
+	TransferID   string     `json:"transfer_id"`
+	Engagement   string     `json:"engagement,omitempty"`
+	OriginalName string     `json:"original_name,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"` // of the file as stored, encrypted or not
+	Size         int64      `json:"size"`
+	StoredAt     *time.Time `json:"stored_at,omitempty"`
+	Reason       string     `json:"reason"`
+	Overwritten  int        `json:"files_overwritten"`
+}
+
+// deletionMu serialises appends to the deletion manifest
+var deletionMu sync.Mutex
+
+// List returns the committed outputs in the store, oldest first. Outputs
+// still being written have no sidecar yet and are left out.
+func (s *OutputStore) List() ([]*StoredFile, error) {
+	entries, err := os.ReadDir(s.filesDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading output directory: %v", err)
+	}
+
+	var stored []*StoredFile
+	for _, entry := range entries {
+		if !entry.IsDir() || !protocol.IsValidTransferID(entry.Name()) {
+			continue
+		}
+		dir := filepath.Join(s.filesDir(), entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, "meta.json"))
+		if err != nil {
+			continue
+		}
+		var record StoredFile
+		if err := json.Unmarshal(data, &record); err != nil || record.TransferID != entry.Name() {
+			log.Printf("Warning: skipping output %s with an unreadable sidecar", entry.Name())
+			continue
+		}
+		digest, _ := record.storedDigest()
+		record.Path = filepath.Join(dir, digest)
+		stored = append(stored, &record)
+	}
+
+	sort.Slice(stored, func(i, j int) bool { return stored[i].StoredAt.Before(stored[j].StoredAt) })
+	return stored, nil
+}
+
+// Delete overwrites and removes a stored output together with its sidecar,
+// then records the deletion in the manifest
+func (s *OutputStore) Delete(record *StoredFile, reason string) (*DeletionRecord, error) {
+	dir := filepath.Join(s.filesDir(), record.TransferID)
+	overwritten, err := shredDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	deletion := &DeletionRecord{
+		Time:         time.Now().UTC(),
+		Kind:         "output",
+		TransferID:   record.TransferID,
+		Engagement:   record.Engagement,
+		OriginalName: record.OriginalName,
+		StoredAt:     &record.StoredAt,
+		Reason:       reason,
+		Overwritten:  overwritten,
+	}
+	deletion.SHA256, deletion.Size = record.storedDigest()
+	return deletion, s.recordDeletion(deletion)
+}
+
+// recordDeletion appends a record to the deletion manifest and syncs it
+func (s *OutputStore) recordDeletion(deletion *DeletionRecord) error {
+	line, err := json.Marshal(deletion)
+	if err != nil {
+		return fmt.Errorf("error encoding deletion record: %v", err)
+	}
+
+	deletionMu.Lock()
+	defer deletionMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(s.root, DeletionManifestName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening deletion manifest: %v", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing deletion manifest: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("error syncing deletion manifest: %v", err)
+	}
+	return f.Close()
+}
+
+// Deletions reads the deletion manifest back, oldest first
+func (s *OutputStore) Deletions() ([]DeletionRecord, error) {
+	data, err := os.ReadFile(filepath.Join(s.root, DeletionManifestName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading deletion manifest: %v", err)
+	}
+	var deletions []DeletionRecord
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var deletion DeletionRecord
+		if err := json.Unmarshal(line, &deletion); err != nil {
+			return nil, fmt.Errorf("deletion manifest line %d: %v", i+1, err)
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, nil
+}
+
+// shredDir overwrites every regular file below dir with random data, syncs
+// it and removes the directory. It returns the number of files overwritten.
+// Overwriting only reaches the original blocks on file systems that update
+// in place; on copy-on-write or flash storage it is a best effort and full
+// disk encryption remains the real protection.
+func shredDir(dir string) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if err := shredFile(path); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return count, fmt.Errorf("error overwriting %s: %v", dir, err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return count, fmt.Errorf("error removing %s: %v", dir, err)
+	}
+	return count, nil
+}
+
+// shredFile overwrites a file in place with random data and syncs it
+func shredFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := io.CopyN(f, rand.Reader, info.Size()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ApplyRetention deletes outputs older than the maximum age, then the
+// oldest remaining outputs until the total fits the maximum size. It
+// returns the deletions made.
+func ApplyRetention(now time.Time) ([]*DeletionRecord, error) {
+	stored, err := outputStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, record := range stored {
+		_, size := record.storedDigest()
+		total += size
+	}
+
+	var deleted []*DeletionRecord
+	for _, record := range stored {
+		reason := ""
+		switch {
+		case retentionPolicy.MaxAge > 0 && now.Sub(record.StoredAt) > time.Duration(retentionPolicy.MaxAge):
+			reason = DeleteReasonMaxAge
+		case retentionPolicy.MaxTotalBytes > 0 && total > retentionPolicy.MaxTotalBytes:
+			reason = DeleteReasonMaxTotal
+		default:
+			continue
+		}
+
+		deletion, err := outputStore.Delete(record, reason)
+		if err != nil {
+			return deleted, err
+		}
+		total -= deletion.Size
+		deleted = append(deleted, deletion)
+		audit(AuditRecord{
+			Event:      AuditCleanup,
+			TransferID: record.TransferID,
+			Engagement: record.Engagement,
+			Reason:     "retention: " + reason,
+		})
+		log.Printf("Deleted output of transfer %s (%d bytes, stored %s): %s",
+			record.TransferID, deletion.Size, record.StoredAt.Format(time.RFC3339), reason)
+	}
+	return deleted, nil
+}
+
+// Purge deletes every stored output and journal entry of an engagement,
+// recording each deletion in the manifest. The receiver should not be
+// running while an engagement is purged.
+func Purge(engagementID string) ([]*DeletionRecord, error) {
+	stored, err := outputStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []*DeletionRecord
+	for _, record := range stored {
+		if record.Engagement != engagementID {
+			continue
+		}
+		deletion, err := outputStore.Delete(record, DeleteReasonPurge)
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, deletion)
+	}
+
+	// Partial transfers hold encrypted chunks in the journal
+	transfers, err := journal.Load()
+	if err != nil {
+		return deleted, err
+	}
+	for _, transfer := range transfers {
+		if transfer.Engagement != engagementID {
+			continue
+		}
+		overwritten, err := shredDir(journal.transferDir(transfer.ID))
+		if err != nil {
+			return deleted, err
+		}
+		deletion := &DeletionRecord{
+			Time:         time.Now().UTC(),
+			Kind:         "journal",
+			TransferID:   transfer.ID,
+			Engagement:   transfer.Engagement,
+			OriginalName: recordedName(transfer.Filename),
+			Size:         int64(transfer.BufferedBytes / 2),
+			Reason:       DeleteReasonPurge,
+			Overwritten:  overwritten,
+		}
+		if err := outputStore.recordDeletion(deletion); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, deletion)
+	}
+	return deleted, nil
+}
+
+// RunPurgeCommand implements the "purge" subcommand:
+//
+//	purge -engagement <id> [-output <dir>]
+func RunPurgeCommand(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	outputDir := fs.String("output", DefaultConfig().OutputDir, "Output root directory")
+	engagementID := fs.String("engagement", "", "Engagement whose data is destroyed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !protocol.IsValidEngagementID(*engagementID) {
+		return fmt.Errorf("purge needs a valid -engagement")
+	}
+
+	SetOutputDir(*outputDir)
+	deleted, err := Purge(*engagementID)
+	for _, d := range deleted {
+		fmt.Printf("Destroyed %s %s (%q, %d bytes, %d files overwritten)\n",
+			d.Kind, d.TransferID, d.OriginalName, d.Size, d.Overwritten)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d items for engagement %s; deletions recorded in %s\n",
+		len(deleted), *engagementID, filepath.Join(*outputDir, DeletionManifestName))
+	return nil
+}
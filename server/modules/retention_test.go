@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeOutput commits data as the output of a transfer and backdates it
+func storeOutput(t *testing.T, transferID, engagement string, data []byte, storedAt time.Time) *StoredFile {
+	t.Helper()
+	pending, err := outputStore.Create(transferID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending.Write(data)
+	record, err := pending.Commit(StoredFile{OriginalName: "file.txt", Engagement: engagement})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record.StoredAt = storedAt
+	sidecar, _ := json.Marshal(record)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(record.Path), "meta.json"), sidecar, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// readDeletions returns the records of the deletion manifest
+func readDeletions(t *testing.T) []DeletionRecord {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(outputStore.root, DeletionManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []DeletionRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec DeletionRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("invalid deletion record %q: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	resetState(t, DefaultLimits())
+	SetRetentionPolicy(RetentionPolicy{MaxAge: Duration(24 * time.Hour)})
+	t.Cleanup(func() { SetRetentionPolicy(DefaultRetentionPolicy()) })
+
+	now := time.Now()
+	old := storeOutput(t, fmt.Sprintf("%064x", 1), "test-engagement", []byte("old secret"), now.Add(-25*time.Hour))
+	recent := storeOutput(t, fmt.Sprintf("%064x", 2), "test-engagement", []byte("new secret"), now.Add(-time.Hour))
+
+	// Keep a second link to the old output to see what happened to its blocks
+	witness := filepath.Join(t.TempDir(), "witness")
+	if err := os.Link(old.Path, witness); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := ApplyRetention(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].TransferID != old.TransferID || deleted[0].Reason != DeleteReasonMaxAge {
+		t.Fatalf("deleted %+v", deleted)
+	}
+	if _, err := os.Stat(filepath.Dir(old.Path)); !os.IsNotExist(err) {
+		t.Errorf("expired output still present: %v", err)
+	}
+	if _, err := os.Stat(recent.Path); err != nil {
+		t.Errorf("recent output removed: %v", err)
+	}
+	if data, _ := os.ReadFile(witness); len(data) != len("old secret") || bytes.Equal(data, []byte("old secret")) {
+		t.Errorf("output was not overwritten before deletion: %q", data)
+	}
+
+	records := readDeletions(t)
+	if len(records) != 1 || records[0].SHA256 != old.SHA256 || records[0].Overwritten != 2 ||
+		records[0].Engagement != "test-engagement" || records[0].Kind != "output" {
+		t.Errorf("deletion manifest %+v", records)
+	}
+}
+
+func TestRetentionMaxTotalBytes(t *testing.T) {
+	resetState(t, DefaultLimits())
+	SetRetentionPolicy(RetentionPolicy{MaxTotalBytes: 25})
+	t.Cleanup(func() { SetRetentionPolicy(DefaultRetentionPolicy()) })
+
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		storeOutput(t, fmt.Sprintf("%064x", i), "test-engagement", bytes.Repeat([]byte{'x'}, 10), now.Add(time.Duration(i)*time.Minute))
+	}
+
+	deleted, err := ApplyRetention(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].TransferID != fmt.Sprintf("%064x", 1) || deleted[0].Reason != DeleteReasonMaxTotal {
+		t.Fatalf("deleted %+v, want only the oldest output", deleted)
+	}
+	if remaining, _ := outputStore.List(); len(remaining) != 2 {
+		t.Errorf("%d outputs remain, want 2", len(remaining))
+	}
+}
+
+func TestPurgeEngagement(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	now := time.Now()
+	mine := storeOutput(t, fmt.Sprintf("%064x", 1), "test-engagement", []byte("customer data"), now)
+	theirs := storeOutput(t, fmt.Sprintf("%064x", 2), "other-engagement", []byte("other data"), now)
+
+	// A partial transfer of the engagement sits in the journal
+	doRequest(fmt.Sprintf("init/%s/2/8/test-engagement/partial.bin", testTransferID))
+	doRequest(chunkPath(testTransferID, 0, "abcd"))
+
+	deleted, err := Purge("test-engagement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0].TransferID != mine.TransferID ||
+		deleted[1].Kind != "journal" || deleted[1].TransferID != testTransferID {
+		t.Fatalf("deleted %+v", deleted)
+	}
+	if _, err := os.Stat(filepath.Dir(mine.Path)); !os.IsNotExist(err) {
+		t.Errorf("purged output still present: %v", err)
+	}
+	if _, err := os.Stat(journal.transferDir(testTransferID)); !os.IsNotExist(err) {
+		t.Errorf("purged journal entry still present: %v", err)
+	}
+	if _, err := os.Stat(theirs.Path); err != nil {
+		t.Errorf("other engagement's output removed: %v", err)
+	}
+	if records := readDeletions(t); len(records) != 2 || records[1].Reason != DeleteReasonPurge {
+		t.Errorf("deletion manifest %+v", records)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// errInterrupted is returned by ProcessCompletedTransfer for a transfer a
+// shutdown interrupted while it was being verified
+var errInterrupted = errors.New("receiver shut down before the transfer was verified")
+
+// shutdownPoll is how often FinishTransfers checks on transfers still being
+// verified
+const shutdownPoll = 50 * time.Millisecond
+
+// RunCleanup calls ScheduleCleanup every interval until ctx is done
+func RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ScheduleCleanup()
+		}
+	}
+}
+
+// countVerifying returns the number of transfers being verified
+func countVerifying() int {
+	transfersMutex.RLock()
+	defer transfersMutex.RUnlock()
+	count := 0
+	for _, transfer := range transfers {
+		transfer.mu.Lock()
+		if transfer.State == StateVerifying {
+			count++
+		}
+		transfer.mu.Unlock()
+	}
+	return count
+}
+
+// FinishTransfers settles every transfer before the process exits. Transfers
+// being verified are given until ctx is done to complete and are interrupted
+// if they have not by then, so none is left half-stored: the complete
+// request then fails them, or the next start does if the process exits
+// first. Transfers still
+// receiving are journaled to resume after a restart. Each settled transfer
+// is recorded in the audit log. The listener should be shut down first so
+// that no new transfers start.
+func FinishTransfers(ctx context.Context) (resumable, failed int) {
+	for countVerifying() > 0 && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-time.After(shutdownPoll):
+		}
+	}
+
+	transfersMutex.RLock()
+	remaining := make([]*FileTransfer, 0, len(transfers))
+	for _, transfer := range transfers {
+		remaining = append(remaining, transfer)
+	}
+	transfersMutex.RUnlock()
+
+	for _, transfer := range remaining {
+		transfer.mu.Lock()
+		record := AuditRecord{
+			Event:      AuditShutdown,
+			TransferID: transfer.ID,
+			Engagement: transfer.Engagement,
+			Source:     transfer.Source,
+			Received:   len(transfer.Chunks),
+		}
+		switch transfer.State {
+		case StateVerifying:
+			// The verification still reads the chunks, so they are left
+			// for the complete handler to release. The journaled state
+			// lets the next start fail the transfer should that not happen.
+			transfer.interrupted.Store(true)
+			persistState(transfer)
+			record.State = StateFailed
+			record.Reason = errInterrupted.Error()
+			failed++
+			log.Printf("Transfer %s was still being verified at shutdown, interrupting it", transfer.ID)
+		case StateInitialised, StateReceiving:
+			persistState(transfer)
+			record.State = transfer.State
+			record.Reason = "journaled; resumes after a restart"
+			resumable++
+		default:
+			transfer.mu.Unlock()
+			continue
+		}
+		transfer.mu.Unlock()
+		audit(record)
+	}
+
+	if resumable > 0 || failed > 0 {
+		log.Printf("Shutdown: %d transfers journaled for resumption, %d failed during verification",
+			resumable, failed)
+	}
+	return resumable, failed
+}
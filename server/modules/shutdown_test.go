@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// setState moves a transfer straight to a state for a test
+func setState(t *testing.T, transferID string, state TransferState) *FileTransfer {
+	t.Helper()
+	transfer, reqErr := lookupTransfer(transferID)
+	if reqErr != nil {
+		t.Fatalf("lookupTransfer: %v", reqErr)
+	}
+	transfer.mu.Lock()
+	transfer.State = state
+	transfer.mu.Unlock()
+	return transfer
+}
+
+func TestFinishTransfers(t *testing.T) {
+	resetState(t, DefaultLimits())
+	path := withAuditLog(t)
+
+	receivingID := fmt.Sprintf("%064x", 1)
+	sendTransfer(t, receivingID, "abcdef", 2)
+	verifying := encryptForTest(t, testTransferID, []byte("cut short"), "test-key")
+	sendTransfer(t, testTransferID, verifying, 16)
+	setState(t, testTransferID, StateVerifying)
+
+	// The verification does not finish before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 3*shutdownPoll)
+	defer cancel()
+	resumable, failed := FinishTransfers(ctx)
+	if resumable != 1 || failed != 1 {
+		t.Errorf("FinishTransfers = %d resumable, %d failed; want 1, 1", resumable, failed)
+	}
+
+	// After a restart the receiving transfer resumes and the other has failed
+	simulateRestart(t)
+	expectCode(t, doRequest(chunkPath(receivingID, 2, "ef")), http.StatusOK, CodeChunkReceived)
+	resp := expectCode(t, doRequest(fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256(verifying))),
+		http.StatusConflict, ErrCodeInvalidState)
+	if resp.State != StateFailed {
+		t.Errorf("state after restart = %s, want %s", resp.State, StateFailed)
+	}
+
+	states := make(map[string]TransferState)
+	for _, rec := range readAudit(t, path) {
+		if rec.Event == AuditShutdown {
+			states[rec.TransferID] = rec.State
+		}
+	}
+	if states[receivingID] != StateReceiving || states[testTransferID] != StateFailed {
+		t.Errorf("shutdown audit records: %v", states)
+	}
+	report := BuildReport(readAudit(t, path), "", time.Now())
+	for _, summary := range report.Transfers {
+		if summary.TransferID == testTransferID && summary.Outcome != StateFailed {
+			t.Errorf("report outcome %s for the interrupted transfer", summary.Outcome)
+		}
+	}
+}
+
+func TestFinishTransfersWaitsForVerification(t *testing.T) {
+	resetState(t, DefaultLimits())
+	sendTransfer(t, testTransferID, "abcdef", 2)
+	transfer := setState(t, testTransferID, StateVerifying)
+
+	go func() {
+		time.Sleep(2 * shutdownPoll)
+		transfer.mu.Lock()
+		transfer.transition(StateCompleted)
+		transfer.mu.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, failed := FinishTransfers(ctx); failed != 0 {
+		t.Errorf("%d transfers failed although verification finished in time", failed)
+	}
+}
+
+func TestFinishTransfersInterruptsVerification(t *testing.T) {
+	resetState(t, DefaultLimits())
+	manifest := testManifest()
+	manifest.MaxTotalBytes = 64 << 20
+	SetManifest(manifest)
+
+	// Chunks this large cannot be sent, so they are put in place directly;
+	// they keep the verification busy long enough to be interrupted
+	const chunks = 4
+	payload := encryptForTest(t, testTransferID, bytes.Repeat([]byte("in flight "), 1600*1024), "test-key")
+	expectCode(t, doRequest(fmt.Sprintf("init/%s/%d/%d/test-engagement/file.txt", testTransferID, chunks, len(payload))),
+		http.StatusOK, CodeTransferInitialised)
+	transfer, _ := lookupTransfer(testTransferID)
+	transfer.mu.Lock()
+	size := (len(payload) + chunks - 1) / chunks
+	for i := 0; i < chunks; i++ {
+		transfer.Chunks[i] = payload[i*size : min((i+1)*size, len(payload))]
+	}
+	transfer.State = StateReceiving
+	transfer.mu.Unlock()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- doRequest(fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256(payload)))
+	}()
+
+	// Shut down as soon as the verification has started, with no time
+	// left to let it finish
+	for {
+		transfer.mu.Lock()
+		state := transfer.State
+		transfer.mu.Unlock()
+		if state != StateReceiving {
+			break
+		}
+		runtime.Gosched()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, failed := FinishTransfers(ctx)
+	rec := <-done
+	if failed == 0 {
+		t.Skip("the verification finished before the shutdown")
+	}
+
+	// The complete request fails the transfer and releases its chunks
+	expectCode(t, rec, http.StatusServiceUnavailable, ErrCodeShuttingDown)
+	transfer.mu.Lock()
+	if transfer.State != StateFailed || transfer.Chunks != nil || transfer.BufferedBytes != 0 {
+		t.Errorf("interrupted transfer left in state %s with %d chunks, %d bytes buffered",
+			transfer.State, len(transfer.Chunks), transfer.BufferedBytes)
+	}
+	transfer.mu.Unlock()
+	if n := bufferedBytes.Load(); n != 0 {
+		t.Errorf("%d bytes still counted against the memory budget", n)
+	}
+	if stored, err := outputStore.List(); err != nil || len(stored) != 0 {
+		t.Errorf("interrupted transfer stored %d outputs (%v)", len(stored), err)
+	}
+}
+
+func TestRunCleanupStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunCleanup(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunCleanup did not return after its context was cancelled")
+	}
+}
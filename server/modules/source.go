@@ -0,0 +1,261 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error codes for requests refused because of where they come from
+const (
+	ErrCodeSourceNotAllowed = "source_not_allowed"
+	ErrCodeRateLimited      = "rate_limited"
+	ErrCodeSourceBusy       = "source_busy"
+)
+
+// SourcePolicy restricts which addresses may send requests and how many.
+// The source is the address the request arrives from, which for relayed
+// traffic is the relaying host's egress; forwarding headers are not trusted.
+type SourcePolicy struct {
+	// AllowedCIDRs lists the networks requests are accepted from. Single
+	// addresses may be given without a prefix length. Empty allows any source.
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+	// RequestsPerSecond and Burst bound each source's request rate with a
+	// token bucket. A zero rate disables rate limiting.
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	// MaxConcurrent bounds the requests each source may have in progress.
+	// Zero disables the bound.
+	MaxConcurrent int `json:"max_concurrent"`
+}
+
+// DefaultSourcePolicy accepts any source at up to 10 requests a second with
+// bursts of 20, and 4 requests in progress at a time
+func DefaultSourcePolicy() SourcePolicy {
+	return SourcePolicy{
+		RequestsPerSecond: 10,
+		Burst:             20,
+		MaxConcurrent:     4,
+	}
+}
+
+// Networks parses the allowed CIDRs
+func (p SourcePolicy) Networks() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range p.AllowedCIDRs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source network %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Validate checks the allowlist and that the limits are not negative
+func (p SourcePolicy) Validate() error {
+	if _, err := p.Networks(); err != nil {
+		return err
+	}
+	if p.RequestsPerSecond < 0 || p.Burst < 0 || p.MaxConcurrent < 0 {
+		return fmt.Errorf("source limits must not be negative: %+v", p)
+	}
+	if p.RequestsPerSecond > 0 && p.Burst < 1 {
+		return fmt.Errorf("a source rate limit needs a burst of at least 1")
+	}
+	return nil
+}
+
+// rejectionInterval is how often a refused source is audited. Further
+// refusals within the interval are only counted, so an outside host cannot
+// grow the audit log by sending requests.
+const rejectionInterval = time.Minute
+
+// sourceRejections counts the refusals of one source for one reason since
+// the last one audited
+type sourceRejections struct {
+	since  time.Time
+	count  int
+	action string
+	last   *RequestError
+}
+
+// sourceState is the rate and concurrency accounting for one source
+type sourceState struct {
+	tokens  float64
+	updated time.Time
+	active  int
+}
+
+// Active source policy and per-source accounting
+var (
+	sourcePolicy   = DefaultSourcePolicy()
+	allowedSources []*net.IPNet
+	sources        = make(map[string]*sourceState)
+	rejections     = make(map[string]*sourceRejections) // by source and code
+	sourcesMutex   sync.Mutex
+)
+
+// SetSourcePolicy replaces the source allowlist and limits. The policy must
+// have been validated.
+func SetSourcePolicy(p SourcePolicy) {
+	networks, err := p.Networks()
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return
+	}
+	sourcesMutex.Lock()
+	sourcePolicy = p
+	allowedSources = networks
+	sources = make(map[string]*sourceState)
+	rejections = make(map[string]*sourceRejections)
+	sourcesMutex.Unlock()
+	if len(networks) > 0 {
+		log.Printf("Accepting requests only from %s", strings.Join(p.AllowedCIDRs, ", "))
+	}
+}
+
+// sourceAllowed reports whether host lies in the allowlist
+func sourceAllowed(host string) bool {
+	if len(allowedSources) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range allowedSources {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admitSource checks a request's source against the allowlist and its
+// limits. On success the returned function must be called once the request
+// is done.
+func admitSource(r *http.Request, now time.Time) (func(), *RequestError) {
+	host := sourceHost(r.RemoteAddr)
+
+	sourcesMutex.Lock()
+	defer sourcesMutex.Unlock()
+
+	if !sourceAllowed(host) {
+		return nil, newRequestError(http.StatusForbidden, ErrCodeSourceNotAllowed,
+			"source %s is not allowed", host)
+	}
+
+	state := sources[host]
+	if state == nil {
+		state = &sourceState{tokens: float64(sourcePolicy.Burst), updated: now}
+		sources[host] = state
+	}
+	if sourcePolicy.MaxConcurrent > 0 && state.active >= sourcePolicy.MaxConcurrent {
+		return nil, newRequestError(http.StatusTooManyRequests, ErrCodeSourceBusy,
+			"source %s already has %d requests in progress", host, state.active)
+	}
+	if sourcePolicy.RequestsPerSecond > 0 {
+		elapsed := now.Sub(state.updated).Seconds()
+		state.tokens = math.Min(float64(sourcePolicy.Burst), state.tokens+elapsed*sourcePolicy.RequestsPerSecond)
+		state.updated = now
+		if state.tokens < 1 {
+			return nil, newRequestError(http.StatusTooManyRequests, ErrCodeRateLimited,
+				"source %s exceeds %g requests per second", host, sourcePolicy.RequestsPerSecond)
+		}
+		state.tokens--
+	}
+
+	state.active++
+	return func() {
+		sourcesMutex.Lock()
+		state.active--
+		sourcesMutex.Unlock()
+	}, nil
+}
+
+// auditSourceReject records a refused source at most once per source and
+// error code in each rejectionInterval. The refusals in between are
+// recorded as one record with their count once the interval is over.
+func auditSourceReject(r *http.Request, e *RequestError, now time.Time) {
+	host := sourceHost(r.RemoteAddr)
+	key := host + " " + e.Code
+
+	sourcesMutex.Lock()
+	pending := rejections[key]
+	if pending != nil && now.Sub(pending.since) < rejectionInterval {
+		pending.count++
+		pending.action, pending.last = requestAction(r), e
+		sourcesMutex.Unlock()
+		return
+	}
+	rejections[key] = &sourceRejections{since: now}
+	sourcesMutex.Unlock()
+
+	if pending != nil {
+		auditRejections(host, pending)
+	}
+	auditReject(r, "", e)
+}
+
+// auditRejections records the refusals counted for a source, if any
+func auditRejections(host string, pending *sourceRejections) {
+	if pending.count == 0 {
+		return
+	}
+	audit(AuditRecord{
+		Event:  AuditReject,
+		Source: host,
+		Action: pending.action,
+		Status: pending.last.Status,
+		Code:   pending.last.Code,
+		Reason: fmt.Sprintf("%d further requests refused since %s: %s",
+			pending.count, pending.since.UTC().Format(time.RFC3339), pending.last.Message),
+		Count: pending.count,
+	})
+}
+
+// pruneSources forgets sources with nothing in progress whose bucket has
+// refilled, so the accounting does not grow with every address ever seen,
+// and records the refusals counted in intervals that are over
+func pruneSources(now time.Time) {
+	sourcesMutex.Lock()
+	for host, state := range sources {
+		refilled := sourcePolicy.RequestsPerSecond <= 0 ||
+			state.tokens+now.Sub(state.updated).Seconds()*sourcePolicy.RequestsPerSecond >= float64(sourcePolicy.Burst)
+		if state.active == 0 && refilled {
+			delete(sources, host)
+		}
+	}
+	finished := make(map[string]*sourceRejections)
+	for key, pending := range rejections {
+		if now.Sub(pending.since) >= rejectionInterval {
+			finished[key] = pending
+			delete(rejections, key)
+		}
+	}
+	sourcesMutex.Unlock()
+
+	for key, pending := range finished {
+		host, _, _ := strings.Cut(key, " ")
+		auditRejections(host, pending)
+	}
+}
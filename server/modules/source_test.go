@@ -0,0 +1,179 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// requestFrom builds a request arriving from addr
+func requestFrom(addr string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/status/test-engagement", nil)
+	req.RemoteAddr = addr
+	return req
+}
+
+func TestSourceAllowlist(t *testing.T) {
+	resetState(t, DefaultLimits())
+	path := withAuditLog(t)
+	SetSourcePolicy(SourcePolicy{AllowedCIDRs: []string{"10.1.0.0/16", "198.51.100.7", "2001:db8::/32"}})
+
+	// httptest requests come from 192.0.2.1, outside the allowlist
+	expectCode(t, doRequest(chunkPath(testTransferID, 0, "ab")), http.StatusForbidden, ErrCodeSourceNotAllowed)
+	records := readAudit(t, path)
+	if len(records) != 1 || records[0].Event != AuditReject || records[0].Code != ErrCodeSourceNotAllowed {
+		t.Errorf("audit records for an out-of-scope source: %+v", records)
+	}
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.1.2.3:4000", true},
+		{"10.2.0.1:4000", false},
+		{"198.51.100.7:4000", true},
+		{"198.51.100.8:4000", false},
+		{"[2001:db8::1]:4000", true},
+		{"[2001:db9::1]:4000", false},
+	}
+	for _, tt := range tests {
+		release, reqErr := admitSource(requestFrom(tt.addr), time.Now())
+		if (reqErr == nil) != tt.allowed {
+			t.Errorf("admitSource(%s) = %v, want allowed %v", tt.addr, reqErr, tt.allowed)
+		}
+		if release != nil {
+			release()
+		}
+	}
+}
+
+func TestSourceRateLimit(t *testing.T) {
+	resetState(t, DefaultLimits())
+	SetSourcePolicy(SourcePolicy{RequestsPerSecond: 2, Burst: 3})
+	now := time.Now()
+	req := requestFrom("10.0.0.1:4000")
+
+	for i := 0; i < 3; i++ {
+		release, reqErr := admitSource(req, now)
+		if reqErr != nil {
+			t.Fatalf("request %d within the burst: %v", i, reqErr)
+		}
+		release()
+	}
+	if _, reqErr := admitSource(req, now); reqErr == nil || reqErr.Code != ErrCodeRateLimited {
+		t.Fatalf("request beyond the burst: %v", reqErr)
+	}
+
+	// Other sources have their own bucket
+	other, reqErr := admitSource(requestFrom("10.0.0.2:4000"), now)
+	if reqErr != nil {
+		t.Fatalf("another source was limited: %v", reqErr)
+	}
+	other()
+
+	// Half a second refills one token at 2 requests a second
+	release, reqErr := admitSource(req, now.Add(500*time.Millisecond))
+	if reqErr != nil {
+		t.Fatalf("request after the bucket refilled: %v", reqErr)
+	}
+	release()
+	if _, reqErr := admitSource(req, now.Add(500*time.Millisecond)); reqErr == nil {
+		t.Error("second request admitted with one token refilled")
+	}
+
+	// A quiet source is forgotten once its bucket is full again
+	pruneSources(now.Add(time.Minute))
+	if len(sources) != 0 {
+		t.Errorf("%d sources left after pruning", len(sources))
+	}
+}
+
+func TestSourceConcurrencyLimit(t *testing.T) {
+	resetState(t, DefaultLimits())
+	SetSourcePolicy(SourcePolicy{MaxConcurrent: 2})
+	now := time.Now()
+	req := requestFrom("10.0.0.1:4000")
+
+	first, _ := admitSource(req, now)
+	second, _ := admitSource(req, now)
+	if _, reqErr := admitSource(req, now); reqErr == nil || reqErr.Code != ErrCodeSourceBusy {
+		t.Fatalf("third concurrent request: %v", reqErr)
+	}
+	pruneSources(now)
+	if len(sources) != 1 {
+		t.Error("source with requests in progress was pruned")
+	}
+
+	first()
+	third, reqErr := admitSource(req, now)
+	if reqErr != nil {
+		t.Fatalf("request after one finished: %v", reqErr)
+	}
+	second()
+	third()
+}
+
+func TestRateLimitedResponse(t *testing.T) {
+	resetState(t, DefaultLimits())
+	SetSourcePolicy(SourcePolicy{RequestsPerSecond: 1, Burst: 1})
+
+	doRequest(chunkPath(testTransferID, 0, "ab"))
+	rec := doRequest(chunkPath(testTransferID, 0, "ab"))
+	expectCode(t, rec, http.StatusTooManyRequests, ErrCodeRateLimited)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("rate-limited response has no Retry-After header")
+	}
+}
+
+func TestSourcePolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy SourcePolicy
+		valid  bool
+	}{
+		{SourcePolicy{}, true},
+		{DefaultSourcePolicy(), true},
+		{SourcePolicy{AllowedCIDRs: []string{"10.0.0.0/8", "192.0.2.1", "::1"}}, true},
+		{SourcePolicy{AllowedCIDRs: []string{"10.0.0.0/33"}}, false},
+		{SourcePolicy{AllowedCIDRs: []string{"example.com"}}, false},
+		{SourcePolicy{RequestsPerSecond: 5}, false},
+		{SourcePolicy{MaxConcurrent: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v, want valid %v", tt.policy, err, tt.valid)
+		}
+	}
+}
+
+func TestSourceRejectionsAuditedOncePerInterval(t *testing.T) {
+	resetState(t, DefaultLimits())
+	path := withAuditLog(t)
+	SetSourcePolicy(SourcePolicy{AllowedCIDRs: []string{"10.0.0.0/8"}})
+
+	// A burst of refused requests is audited once
+	for i := 0; i < 500; i++ {
+		expectCode(t, doRequest(chunkPath(testTransferID, 0, "ab")), http.StatusForbidden, ErrCodeSourceNotAllowed)
+	}
+	if records := readAudit(t, path); len(records) != 1 || records[0].Count != 0 {
+		t.Fatalf("audit records for a refused burst: %+v", records)
+	}
+
+	// Once the interval is over the rest are recorded with their count
+	pruneSources(time.Now().Add(rejectionInterval))
+	records := readAudit(t, path)
+	if len(records) != 2 || records[1].Count != 499 || records[1].Code != ErrCodeSourceNotAllowed || records[1].Source != "192.0.2.1" {
+		t.Fatalf("audit records after the interval: %+v", records)
+	}
+	report := BuildReport(records, "", time.Now())
+	if len(report.Rejections) != 1 || report.Rejections[0].Count != 500 {
+		t.Errorf("report rejections: %+v", report.Rejections)
+	}
+
+	// The next refusal starts a new interval
+	doRequest(chunkPath(testTransferID, 0, "ab"))
+	pruneSources(time.Now())
+	if records := readAudit(t, path); len(records) != 3 {
+		t.Errorf("%d audit records, want 3", len(records))
+	}
+}
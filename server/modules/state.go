@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// TransferState is the lifecycle stage of a transfer
+type TransferState string
+
+// Transfer states
+const (
+	StateInitialised TransferState = "initialised"
+	StateReceiving   TransferState = "receiving"
+	StateVerifying   TransferState = "verifying"
+	StateCompleted   TransferState = "completed"
+	StateFailed      TransferState = "failed"
+	StateExpired     TransferState = "expired"
+)
+
+// allowedTransitions lists the states reachable from each state.
+// Expired is terminal; the transfer is dropped once it gets there.
+var allowedTransitions = map[TransferState][]TransferState{
+	StateInitialised: {StateReceiving, StateFailed, StateExpired},
+	StateReceiving:   {StateReceiving, StateVerifying, StateFailed, StateExpired},
+	StateVerifying:   {StateCompleted, StateFailed},
+	StateCompleted:   {StateExpired},
+	StateFailed:      {StateExpired},
+}
+
+// CanTransition reports whether a transfer may move from one state to another
+func CanTransition(from, to TransferState) bool {
+	for _, allowed := range allowedTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsActive reports whether the state still holds resources for an
+// unfinished transfer
+func (s TransferState) IsActive() bool {
+	return s == StateInitialised || s == StateReceiving || s == StateVerifying
+}
+
+// transition moves the transfer to a new state if the move is allowed.
+// The caller must hold transfer.mu.
+func (t *FileTransfer) transition(to TransferState) error {
+	if !CanTransition(t.State, to) {
+		return fmt.Errorf("transfer %s cannot move from %s to %s", t.ID, t.State, to)
+	}
+	t.State = to
+	t.LastUpdated = time.Now()
+	return nil
+}
+
+// countActiveTransfers returns the number of transfers still in progress.
+// The caller must hold transfersMutex.
+func countActiveTransfers() int {
+	count := 0
+	for _, transfer := range transfers {
+		transfer.mu.Lock()
+		if transfer.State.IsActive() {
+			count++
+		}
+		transfer.mu.Unlock()
+	}
+	return count
+}
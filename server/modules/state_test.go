@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"protocol"
+)
+
+// encryptForTest encrypts plaintext for a transfer the way the client does
+// and returns hex
+func encryptForTest(t *testing.T, transferID string, plaintext []byte, keyString string) string {
+	t.Helper()
+	salt, err := protocol.NewPayloadSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(salt)
+	w, err := newStreamWriter(buf, protocol.DerivePayloadKey(keyString, salt, transferID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(buf.Bytes())
+}
+
+// sendTransfer initialises a transfer for data and sends every chunk
+func sendTransfer(t *testing.T, transferID, data string, chunkSize int) int {
+	t.Helper()
+	var chunks []string
+	for i := 0; i < len(data); i += chunkSize {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, data[i:end])
+	}
+
+	rec := doRequest(fmt.Sprintf("init/%s/%d/%d/test-engagement/file.txt", transferID, len(chunks), len(data)))
+	expectCode(t, rec, http.StatusOK, CodeTransferInitialised)
+	for i, chunk := range chunks {
+		expectCode(t, doRequest(chunkPath(transferID, i, chunk)), http.StatusOK, CodeChunkReceived)
+	}
+	return len(chunks)
+}
+
+func TestTransitions(t *testing.T) {
+	tests := []struct {
+		from, to TransferState
+		allowed  bool
+	}{
+		{StateInitialised, StateReceiving, true},
+		{StateInitialised, StateVerifying, false},
+		{StateReceiving, StateReceiving, true},
+		{StateReceiving, StateVerifying, true},
+		{StateVerifying, StateCompleted, true},
+		{StateVerifying, StateFailed, true},
+		{StateVerifying, StateExpired, false},
+		{StateCompleted, StateReceiving, false},
+		{StateCompleted, StateExpired, true},
+		{StateFailed, StateVerifying, false},
+		{StateExpired, StateInitialised, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.allowed {
+			t.Errorf("CanTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.allowed)
+		}
+	}
+}
+
+func TestDuplicateInitRejected(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	path := fmt.Sprintf("init/%s/2/100/test-engagement/a.txt", testTransferID)
+	expectCode(t, doRequest(path), http.StatusOK, CodeTransferInitialised)
+	doRequest(chunkPath(testTransferID, 0, "abcd"))
+
+	resp := expectCode(t, doRequest(path), http.StatusConflict, ErrCodeTransferExists)
+	if resp.State != StateReceiving {
+		t.Errorf("state = %s, want %s", resp.State, StateReceiving)
+	}
+
+	// The original transfer and its chunk are untouched
+	transfersMutex.RLock()
+	received := len(transfers[testTransferID].Chunks)
+	transfersMutex.RUnlock()
+	if received != 1 {
+		t.Errorf("received chunks = %d after duplicate init, want 1", received)
+	}
+}
+
+func TestCompleteWithMissingChunks(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	doRequest(fmt.Sprintf("init/%s/2/100/test-engagement/a.txt", testTransferID))
+	doRequest(chunkPath(testTransferID, 0, "abcd"))
+
+	rec := doRequest(fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256("abcd")))
+	resp := expectCode(t, rec, http.StatusBadRequest, ErrCodeMissingChunks)
+	if resp.State != StateReceiving {
+		t.Errorf("state = %s, want %s", resp.State, StateReceiving)
+	}
+
+	// The missing chunk can still be sent
+	expectCode(t, doRequest(chunkPath(testTransferID, 1, "ef")), http.StatusOK, CodeChunkReceived)
+}
+
+func TestRequestsAfterCompleteRejected(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	data := encryptForTest(t, testTransferID, []byte("hello state machine"), "test-key")
+	sendTransfer(t, testTransferID, data, 16)
+
+	completePath := fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256(data))
+	resp := expectCode(t, doRequest(completePath), http.StatusOK, CodeTransferCompleted)
+	if resp.State != StateCompleted {
+		t.Errorf("state = %s, want %s", resp.State, StateCompleted)
+	}
+
+	expectCode(t, doRequest(chunkPath(testTransferID, 0, data[:16])), http.StatusConflict, ErrCodeInvalidState)
+	expectCode(t, doRequest(completePath), http.StatusConflict, ErrCodeInvalidState)
+}
+
+func TestFailedChecksumMovesToFailed(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	sendTransfer(t, testTransferID, "abcdef0123", 4)
+
+	rec := doRequest(fmt.Sprintf("complete/%s/%s", testTransferID, calculateSHA256("wrong")))
+	resp := expectCode(t, rec, http.StatusBadRequest, ErrCodeFullChecksumMismatch)
+	if resp.State != StateFailed {
+		t.Errorf("state = %s, want %s", resp.State, StateFailed)
+	}
+
+	expectCode(t, doRequest(chunkPath(testTransferID, 0, "abcd")), http.StatusConflict, ErrCodeInvalidState)
+}
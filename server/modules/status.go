@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"protocol"
+)
+
+// ErrCodeEngagementRevoked is returned once the operator has revoked an
+// engagement
+const ErrCodeEngagementRevoked = "engagement_revoked"
+
+// AuditStatus records a status query
+const AuditStatus AuditEvent = "status"
+
+// Revocation records that an engagement was revoked by the operator
+type Revocation struct {
+	EngagementID string    `json:"engagement_id"`
+	RevokedAt    time.Time `json:"revoked_at"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+// revocationPath is where the revocation of an engagement is recorded
+func (s *OutputStore) revocationPath(engagementID string) string {
+	return filepath.Join(s.root, "revocations", engagementID+".json")
+}
+
+// Revoke records that an engagement is revoked. Clients asking for its
+// status are told to stop and no new transfers are accepted for it.
+// Revoking an engagement twice keeps the first record.
+func Revoke(engagementID, reason string) (*Revocation, error) {
+	if !protocol.IsValidEngagementID(engagementID) {
+		return nil, fmt.Errorf("invalid engagement ID %q", engagementID)
+	}
+	if existing, err := loadRevocation(engagementID); err != nil || existing != nil {
+		return existing, err
+	}
+
+	path := outputStore.revocationPath(engagementID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating revocations directory: %v", err)
+	}
+	revocation := &Revocation{EngagementID: engagementID, RevokedAt: time.Now().UTC(), Reason: reason}
+	data, err := json.MarshalIndent(revocation, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding revocation: %v", err)
+	}
+	if err := writeExclusive(path, append(data, '\n')); err != nil {
+		return nil, err
+	}
+	return revocation, nil
+}
+
+// loadRevocation returns the revocation of an engagement, or nil if it has
+// not been revoked
+func loadRevocation(engagementID string) (*Revocation, error) {
+	data, err := os.ReadFile(outputStore.revocationPath(engagementID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading revocation: %v", err)
+	}
+	var revocation Revocation
+	if err := json.Unmarshal(data, &revocation); err != nil {
+		return nil, fmt.Errorf("invalid revocation record: %v", err)
+	}
+	return &revocation, nil
+}
+
+// checkRevoked rejects requests for a revoked engagement. A revocation that
+// cannot be read counts as revoked.
+func checkRevoked(engagementID string) *RequestError {
+	revocation, err := loadRevocation(engagementID)
+	if err != nil {
+		return newRequestError(http.StatusForbidden, ErrCodeEngagementRevoked,
+			"engagement %s may be revoked: %v", engagementID, err)
+	}
+	if revocation != nil {
+		return newRequestError(http.StatusForbidden, ErrCodeEngagementRevoked,
+			"engagement %s was revoked at %s", engagementID, revocation.RevokedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// handleStatusRequest answers whether an engagement may still be used
+func handleStatusRequest(w http.ResponseWriter, r *http.Request) {
+	req, err := protocol.ParseStatusPath(r.URL.Path)
+	if err != nil {
+		writeError(w, r, "", decodeError(err))
+		return
+	}
+	if _, ok := keyring.Match(req.Verify); !ok {
+		writeError(w, r, "", newRequestError(http.StatusUnauthorized, ErrCodeUnauthenticated,
+			"request is not authenticated"))
+		return
+	}
+	if reqErr := checkEngagement(req.EngagementID, time.Now()); reqErr != nil {
+		writeError(w, r, "", reqErr)
+		return
+	}
+
+	audit(AuditRecord{Event: AuditStatus, Engagement: req.EngagementID, Source: r.RemoteAddr})
+	writeJSON(w, http.StatusOK, Response{
+		OK:      true,
+		Code:    protocol.CodeEngagementActive,
+		Message: fmt.Sprintf("engagement %s is active until %s", req.EngagementID, engagement.NotAfter.Format(time.RFC3339)),
+	})
+}
+
+// RunRevokeCommand implements the "revoke" subcommand:
+//
+//	revoke -engagement <id> [-reason <text>] [-output <dir>]
+func RunRevokeCommand(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	outputDir := fs.String("output", DefaultConfig().OutputDir, "Output root directory of the receiver")
+	engagementID := fs.String("engagement", "", "Engagement to revoke")
+	reason := fs.String("reason", "", "Why the engagement is revoked")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	SetOutputDir(*outputDir)
+	revocation, err := Revoke(*engagementID, *reason)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Engagement %s revoked at %s\n", revocation.EngagementID, revocation.RevokedAt.Format(time.RFC3339))
+	return nil
+}
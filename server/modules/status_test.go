@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"protocol"
+)
+
+func TestStatusReportsActiveEngagement(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	path, _ := protocol.EncodeStatus("test-engagement", "test-key")
+	rec := doRawRequest(path + protocol.URLSuffix)
+	expectCode(t, rec, http.StatusOK, protocol.CodeEngagementActive)
+
+	path, _ = protocol.EncodeStatus("test-engagement", "wrong-key")
+	rec = doRawRequest(path + protocol.URLSuffix)
+	expectCode(t, rec, http.StatusUnauthorized, ErrCodeUnauthenticated)
+
+	path, _ = protocol.EncodeStatus("other-engagement", "test-key")
+	rec = doRawRequest(path + protocol.URLSuffix)
+	expectCode(t, rec, http.StatusForbidden, ErrCodeUnknownEngagement)
+}
+
+func TestRevokedEngagement(t *testing.T) {
+	resetState(t, DefaultLimits())
+
+	first, err := Revoke("test-engagement", "test finished")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Revoke("test-engagement", "second reason")
+	if err != nil || !again.RevokedAt.Equal(first.RevokedAt) || again.Reason != "test finished" {
+		t.Errorf("second revocation = %+v, %v; want the first record kept", again, err)
+	}
+
+	path, _ := protocol.EncodeStatus("test-engagement", "test-key")
+	rec := doRawRequest(path + protocol.URLSuffix)
+	expectCode(t, rec, http.StatusForbidden, ErrCodeEngagementRevoked)
+
+	// No new transfers start once the engagement is revoked
+	rec = doRequest(fmt.Sprintf("init/%s/1/10/test-engagement/a.txt", testTransferID))
+	expectCode(t, rec, http.StatusForbidden, ErrCodeEngagementRevoked)
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"protocol"
+)
+
+// maxSanitisedNameLength caps the length of a recorded original filename
+const maxSanitisedNameLength = 200
+
+// StoredFile describes a completed transfer written by the output store.
+// It is also the content of the JSON sidecar next to the stored file, which
+// records where the file came from for chain of custody (see Verify).
+type StoredFile struct {
+	TransferID   string `json:"transfer_id"`
+	OriginalName string `json:"original_name"`
+	Engagement   string `json:"engagement"`
+	// Source is the remote address the transfer was initialised from
+	Source string `json:"source"`
+	// CiphertextSHA256 is the SHA-256 of the hex-encoded ciphertext as
+	// received, the checksum the transfer was completed with
+	CiphertextSHA256 string    `json:"ciphertext_sha256"`
+	SHA256           string    `json:"sha256"` // of the stored plaintext
+	Size             int64     `json:"size"`
+	InitialisedAt    time.Time `json:"initialised_at"`
+	StoredAt         time.Time `json:"stored_at"`
+	// Outputs encrypted at rest (see atrest.go) record the scheme, the hex
+	// recipient public key and the hash and size of the file as stored.
+	// OriginalName, SHA256 and Size are left empty and kept in Sealed,
+	// encrypted to the recipient.
+	Encryption   string `json:"encryption,omitempty"`
+	Recipient    string `json:"recipient,omitempty"`
+	StoredSHA256 string `json:"stored_sha256,omitempty"`
+	StoredSize   int64  `json:"stored_size,omitempty"`
+	Sealed       string `json:"sealed,omitempty"`
+	Path         string `json:"-"`
+	// sealedName is the journaled, sealed filename passed to Commit; it is
+	// used when the plaintext name was not kept
+	sealedName string
+}
+
+// storedDigest returns the SHA-256 and size of the file as stored, which
+// names it in its transfer directory
+func (f *StoredFile) storedDigest() (string, int64) {
+	if f.Encryption != "" {
+		return f.StoredSHA256, f.StoredSize
+	}
+	return f.SHA256, f.Size
+}
+
+// OutputStore writes completed transfers below a root directory.
+// Each transfer gets its own directory named after the transfer ID; the
+// payload is stored under its SHA-256 digest and the original filename is
+// only ever recorded, sanitised, in a JSON sidecar.
+type OutputStore struct {
+	root string
+}
+
+// NewOutputStore returns a store rooted at dir
+func NewOutputStore(dir string) *OutputStore {
+	return &OutputStore{root: dir}
+}
+
+// filesDir is where per-transfer output directories live
+func (s *OutputStore) filesDir() string {
+	return filepath.Join(s.root, "files")
+}
+
+// PendingFile is an output being written for a transfer. Nothing becomes
+// visible under a content-addressed name until Commit succeeds.
+type PendingFile struct {
+	store      *OutputStore
+	transferID string
+	dir        string
+	file       *os.File
+	hasher     hash.Hash
+	size       int64
+
+	// Set when the output is encrypted at rest: plaintext goes through
+	// sealer, and the file as written is hashed by stored
+	recipient *ecdh.PublicKey
+	sealer    io.WriteCloser
+	stored    *countingHash
+}
+
+// countingHash hashes and counts what is written to it
+type countingHash struct {
+	hash.Hash
+	n int64
+}
+
+// Write implements io.Writer
+func (c *countingHash) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return c.Hash.Write(p)
+}
+
+// Create starts writing the output of a completed transfer. It refuses to
+// touch a transfer that already has an output directory.
+func (s *OutputStore) Create(transferID string) (*PendingFile, error) {
+	if !protocol.IsValidTransferID(transferID) {
+		return nil, fmt.Errorf("invalid transfer ID: %q", transferID)
+	}
+
+	if err := os.MkdirAll(s.filesDir(), 0700); err != nil {
+		return nil, fmt.Errorf("error creating output directory: %v", err)
+	}
+
+	transferDir := filepath.Join(s.filesDir(), transferID)
+	if err := os.Mkdir(transferDir, 0700); err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("output for transfer %s already exists", transferID)
+		}
+		return nil, fmt.Errorf("error creating transfer directory: %v", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(transferDir, ".partial"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		os.Remove(transferDir)
+		return nil, fmt.Errorf("error creating file: %v", err)
+	}
+
+	pending := &PendingFile{
+		store:      s,
+		transferID: transferID,
+		dir:        transferDir,
+		file:       file,
+		hasher:     sha256.New(),
+	}
+	if outputRecipient != nil {
+		pending.recipient = outputRecipient
+		pending.stored = &countingHash{Hash: sha256.New()}
+		pending.sealer, err = sealOutput(io.MultiWriter(file, pending.stored), outputRecipient)
+		if err != nil {
+			pending.Abort()
+			return nil, fmt.Errorf("error encrypting file: %v", err)
+		}
+	}
+	return pending, nil
+}
+
+// Write appends plaintext to the pending output
+func (p *PendingFile) Write(b []byte) (int, error) {
+	var n int
+	var err error
+	if p.sealer != nil {
+		n, err = p.sealer.Write(b)
+	} else {
+		n, err = p.file.Write(b)
+	}
+	p.hasher.Write(b[:n])
+	p.size += int64(n)
+	return n, err
+}
+
+// Commit moves the pending output to its content-addressed name and writes
+// the JSON sidecar. The provenance fields of the sidecar are taken from
+// meta; the rest are filled in from the output. The pending file is
+// discarded if anything fails.
+func (p *PendingFile) Commit(meta StoredFile) (*StoredFile, error) {
+	partialPath := p.file.Name()
+	if p.sealer != nil {
+		if err := p.sealer.Close(); err != nil {
+			p.Abort()
+			return nil, fmt.Errorf("error encrypting file: %v", err)
+		}
+	}
+	if err := p.file.Sync(); err != nil {
+		p.Abort()
+		return nil, fmt.Errorf("error syncing file: %v", err)
+	}
+	if err := p.file.Close(); err != nil {
+		p.Abort()
+		return nil, fmt.Errorf("error closing file: %v", err)
+	}
+
+	digest := hex.EncodeToString(p.hasher.Sum(nil))
+	record := &StoredFile{
+		TransferID:       p.transferID,
+		OriginalName:     SanitiseFilename(meta.OriginalName),
+		Engagement:       meta.Engagement,
+		Source:           meta.Source,
+		CiphertextSHA256: meta.CiphertextSHA256,
+		SHA256:           digest,
+		Size:             p.size,
+		InitialisedAt:    meta.InitialisedAt.UTC(),
+		StoredAt:         time.Now().UTC(),
+		Path:             filepath.Join(p.dir, digest),
+	}
+	if p.sealer != nil {
+		fields := sealedFields{
+			OriginalName: record.OriginalName,
+			SHA256:       record.SHA256,
+			Size:         record.Size,
+		}
+		if meta.OriginalName == "" && meta.sealedName != "" {
+			fields.OriginalName, fields.SealedName = "", meta.sealedName
+		}
+		sealed, err := sealFields(fields, p.recipient)
+		if err != nil {
+			p.Abort()
+			return nil, fmt.Errorf("error encrypting record: %v", err)
+		}
+		record.Encryption = AtRestEncryption
+		record.Recipient = hex.EncodeToString(p.recipient.Bytes())
+		record.StoredSHA256 = hex.EncodeToString(p.stored.Sum(nil))
+		record.StoredSize = p.stored.n
+		record.Sealed = sealed
+		record.OriginalName, record.SHA256, record.Size = "", "", 0
+		record.Path = filepath.Join(p.dir, record.StoredSHA256)
+	}
+
+	// Link rather than rename so an existing file is never replaced
+	if err := os.Link(partialPath, record.Path); err != nil {
+		p.Abort()
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("refusing to overwrite existing file %s", record.Path)
+		}
+		return nil, fmt.Errorf("error committing file: %v", err)
+	}
+	os.Remove(partialPath)
+
+	// Without its sidecar the output would be invisible to List and so to
+	// retention, so it goes too
+	sidecar, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		p.Abort()
+		return nil, fmt.Errorf("error encoding sidecar: %v", err)
+	}
+	if err := writeExclusive(filepath.Join(p.dir, "meta.json"), append(sidecar, '\n')); err != nil {
+		p.Abort()
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Abort discards the pending output and its transfer directory
+func (p *PendingFile) Abort() {
+	p.file.Close()
+	if err := os.RemoveAll(p.dir); err != nil {
+		log.Printf("Warning: failed to remove aborted output %s: %v", p.dir, err)
+	}
+}
+
+// writeExclusive creates path with mode 0600, failing if it already exists
+func writeExclusive(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("refusing to overwrite existing file %s", path)
+		}
+		return fmt.Errorf("error creating file: %v", err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing file: %v", err)
+	}
+	return nil
+}
+
+// SanitiseFilename reduces an untrusted filename to a plain, printable base
+// name suitable for recording. It is never used as a path.
+func SanitiseFilename(name string) string {
+	// Keep only the last path element, whichever separator was used
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var builder strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '.', r == '-', r == '_', r == ' ':
+			builder.WriteRune(r)
+		default:
+			builder.WriteRune('_')
+		}
+	}
+
+	cleaned := strings.TrimLeft(strings.TrimSpace(builder.String()), ".")
+	if runes := []rune(cleaned); len(runes) > maxSanitisedNameLength {
+		cleaned = string(runes[:maxSanitisedNameLength])
+	}
+	if cleaned == "" {
+		cleaned = "unnamed"
+	}
+	return cleaned
+}
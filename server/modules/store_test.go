@@ -0,0 +1,82 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitiseFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"..\\..\\windows\\win.ini", "win.ini"},
+		{"/etc/shadow", "shadow"},
+		{"C:\\Users\\me\\secret.txt", "secret.txt"},
+		{"a\x00b.txt", "a_b.txt"},
+		{"evil\x00/../x", "x"},
+		{".", "unnamed"},
+		{"..", "unnamed"},
+		{"...", "unnamed"},
+		{".bashrc", "bashrc"},
+		{"dir/", "unnamed"},
+		{"", "unnamed"},
+		{"  spaced  ", "spaced"},
+		{"new\nline;rm -rf", "new_line_rm -rf"},
+		{strings.Repeat("a", 300), strings.Repeat("a", maxSanitisedNameLength)},
+	}
+	for _, tt := range tests {
+		got := SanitiseFilename(tt.name)
+		if got != tt.want {
+			t.Errorf("SanitiseFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if strings.ContainsAny(got, "/\\\x00") || got == "." || got == ".." {
+			t.Errorf("SanitiseFilename(%q) = %q is not a plain name", tt.name, got)
+		}
+	}
+}
+
+func TestCreateRefusesExistingOutput(t *testing.T) {
+	store := NewOutputStore(t.TempDir())
+	pending, err := store.Create(testTransferID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending.Write([]byte("first"))
+	record, err := pending.Commit(StoredFile{OriginalName: "a.txt"})
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if _, err := store.Create(testTransferID); err == nil {
+		t.Fatal("second output for the same transfer was accepted")
+	}
+	if data, err := os.ReadFile(record.Path); err != nil || string(data) != "first" {
+		t.Errorf("first output changed: %q, %v", data, err)
+	}
+}
+
+func TestCommitRemovesOutputWithoutSidecar(t *testing.T) {
+	store := NewOutputStore(t.TempDir())
+	pending, err := store.Create(testTransferID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending.Write([]byte("orphan"))
+
+	// A sidecar already in the way makes writing it fail after the link
+	dir := filepath.Join(store.filesDir(), testTransferID)
+	if err := os.WriteFile(filepath.Join(dir, "meta.json"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pending.Commit(StoredFile{OriginalName: "a.txt"}); err == nil {
+		t.Fatal("Commit succeeded without writing its sidecar")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("output left behind without a sidecar: %v", err)
+	}
+}
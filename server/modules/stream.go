@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"protocol"
+)
+
+// Payloads are encrypted as the segment stream laid out in
+// protocol/stream.go, so they can be decrypted and written out without
+// holding the whole file in memory.
+
+// streamWriter encrypts everything written to it into dst
+type streamWriter struct {
+	aead    cipher.AEAD
+	dst     io.Writer
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+// newStreamWriter starts an encrypted stream on dst. Close must be called to
+// write the final segment.
+func newStreamWriter(dst io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := protocol.NewStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, protocol.StreamNoncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	if _, err := dst.Write(prefix); err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		aead:   aead,
+		dst:    dst,
+		prefix: prefix,
+		buf:    make([]byte, 0, protocol.StreamSegmentSize+aead.Overhead()),
+	}, nil
+}
+
+// Write buffers plaintext and seals every full segment that is known not to
+// be the last one
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data proves it is not final
+		if len(w.buf) == protocol.StreamSegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):protocol.StreamSegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final segment
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// seal encrypts the buffered plaintext as the next segment
+func (w *streamWriter) seal(final bool) error {
+	if w.counter == math.MaxUint32 {
+		return errors.New("stream too long")
+	}
+	sealed := w.aead.Seal(w.buf[:0], protocol.StreamNonce(w.prefix, w.counter, final), w.buf, nil)
+	if _, err := w.dst.Write(sealed); err != nil {
+		return err
+	}
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// decryptStream decrypts an encrypted stream from src into dst one segment
+// at a time. Plaintext of a segment is only written once it has been
+// authenticated, but callers must still discard dst if an error is returned,
+// since earlier segments will already have been written.
+func decryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := protocol.NewStreamAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	sealedSize := protocol.StreamSegmentSize + aead.Overhead()
+	reader := bufio.NewReaderSize(src, sealedSize)
+
+	prefix := make([]byte, protocol.StreamNoncePrefixSize)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return fmt.Errorf("ciphertext too short")
+	}
+
+	buf := make([]byte, sealedSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(reader, buf)
+		final := false
+		switch err {
+		case nil:
+			// A full segment is final only if nothing follows it
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				final = true
+			} else if peekErr != nil {
+				return peekErr
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			final = true
+		default:
+			return err
+		}
+
+		if n < aead.Overhead() {
+			return fmt.Errorf("ciphertext truncated")
+		}
+
+		plaintext, err := aead.Open(buf[:0], protocol.StreamNonce(prefix, counter, final), buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt segment %d: %v", counter, err)
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return errors.New("stream too long")
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"protocol"
+)
+
+// sealForTest encrypts plaintext into a stream under key
+func sealForTest(t *testing.T, plaintext, key []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newStreamWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in uneven pieces to exercise segment buffering
+	for len(plaintext) > 0 {
+		n := len(plaintext)
+		if n > 1000 {
+			n = 1000
+		}
+		if _, err := w.Write(plaintext[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plaintext = plaintext[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	for _, size := range []int{0, 1, protocol.StreamSegmentSize - 1, protocol.StreamSegmentSize, protocol.StreamSegmentSize + 1, 3*protocol.StreamSegmentSize + 17} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		var out bytes.Buffer
+		if err := decryptStream(&out, bytes.NewReader(sealForTest(t, plaintext, key)), key); err != nil {
+			t.Fatalf("size %d: decryptStream: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plaintext) {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestStreamRejectsTamperingAndTruncation(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	plaintext := make([]byte, 2*protocol.StreamSegmentSize+100)
+	sealed := sealForTest(t, plaintext, key)
+	segment := protocol.StreamSegmentSize + protocol.StreamTagSize
+
+	wrongKey := make([]byte, 32)
+	tests := map[string]struct {
+		data []byte
+		key  []byte
+	}{
+		"wrong key":          {sealed, wrongKey},
+		"flipped bit":        {append(append([]byte{}, sealed[:100]...), append([]byte{sealed[100] ^ 1}, sealed[101:]...)...), key},
+		"final segment cut":  {sealed[:protocol.StreamNoncePrefixSize+2*segment], key},
+		"only nonce prefix":  {sealed[:protocol.StreamNoncePrefixSize], key},
+		"empty":              {nil, key},
+		"trailing bytes cut": {sealed[:len(sealed)-1], key},
+	}
+	for name, tt := range tests {
+		if err := decryptStream(&bytes.Buffer{}, bytes.NewReader(tt.data), tt.key); err == nil {
+			t.Errorf("%s: decryptStream succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"protocol"
+)
+
+// TLSConfig selects how the receiver serves TLS: from a certificate and key
+// file, or from a self-signed certificate generated on first start and kept
+// below the output root so its fingerprint stays the same across restarts.
+// With neither, the receiver serves plain HTTP.
+type TLSConfig struct {
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	SelfSigned bool   `json:"self_signed"`
+}
+
+// Self-signed certificate files below the output root
+const (
+	selfSignedDir      = "tls"
+	selfSignedCertName = "cert.pem"
+	selfSignedKeyName  = "key.pem"
+)
+
+// selfSignedValidity is how long a generated certificate is valid for
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// Enabled reports whether TLS is configured
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.SelfSigned
+}
+
+// Validate checks that exactly one certificate source is configured
+func (c TLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	if c.SelfSigned && c.CertFile != "" {
+		return fmt.Errorf("use either TLS certificate files or a self-signed certificate, not both")
+	}
+	return nil
+}
+
+// LoadCertificate returns the certificate the receiver serves, generating
+// and storing a self-signed one below outputDir if none exists yet
+func (c TLSConfig) LoadCertificate(outputDir string) (tls.Certificate, error) {
+	if !c.SelfSigned {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return cert, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		return cert, nil
+	}
+
+	dir := filepath.Join(outputDir, selfSignedDir)
+	certPath := filepath.Join(dir, selfSignedCertName)
+	keyPath := filepath.Join(dir, selfSignedKeyName)
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().Before(leaf.NotAfter) {
+			return cert, nil
+		}
+		log.Printf("Warning: self-signed certificate %s has expired; generating a new one", certPath)
+	} else if !os.IsNotExist(err) {
+		log.Printf("Warning: cannot load self-signed certificate %s (%v); generating a new one", certPath, err)
+	}
+
+	certPEM, keyPEM, err := generateSelfSigned(time.Now())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, fmt.Errorf("error creating TLS directory: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("error writing TLS key: %v", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, fmt.Errorf("error writing TLS certificate: %v", err)
+	}
+	log.Printf("Generated self-signed TLS certificate %s", certPath)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// generateSelfSigned creates an ECDSA P-256 certificate for localhost, the
+// loopback addresses and this host's name, returned as PEM
+func generateSelfSigned(now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate TLS key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[len(names)-1]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode TLS key: %v", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// ServerTLSConfig returns the TLS settings the receiver listens with
+func ServerTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// CertificateFingerprint returns the fingerprint clients pin the receiver's
+// certificate with
+func CertificateFingerprint(cert tls.Certificate) string {
+	return protocol.CertificateFingerprint(cert.Certificate[0])
+}
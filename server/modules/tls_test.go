@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCertificateIsKept(t *testing.T) {
+	dir := t.TempDir()
+	cfg := TLSConfig{SelfSigned: true}
+
+	first, err := cfg.LoadCertificate(dir)
+	if err != nil {
+		t.Fatalf("LoadCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(first.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("certificate does not cover loopback: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, selfSignedDir, selfSignedKeyName)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file: %v, %v", info, err)
+	}
+
+	// A restart serves the same certificate, so pins keep working
+	second, err := cfg.LoadCertificate(dir)
+	if err != nil {
+		t.Fatalf("LoadCertificate after restart: %v", err)
+	}
+	if CertificateFingerprint(first) != CertificateFingerprint(second) {
+		t.Error("self-signed certificate changed across restarts")
+	}
+
+	// Certificate files load the same certificate
+	files := TLSConfig{
+		CertFile: filepath.Join(dir, selfSignedDir, selfSignedCertName),
+		KeyFile:  filepath.Join(dir, selfSignedDir, selfSignedKeyName),
+	}
+	third, err := files.LoadCertificate(t.TempDir())
+	if err != nil || CertificateFingerprint(third) != CertificateFingerprint(first) {
+		t.Errorf("loading the certificate files: %v", err)
+	}
+}
+
+func TestExpiredSelfSignedCertificateReplaced(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM, err := generateSelfSigned(time.Now().Add(-2 * selfSignedValidity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, selfSignedDir), 0700)
+	os.WriteFile(filepath.Join(dir, selfSignedDir, selfSignedCertName), certPEM, 0644)
+	os.WriteFile(filepath.Join(dir, selfSignedDir, selfSignedKeyName), keyPEM, 0600)
+
+	cert, err := TLSConfig{SelfSigned: true}.LoadCertificate(dir)
+	if err != nil {
+		t.Fatalf("LoadCertificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if !time.Now().Before(leaf.NotAfter) {
+		t.Error("expired certificate still served")
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg   TLSConfig
+		valid bool
+	}{
+		{TLSConfig{}, true},
+		{TLSConfig{CertFile: "c.pem", KeyFile: "k.pem"}, true},
+		{TLSConfig{SelfSigned: true}, true},
+		{TLSConfig{CertFile: "c.pem"}, false},
+		{TLSConfig{KeyFile: "k.pem"}, false},
+		{TLSConfig{CertFile: "c.pem", KeyFile: "k.pem", SelfSigned: true}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v, want valid %v", tt.cfg, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"protocol"
+)
+
+// Outcomes of verifying a stored output
+const (
+	VerifyOK = "ok"
+	// VerifyModified means the file no longer hashes to its record
+	VerifyModified = "modified"
+	// VerifyMissing means the recorded file is gone
+	VerifyMissing = "missing"
+	// VerifyAuditMismatch means the record disagrees with the audit log
+	VerifyAuditMismatch = "audit_mismatch"
+	// VerifyUnrecorded means an output directory has no readable record
+	VerifyUnrecorded = "unrecorded"
+)
+
+// FileVerification is the outcome of re-hashing one stored output
+type FileVerification struct {
+	TransferID string      `json:"transfer_id"`
+	Status     string      `json:"status"`
+	Detail     string      `json:"detail,omitempty"`
+	Record     *StoredFile `json:"record,omitempty"`
+	// ActualSHA256 and ActualSize describe the file as found on disk
+	ActualSHA256 string `json:"actual_sha256,omitempty"`
+	ActualSize   int64  `json:"actual_size"`
+	// Audited is set when the audit log holds the transfer's completion
+	// and it agrees with the record
+	Audited bool `json:"audited"`
+}
+
+// VerificationReport is the outcome of verifying an output store
+type VerificationReport struct {
+	VerifiedAt time.Time           `json:"verified_at"`
+	Engagement string              `json:"engagement,omitempty"`
+	Files      []*FileVerification `json:"files"`
+	Failed     int                 `json:"failed"`
+}
+
+// Verify re-hashes every stored output of the engagement, or of all
+// engagements if it is empty, and compares it with its sidecar record.
+// Records are also checked against the completions in the audit log when
+// records is not nil, so a file replaced together with its sidecar is
+// noticed too, as is a completed transfer whose output is gone without a
+// deletion in the deletion manifest.
+func (s *OutputStore) Verify(engagementID string, records []AuditRecord, now time.Time) (*VerificationReport, error) {
+	report := &VerificationReport{VerifiedAt: now.UTC(), Engagement: engagementID, Files: []*FileVerification{}}
+
+	completed := make(map[string]AuditRecord)
+	for _, rec := range records {
+		if rec.Event == AuditComplete && !rec.Canary {
+			completed[rec.TransferID] = rec
+		}
+	}
+
+	stored, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]bool, len(stored))
+	for _, record := range stored {
+		recorded[record.TransferID] = true
+		if engagementID != "" && record.Engagement != engagementID {
+			continue
+		}
+		result := verifyFile(record)
+		if result.Status == VerifyOK && records != nil {
+			checkAudit(result, completed)
+		}
+		report.Files = append(report.Files, result)
+	}
+
+	// Output directories List skipped because their record is unreadable
+	entries, err := os.ReadDir(s.filesDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading output directory: %v", err)
+	}
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || !protocol.IsValidTransferID(entry.Name()) {
+			continue
+		}
+		present[entry.Name()] = true
+		if recorded[entry.Name()] {
+			continue
+		}
+		if engagementID != "" && completed[entry.Name()].Engagement != engagementID {
+			continue
+		}
+		report.Files = append(report.Files, &FileVerification{
+			TransferID: entry.Name(),
+			Status:     VerifyUnrecorded,
+			Detail:     "no readable meta.json",
+		})
+	}
+
+	// Completed transfers whose output went without a recorded deletion
+	if records != nil {
+		deletions, err := s.Deletions()
+		if err != nil {
+			return nil, err
+		}
+		deleted := make(map[string]bool, len(deletions))
+		for _, deletion := range deletions {
+			if deletion.Kind == "output" {
+				deleted[deletion.TransferID] = true
+			}
+		}
+		for _, rec := range records {
+			if rec.Event != AuditComplete || rec.Canary || present[rec.TransferID] || deleted[rec.TransferID] {
+				continue
+			}
+			if engagementID != "" && rec.Engagement != engagementID {
+				continue
+			}
+			present[rec.TransferID] = true
+			report.Files = append(report.Files, &FileVerification{
+				TransferID: rec.TransferID,
+				Status:     VerifyMissing,
+				Detail:     fmt.Sprintf("completed at %s but neither stored nor deleted", rec.Time.Format(time.RFC3339)),
+			})
+		}
+	}
+
+	for _, result := range report.Files {
+		if result.Status != VerifyOK {
+			report.Failed++
+		}
+	}
+	return report, nil
+}
+
+// verifyFile re-hashes the file a record describes
+func verifyFile(record *StoredFile) *FileVerification {
+	result := &FileVerification{TransferID: record.TransferID, Record: record}
+
+	f, err := os.Open(record.Path)
+	if err != nil {
+		result.Status = VerifyMissing
+		result.Detail = err.Error()
+		return result
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	result.ActualSize, err = io.Copy(hasher, f)
+	if err != nil {
+		result.Status = VerifyMissing
+		result.Detail = fmt.Sprintf("error reading file: %v", err)
+		return result
+	}
+	result.ActualSHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+	// Outputs encrypted at rest are checked as stored, without the key
+	expectedSHA256, expectedSize := record.storedDigest()
+	switch {
+	case result.ActualSHA256 != expectedSHA256:
+		result.Status = VerifyModified
+		result.Detail = fmt.Sprintf("SHA-256 is %s, recorded %s", result.ActualSHA256, expectedSHA256)
+	case result.ActualSize != expectedSize:
+		result.Status = VerifyModified
+		result.Detail = fmt.Sprintf("size is %d bytes, recorded %d", result.ActualSize, expectedSize)
+	default:
+		result.Status = VerifyOK
+	}
+	return result
+}
+
+// checkAudit compares a verified record with the transfer's completion in
+// the audit log. Outputs stored before the audit log existed have no
+// completion and are only reported as unaudited.
+func checkAudit(result *FileVerification, completed map[string]AuditRecord) {
+	rec, ok := completed[result.TransferID]
+	if !ok {
+		return
+	}
+	record := result.Record
+	storedSHA256, storedSize := record.storedDigest()
+	switch {
+	case rec.StoredSHA256 != storedSHA256 || rec.StoredSize != storedSize:
+		result.Status = VerifyAuditMismatch
+		result.Detail = fmt.Sprintf("audit log recorded %s (%d bytes)", rec.StoredSHA256, rec.StoredSize)
+	case record.CiphertextSHA256 != "" && rec.Checksum != record.CiphertextSHA256:
+		result.Status = VerifyAuditMismatch
+		result.Detail = fmt.Sprintf("audit log recorded ciphertext %s", rec.Checksum)
+	case rec.Engagement != record.Engagement:
+		result.Status = VerifyAuditMismatch
+		result.Detail = fmt.Sprintf("audit log recorded engagement %s", rec.Engagement)
+	default:
+		result.Audited = true
+	}
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *VerificationReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes one line per stored output followed by a summary
+func (r *VerificationReport) WriteText(w io.Writer) error {
+	for _, f := range r.Files {
+		line := fmt.Sprintf("%-14s %s", f.Status, f.TransferID)
+		if rec := f.Record; rec != nil {
+			digest, size := rec.storedDigest()
+			name := strconv.Quote(rec.OriginalName)
+			if rec.Encryption != "" {
+				name = "encrypted at rest"
+			}
+			line += fmt.Sprintf("  sha256 %s  %d bytes  engagement %s  from %s  stored %s  %s",
+				digest, size, rec.Engagement, rec.Source, rec.StoredAt.Format(time.RFC3339), name)
+		}
+		if f.Status == VerifyOK && !f.Audited {
+			line += "  (not in audit log)"
+		}
+		if f.Detail != "" {
+			line += "  " + f.Detail
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "Verified %d stored files at %s: %d failed\n",
+		len(r.Files), r.VerifiedAt.Format(time.RFC3339), r.Failed)
+	return err
+}
+
+// RunVerifyCommand implements the "verify" subcommand:
+//
+//	verify [-output <dir>] [-audit-log <file>] [-engagement <id>] [-format text|json]
+//
+// It fails when any stored output does not match its record.
+func RunVerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	outputDir := fs.String("output", DefaultConfig().OutputDir, "Output root directory")
+	auditPath := fs.String("audit-log", "", "Audit log to check records against (default <output>/audit.jsonl)")
+	engagementID := fs.String("engagement", "", "Only verify this engagement's outputs")
+	format := fs.String("format", "text", "Output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	if *auditPath == "" {
+		*auditPath = filepath.Join(*outputDir, AuditLogName)
+	}
+
+	// Without an audit log the records are only checked against the files
+	var records []AuditRecord
+	if f, err := os.Open(*auditPath); err == nil {
+		records, err = ReadAuditLog(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if records == nil {
+			records = []AuditRecord{}
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error opening audit log: %v", err)
+	}
+
+	report, err := NewOutputStore(*outputDir).Verify(*engagementID, records, time.Now())
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		err = report.WriteJSON(os.Stdout)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d stored files failed verification", report.Failed, len(report.Files))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// completeTransfer sends plaintext as a complete transfer and returns its record
+func completeTransfer(t *testing.T, transferID string, plaintext []byte) *StoredFile {
+	t.Helper()
+	payload := encryptForTest(t, transferID, plaintext, "test-key")
+	sendTransfer(t, transferID, payload, 64)
+	expectCode(t, doRequest(fmt.Sprintf("complete/%s/%s", transferID, calculateSHA256(payload))),
+		http.StatusOK, CodeTransferCompleted)
+
+	stored, err := outputStore.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range stored {
+		if record.TransferID == transferID {
+			return record
+		}
+	}
+	t.Fatalf("no stored output for %s", transferID)
+	return nil
+}
+
+func TestSidecarRecordsProvenance(t *testing.T) {
+	resetState(t, DefaultLimits())
+	path := withAuditLog(t)
+	before := time.Now().UTC()
+	record := completeTransfer(t, testTransferID, []byte("custody"))
+
+	if record.Source != "192.0.2.1:1234" || record.Engagement != "test-engagement" || record.OriginalName != "file.txt" {
+		t.Errorf("sidecar provenance: %+v", record)
+	}
+	for _, rec := range readAudit(t, path) {
+		if rec.Event == AuditComplete && rec.Checksum != record.CiphertextSHA256 {
+			t.Errorf("ciphertext hash %q, completed with %q", record.CiphertextSHA256, rec.Checksum)
+		}
+	}
+	if record.InitialisedAt.Before(before.Add(-time.Second)) || record.StoredAt.Before(record.InitialisedAt) {
+		t.Errorf("timestamps: initialised %s, stored %s", record.InitialisedAt, record.StoredAt)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	resetState(t, DefaultLimits())
+	path := withAuditLog(t)
+
+	ids := make([]string, 7)
+	records := make([]*StoredFile, len(ids))
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%064x", i+1)
+		records[i] = completeTransfer(t, ids[i], []byte(fmt.Sprintf("output %d", i)))
+	}
+
+	// Untouched, modified, missing, replaced with its sidecar, unrecorded,
+	// removed with its record, and deleted by retention
+	os.WriteFile(records[1].Path, []byte("tampered"), 0600)
+	os.Remove(records[2].Path)
+	replaced := *records[3]
+	replaced.SHA256, replaced.Size = calculateSHA256("forged"), int64(len("forged"))
+	sidecar, _ := json.Marshal(replaced)
+	os.WriteFile(filepath.Join(filepath.Dir(records[3].Path), "meta.json"), sidecar, 0600)
+	os.WriteFile(filepath.Join(filepath.Dir(records[3].Path), replaced.SHA256), []byte("forged"), 0600)
+	os.Remove(filepath.Join(filepath.Dir(records[4].Path), "meta.json"))
+	os.RemoveAll(filepath.Dir(records[5].Path))
+	if _, err := outputStore.Delete(records[6], DeleteReasonMaxAge); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := outputStore.Verify("", readAudit(t, path), time.Now())
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	want := map[string]string{
+		ids[0]: VerifyOK,
+		ids[1]: VerifyModified,
+		ids[2]: VerifyMissing,
+		ids[3]: VerifyAuditMismatch,
+		ids[4]: VerifyUnrecorded,
+		ids[5]: VerifyMissing,
+	}
+	if len(report.Files) != len(want) || report.Failed != 5 {
+		t.Errorf("%d files verified, %d failed; want %d, 5", len(report.Files), report.Failed, len(want))
+	}
+	for _, f := range report.Files {
+		if f.Status != want[f.TransferID] {
+			t.Errorf("%s: status %s, want %s (%s)", f.TransferID, f.Status, want[f.TransferID], f.Detail)
+		}
+		if f.TransferID == ids[0] && !f.Audited {
+			t.Error("untouched output not matched to the audit log")
+		}
+	}
+
+	// Without the audit log the replaced output cannot be told apart
+	report, err = outputStore.Verify("", nil, time.Now())
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	for _, f := range report.Files {
+		if f.TransferID == ids[3] && f.Status != VerifyOK {
+			t.Errorf("replaced output without audit log: %s", f.Status)
+		}
+	}
+
+	// Other engagements are left out
+	if report, _ := outputStore.Verify("other", nil, time.Now()); len(report.Files) != 0 {
+		t.Errorf("%d files verified for another engagement", len(report.Files))
+	}
+}